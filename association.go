@@ -17,8 +17,13 @@ type Association struct {
 	Profile         string          `json:"profile"`
 	ProfileUploaded string          `json:"profileuploaded"`
 	Cover           string          `json:"cover"`
-	BgColor         string          `json:"bgcolor"`
-	FgColor         string          `json:"fgcolor"`
+	// The placeholders are displayed while the images load
+	ProfilePlaceholder ImagePlaceholder `json:"profileplaceholder"`
+	CoverPlaceholder   ImagePlaceholder `json:"coverplaceholder"`
+	BgColor            string           `json:"bgcolor"`
+	FgColor            string           `json:"fgcolor"`
+	Language           string           `json:"language" bson:"language,omitempty"`
+	SearchPrefixes     []string         `json:"-" bson:"searchprefixes"`
 }
 
 // Associations is an array of Association
@@ -39,9 +44,12 @@ func AddAssociation(association Association) Association {
 	defer session.Close()
 	db := session.DB("insapp").C("association")
 
+	association = withAssociationImages(association)
+	association.SearchPrefixes = searchPrefixesOf(association.Name)
 	db.Insert(association)
 	var result Association
 	db.Find(bson.M{"name": association.Name}).One(&result)
+	setAssociationImageReferences(result)
 
 	return result
 }
@@ -56,28 +64,56 @@ func UpdateAssociation(id bson.ObjectId, association Association) Association {
 	if association.ProfileUploaded != "" {
 		association.Profile, _ = ResizeImage(association.ProfileUploaded, 256, 256)
 	}
+	association = withAssociationImages(association)
+
+	var current Association
+	db.FindId(id).One(&current)
 
 	associationID := bson.M{"_id": id}
 	change := bson.M{"$set": bson.M{
-		"name":            association.Name,
-		"email":           association.Email,
-		"description":     association.Description,
-		"profile":         association.Profile,
-		"profileuploaded": association.ProfileUploaded,
-		"cover":           association.Cover,
-		"palette":         association.Palette,
-		"selectedcolor":   association.SelectedColor,
-		"bgcolor":         association.BgColor,
-		"fgcolor":         association.FgColor,
+		"name":               association.Name,
+		"searchprefixes":     searchPrefixesOf(association.Name),
+		"email":              association.Email,
+		"description":        association.Description,
+		"profile":            association.Profile,
+		"profileuploaded":    association.ProfileUploaded,
+		"cover":              association.Cover,
+		"profileplaceholder": association.ProfilePlaceholder,
+		"coverplaceholder":   association.CoverPlaceholder,
+		"palette":            association.Palette,
+		"selectedcolor":      association.SelectedColor,
+		"bgcolor":            association.BgColor,
+		"fgcolor":            association.FgColor,
+		"language":           supportedLanguage(association.Language),
 	}}
 
 	db.Update(associationID, change)
 	var result Association
 	db.Find(bson.M{"_id": id}).One(&result)
+	// The references only change along with the images
+	if result.Profile != current.Profile || result.ProfileUploaded != current.ProfileUploaded || result.Cover != current.Cover {
+		setAssociationImageReferences(result)
+	}
 
 	return result
 }
 
+// withAssociationImages derives the colors of the association from the
+// palette of its cover, or of its profile picture without cover, and adds
+// the placeholders of these images
+func withAssociationImages(association Association) Association {
+	image := association.Cover
+	if image == "" {
+		image = association.ProfileUploaded
+	}
+
+	association.Palette, association.SelectedColor, association.BgColor, association.FgColor = deriveColors(image, association.Palette, association.SelectedColor, association.BgColor, association.FgColor)
+	association.ProfilePlaceholder = GetImagePlaceholder(association.Profile)
+	association.CoverPlaceholder = GetImagePlaceholder(association.Cover)
+
+	return association
+}
+
 // DeleteAssociation will delete the given association from the database
 func DeleteAssociation(id bson.ObjectId) Association {
 	session := GetMongoSession()
@@ -93,6 +129,7 @@ func DeleteAssociation(id bson.ObjectId) Association {
 	}
 
 	db.RemoveId(id)
+	RemoveImageReferences(id)
 	var result Association
 	db.FindId(id).One(result)
 
@@ -151,18 +188,34 @@ func GetMyAssociations(id bson.ObjectId) []bson.ObjectId {
 	return res
 }
 
-// SearchAssociation return an array of all Association found with the given search string.
-func SearchAssociation(name string) Associations {
+// SearchAssociation returns the associations whose name or description
+// match the search, the most relevant first, and whether more associations
+// follow
+func SearchAssociation(search Search) (Associations, bool) {
+	ids, more := searchIDs("association", search, nil)
+	if len(ids) == 0 {
+		return Associations{}, false
+	}
+
 	session := GetMongoSession()
 	defer session.Close()
 	db := session.DB("insapp").C("association")
 
-	var result Associations
-	db.Find(bson.M{"$or": []interface{}{
-		bson.M{"name": bson.M{"$regex": bson.RegEx{`^.*` + name + `.*`, "i"}}},
-		bson.M{"description": bson.M{"$regex": bson.RegEx{`^.*` + name + `.*`, "i"}}}}}).All(&result)
+	var found Associations
+	_ = db.Find(bson.M{"_id": bson.M{"$in": ids}}).All(&found)
 
-	return result
+	byID := map[bson.ObjectId]Association{}
+	for _, association := range found {
+		byID[association.ID] = association
+	}
+	result := Associations{}
+	for _, id := range ids {
+		if association, ok := byID[id]; ok {
+			result = append(result, association)
+		}
+	}
+
+	return result, more
 }
 
 // AddEventToAssociation will add the given event ID to the given association
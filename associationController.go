@@ -64,7 +64,7 @@ func AddAssociationController(w http.ResponseWriter, r *http.Request) {
 	user.Password = GetMD5Hash(password)
 	AddAssociationUser(user)
 
-	_ = SendAssociationEmailSubscription(user.Username, password)
+	_ = SendAssociationEmailSubscription(user.Username, res.Language, password)
 	_ = json.NewEncoder(w).Encode(res)
 }
 
@@ -144,6 +144,44 @@ func GetUserFromRequest(r *http.Request) (bson.ObjectId, error) {
 	return authToken.Claims.(*TokenClaims).ID, nil
 }
 
+// GetRoleFromRequest returns the role ("user", "association" or "admin")
+// from the auth cookie.
+func GetRoleFromRequest(r *http.Request) (string, error) {
+	authCookie, err1 := r.Cookie("AuthToken")
+	if err1 != nil {
+		return "", err1
+	}
+
+	authToken, err2 := parseAuthStringToken(authCookie.Value)
+	if err2 != nil {
+		return "", err2
+	}
+
+	return authToken.Claims.(*TokenClaims).Role, nil
+}
+
+// RevokeRefreshTokensForUser deletes every refresh token issued to the given
+// User or AssociationUser.
+func RevokeRefreshTokensForUser(id bson.ObjectId) {
+	session := GetMongoSession()
+	defer session.Close()
+	db := session.DB("insapp").C("tokens")
+
+	db.RemoveAll(bson.M{"userid": id})
+}
+
+// getTokenClaims returns the claims of a parsed or a freshly created token.
+func getTokenClaims(token *jwt.Token) *TokenClaims {
+	switch claims := token.Claims.(type) {
+	case *TokenClaims:
+		return claims
+	case TokenClaims:
+		return &claims
+	}
+
+	return nil
+}
+
 func parseAuthStringToken(authStringToken string) (*jwt.Token, error) {
 	authToken, err := jwt.ParseWithClaims(authStringToken, &TokenClaims{}, func(token *jwt.Token) (interface{}, error) {
 		return verifyKey, nil
@@ -195,7 +233,7 @@ func createRefreshToken(id bson.ObjectId, role string) *jwt.Token {
 	refreshTokenExpiration := time.Now().Add(refreshTokenValidTime).Unix()
 
 	// Store a token in the database
-	token := storeRefreshToken()
+	token := storeRefreshToken(id)
 
 	refreshClaims := TokenClaims{
 		ID:   id,
@@ -256,7 +294,7 @@ func checkRefreshToken(jti string) bool {
 	return err == nil && count > 0
 }
 
-func storeRefreshToken() TokenJTI {
+func storeRefreshToken(id bson.ObjectId) TokenJTI {
 	session := GetMongoSession()
 	defer session.Close()
 	db := session.DB("insapp").C("tokens")
@@ -268,6 +306,7 @@ func storeRefreshToken() TokenJTI {
 
 	var token TokenJTI
 	token.JTI = jti
+	token.UserID = id
 	db.Insert(token)
 
 	return token
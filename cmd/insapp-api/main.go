@@ -14,6 +14,18 @@ type withCORS struct {
 
 func main() {
 	config := insapp.InitConfig()
+	if err := insapp.InitStorage(); err != nil {
+		log.Fatal(err)
+	}
+	insapp.EnsureIndexes()
+	if count, err := insapp.MigrateLikesToReactions(); err != nil {
+		log.Println("error migrating the likes:", err)
+	} else if count > 0 {
+		log.Println(count, "likes migrated to reactions")
+	}
+	insapp.StartOutbox()
+	insapp.StartDigest()
+	insapp.StartReminders()
 
 	log.Println("Starting server on 0.0.0.0:" + config.Port)
 	log.Fatal(http.ListenAndServe(":"+config.Port, &withCORS{insapp.NewRouter()}))
@@ -24,8 +36,8 @@ func (s *withCORS) ServeHTTP(res http.ResponseWriter, req *http.Request) {
 	origin := req.Header.Get("Origin")
 	res.Header().Set("Access-Control-Allow-Origin", origin)
 	res.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
-	res.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, Origin")
-	res.Header().Set("Access-Control-Expose-Headers", "Content-Range")
+	res.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, Origin, Range, If-None-Match, If-Modified-Since")
+	res.Header().Set("Access-Control-Expose-Headers", "Content-Range, ETag")
 
 	// Stop here for a Preflighted OPTIONS request.
 	if req.Method == "OPTIONS" {
@@ -8,6 +8,7 @@ import (
 
 	insapp "github.com/thomas-bouvier/insapp-go"
 	"github.com/urfave/cli"
+	"gopkg.in/mgo.v2"
 )
 
 func main() {
@@ -61,14 +62,69 @@ func main() {
 			},
 		},
 
+		cli.Command{
+			Name:     "reactions",
+			Category: "management",
+			Usage:    "Manage reactions",
+			Subcommands: []cli.Command{
+				{
+					Name:  "migrate",
+					Usage: "Turn the likes stored on posts and users into reactions",
+					Action: func(c *cli.Context) error {
+						insapp.InitConfig()
+						count, err := insapp.MigrateLikesToReactions()
+						if err != nil {
+							return err
+						}
+						fmt.Println(count, " likes migrated")
+						return nil
+					},
+				},
+			},
+		},
+
+		cli.Command{
+			Name:     "webpush",
+			Category: "management",
+			Usage:    "Manage Web Push",
+			Subcommands: []cli.Command{
+				{
+					Name:  "keys",
+					Usage: "Generate a pair of VAPID keys to copy in the configuration",
+					Action: func(c *cli.Context) error {
+						publicKey, privateKey, err := insapp.GenerateVAPIDKeys()
+						if err != nil {
+							return err
+						}
+						fmt.Println("vapid_public_key: ", publicKey)
+						fmt.Println("vapid_private_key:", privateKey)
+						return nil
+					},
+				},
+			},
+		},
+
 		cli.Command{
 			Name:     "cdn",
 			Category: "management",
 			Usage:    "Manage insapp cdn",
 			Subcommands: []cli.Command{
+				{
+					Name:  "index",
+					Usage: "Record the images used by associations, events and posts, needed once for the images uploaded before they were tracked",
+					Action: func(c *cli.Context) error {
+						insapp.InitConfig()
+						if err := insapp.InitStorage(); err != nil {
+							return err
+						}
+						count := insapp.IndexImageReferences()
+						fmt.Println(count, " associations, events and posts indexed")
+						return nil
+					},
+				},
 				{
 					Name:  "clean",
-					Usage: "Clean unused images in insapp-cdn folder",
+					Usage: "Clean the images no association, event or post uses anymore",
 					Flags: []cli.Flag{
 						cli.BoolFlag{
 							Name:  "archive, a",
@@ -82,65 +138,75 @@ func main() {
 							Name:  "list, l",
 							Usage: "List all files that will be affected",
 						},
+						cli.BoolFlag{
+							Name:  "untracked, u",
+							Usage: "Also affect the files of the cdn unknown to the database. Run cdn index first!",
+						},
 					},
 					Action: func(c *cli.Context) error {
-						var usedImages = GetUsedImages()
-						cdnImages, _ := insapp.GetImagesNames()
-						var toDelete []string
-						for _, cdnImage := range cdnImages {
-							delete := true
-							for _, usedImage := range usedImages {
-								if usedImage == cdnImage {
-									delete = false
-									break
-								}
-							}
-							if delete {
-								toDelete = append(toDelete, cdnImage)
+						insapp.InitConfig()
+						if err := insapp.InitStorage(); err != nil {
+							return err
+						}
+						images := insapp.GetUnreferencedImages()
+						var untracked []string
+						if c.Bool("untracked") {
+							var err error
+							untracked, err = insapp.GetUntrackedImages()
+							if err != nil {
+								return err
 							}
 						}
 
 						if c.Bool("list") {
-							for _, imageName := range toDelete {
-								fmt.Println(imageName)
+							for _, image := range images {
+								fmt.Println(image.Name)
+							}
+							for _, fileName := range untracked {
+								fmt.Println(fileName)
 							}
 						}
 
-						fmt.Println(len(usedImages), " images found in database")
-						fmt.Println(len(cdnImages), " images found in cdn")
-						fmt.Println(len(toDelete), " images will be affected")
-
-						if c.Bool("archive") {
-							fmt.Println("Are you sure to archive these files ? (Y/n)")
-							if askForConfirmation("Are you sure to archive these files ? (Y/n)") {
-								fmt.Println("Archiving files...")
-								for _, imageName := range toDelete {
-									err := insapp.ArchiveImage(imageName)
-									if err != nil {
-										return err
-									}
-								}
-								fmt.Println("Done!")
-							}
-							return nil
-						} else if c.Bool("delete") {
-							fmt.Println("Are you sure to delete these files ? (Y/n)")
-							if askForConfirmation("Are you sure to delete these files ? (Y/n)") {
-								fmt.Println("Deleting files...")
-								for _, imageName := range toDelete {
-									err := insapp.DeleteImage(imageName)
-									if err != nil {
-										return err
-									}
-								}
-								fmt.Println("Done!")
-							}
-							return nil
-						} else {
+						fmt.Println(len(images), " unreferenced images found in database")
+						fmt.Println(len(untracked), " untracked files found in cdn")
+
+						archive := c.Bool("archive")
+						if !archive && !c.Bool("delete") {
 							fmt.Println("To list files affected, use -l")
 							fmt.Println("If you're sure to delete these files, use -d but we suggest to archive them with -a")
 							return nil
 						}
+
+						message := "Are you sure to delete these files ? (Y/n)"
+						if archive {
+							message = "Are you sure to archive these files ? (Y/n)"
+						}
+						fmt.Println(message)
+						if !askForConfirmation(message) {
+							return nil
+						}
+
+						fmt.Println("Cleaning files...")
+						for _, image := range images {
+							// Images referenced in the meantime are kept
+							err := insapp.CollectImage(image.Name, archive)
+							if err != nil && err != mgo.ErrNotFound {
+								return err
+							}
+						}
+						for _, fileName := range untracked {
+							var err error
+							if archive {
+								err = insapp.ArchiveImage(fileName)
+							} else {
+								err = insapp.DeleteImage(fileName)
+							}
+							if err != nil {
+								return err
+							}
+						}
+						fmt.Println("Done!")
+						return nil
 					},
 				},
 			},
@@ -193,7 +259,7 @@ func AddAssociationCLI(name string, email string) error {
 	user.Master = true
 	user.Password = insapp.GetMD5Hash(password)
 	insapp.AddAssociationUser(user)
-	err := insapp.SendAssociationEmailSubscription(user.Username, password)
+	err := insapp.SendAssociationEmailSubscription(user.Username, "", password)
 	if err != nil {
 		return err
 	}
@@ -216,36 +282,3 @@ func UpdateAssociationsCLI() error {
 	}
 	return nil
 }
-
-// GetUsedImages return an array of all images file name found in db
-func GetUsedImages() []string {
-	var result []string
-	var assos = insapp.GetAllAssociations()
-	for _, ass := range assos {
-		if ass.Profile != "" {
-			result = append(result, ass.Profile)
-		}
-		if ass.ProfileUploaded != "" {
-			result = append(result, ass.ProfileUploaded)
-		}
-		if ass.Cover != "" {
-			result = append(result, ass.Cover)
-		}
-	}
-
-	var events = insapp.GetEvents()
-	for _, event := range events {
-		if event.Image != "" {
-			result = append(result, event.Image)
-		}
-	}
-
-	var posts = insapp.GetPosts()
-	for _, post := range posts {
-		if post.Image != "" {
-			result = append(result, post.Image)
-		}
-	}
-
-	return result
-}
@@ -9,11 +9,14 @@ import (
 
 // Comment defines how to model a Comment of a Post
 type Comment struct {
-	ID      bson.ObjectId `bson:"_id,omitempty"`
-	User    bson.ObjectId `json:"user"`
-	Content string        `json:"content"`
-	Date    time.Time     `json:"date"`
-	Tags    Tags          `json:"tags"`
+	ID         bson.ObjectId  `bson:"_id,omitempty"`
+	User       bson.ObjectId  `json:"user"`
+	Content    string         `json:"content"`
+	Date       time.Time      `json:"date"`
+	Tags       Tags           `json:"tags"`
+	Hidden     bool           `json:"hidden"`
+	Reactions  map[string]int `json:"reactions" bson:"-"`
+	MyReaction string         `json:"myreaction" bson:"-"`
 }
 
 // Comments is an array of Comment
@@ -27,6 +30,22 @@ type Tag struct {
 
 type Tags []Tag
 
+// removeBlockedTags drops the tags of the users who blocked the author
+func removeBlockedTags(author bson.ObjectId, tags Tags) Tags {
+	result := Tags{}
+	for _, tag := range tags {
+		if !bson.IsObjectIdHex(tag.User) {
+			continue
+		}
+		if GetUser(bson.ObjectIdHex(tag.User)).HasBlocked(author) {
+			continue
+		}
+		result = append(result, tag)
+	}
+
+	return result
+}
+
 // CommentPost will add the given comment object to the
 // list of comments of the post linked to the given id
 func CommentPost(id bson.ObjectId, comment Comment) Post {
@@ -43,6 +62,11 @@ func CommentPost(id bson.ObjectId, comment Comment) Post {
 	var post Post
 	_ = db.Find(bson.M{"_id": id}).One(&post)
 
+	// The comments on hidden posts are only seen by moderators
+	if post.ID != "" && !post.Hidden {
+		publishComment(id, comment)
+	}
+
 	return post
 }
 
@@ -54,6 +78,8 @@ func UncommentPost(id bson.ObjectId, commentID bson.ObjectId) Post {
 	db := session.DB("insapp").C("post")
 
 	DeleteNotificationsForComment(commentID)
+	MarkReportsTargetDeleted(commentID)
+	DeleteReactionsForContent(commentID)
 	postID := bson.M{"_id": id}
 	change := bson.M{"$pull": bson.M{
 		"comments": bson.M{"_id": commentID},
@@ -80,6 +106,11 @@ func CommentEvent(id bson.ObjectId, comment Comment) Event {
 	var event Event
 	_ = db.Find(bson.M{"_id": id}).One(&event)
 
+	// The comments on hidden events are only seen by moderators
+	if event.ID != "" && !event.Hidden {
+		publishComment(id, comment)
+	}
+
 	return event
 }
 
@@ -89,6 +120,8 @@ func UncommentEvent(id bson.ObjectId, commentID bson.ObjectId) Event {
 	db := session.DB("insapp").C("event")
 
 	DeleteNotificationsForComment(commentID)
+	MarkReportsTargetDeleted(commentID)
+	DeleteReactionsForContent(commentID)
 	eventID := bson.M{"_id": id}
 	change := bson.M{"$pull": bson.M{
 		"comments": bson.M{"_id": commentID},
@@ -101,29 +134,54 @@ func UncommentEvent(id bson.ObjectId, commentID bson.ObjectId) Event {
 	return event
 }
 
-func ReportComment(id bson.ObjectId, commentID bson.ObjectId, reporterID bson.ObjectId) {
-	session := GetMongoSession()
-	defer session.Close()
-	db := session.DB("insapp").C("post")
+// ReportComment records a report made by the given reporter on the comment
+// linked to commentID, on the post linked to the given id
+func ReportComment(id bson.ObjectId, commentID bson.ObjectId, reporterID bson.ObjectId, category string, reason string) (Report, error) {
+	comment, err := GetComment(id, commentID)
+	if err != nil {
+		return Report{}, err
+	}
 
-	var post Post
-	_ = db.Find(bson.M{"_id": id}).One(&post)
-	db = session.DB("insapp").C("user")
-	var reporter User
-	_ = db.Find(bson.M{"_id": reporterID}).One(&reporter)
-	for _, comment := range post.Comments {
-		if comment.ID == commentID {
-			var sender User
-			db = session.DB("insapp").C("user")
-			_ = db.Find(bson.M{"_id": comment.User}).One(&sender)
-			SendEmail("aeir@insa-rennes.fr", "Un commentaire a été reporté sur Insapp",
-				"Ce commentaire a été reporté le "+time.Now().String()+
-					"\n\nReporteur:\n"+reporter.ID.Hex()+"\n"+reporter.Username+
-					"\n\nCommentaire:\n"+comment.ID.Hex()+"\n"+comment.Content+
-					"\n\nPost:\n"+post.Title+
-					"\n\nUser:\n"+sender.ID.Hex()+"\n"+sender.Username+"\n"+sender.Name)
-		}
+	report, duplicate := AddReport(Report{
+		Reporter:   reporterID,
+		TargetType: ReportTargetPostComment,
+		Target:     comment.ID,
+		Parent:     id,
+		Category:   category,
+		Reason:     reason,
+	})
+	if !duplicate {
+		sender := GetUser(comment.User)
+		sendReportEmail(report, comment.Content+"\n\nPost:\n"+GetPost(id).Title+
+			"\n\nUser:\n"+sender.ID.Hex()+"\n"+sender.Username+"\n"+sender.Name)
+	}
+
+	return report, nil
+}
+
+// ReportCommentOnEvent records a report made by the given reporter on the
+// comment linked to commentID, on the event linked to the given id
+func ReportCommentOnEvent(id bson.ObjectId, commentID bson.ObjectId, reporterID bson.ObjectId, category string, reason string) (Report, error) {
+	comment, err := GetCommentForEvent(id, commentID)
+	if err != nil {
+		return Report{}, err
 	}
+
+	report, duplicate := AddReport(Report{
+		Reporter:   reporterID,
+		TargetType: ReportTargetEventComment,
+		Target:     comment.ID,
+		Parent:     id,
+		Category:   category,
+		Reason:     reason,
+	})
+	if !duplicate {
+		sender := GetUser(comment.User)
+		sendReportEmail(report, comment.Content+"\n\nEvent:\n"+GetEvent(id).Name+
+			"\n\nUser:\n"+sender.ID.Hex()+"\n"+sender.Username+"\n"+sender.Name)
+	}
+
+	return report, nil
 }
 
 func GetComment(postID bson.ObjectId, id bson.ObjectId) (Comment, error) {
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"log"
 	"os"
+	"strings"
 	"time"
 
 	"gopkg.in/mgo.v2"
@@ -11,18 +12,56 @@ import (
 
 // Config defines how to model a Config
 type Config struct {
-	Domain           string `json:"domain"`
-	Environment      string `json:"env"`
-	GoogleEmail      string `json:"google_email"`
-	GooglePassword   string `json:"google_password"`
-	FirebaseKey      string `json:"firebase_key"`
-	DatabaseName     string `json:"mongo_database_name"`
-	DatabaseSource   string `json:"mongo_database_source"`
-	DatabaseUsername string `json:"mongo_database_username"`
-	DatabasePassword string `json:"mongo_database_password"`
-	PrivateKeyPath   string `json:"private_key_path"`
-	PublicKeyPath    string `json:"public_key_path"`
-	Port             string `json:"port"`
+	Domain            string             `json:"domain"`
+	APIURL            string             `json:"api_url"`
+	Environment       string             `json:"env"`
+	Language          string             `json:"language"`
+	GoogleEmail       string             `json:"google_email"`
+	GooglePassword    string             `json:"google_password"`
+	MailTransport     string             `json:"mail_transport"`
+	MailFrom          string             `json:"mail_from"`
+	MailDirectory     string             `json:"mail_directory"`
+	SMTPHost          string             `json:"smtp_host"`
+	SMTPPort          int                `json:"smtp_port"`
+	SMTPTLS           string             `json:"smtp_tls"`
+	SMTPUsername      string             `json:"smtp_username"`
+	SMTPPassword      string             `json:"smtp_password"`
+	ModerationEmail   string             `json:"moderation_email"`
+	FirebaseKey       string             `json:"firebase_key"`
+	PushProvider      string             `json:"push_provider"`
+	VAPIDPublicKey    string             `json:"vapid_public_key"`
+	VAPIDPrivateKey   string             `json:"vapid_private_key"`
+	VAPIDSubject      string             `json:"vapid_subject"`
+	OutboxWorkers     int                `json:"outbox_workers"`
+	OutboxAttempts    int                `json:"outbox_max_attempts"`
+	StreamBroker      string             `json:"stream_broker"`
+	NotificationTTL   int                `json:"notification_ttl_days"`
+	DatabaseName      string             `json:"mongo_database_name"`
+	DatabaseSource    string             `json:"mongo_database_source"`
+	DatabaseUsername  string             `json:"mongo_database_username"`
+	DatabasePassword  string             `json:"mongo_database_password"`
+	PrivateKeyPath    string             `json:"private_key_path"`
+	PublicKeyPath     string             `json:"public_key_path"`
+	Port              string             `json:"port"`
+	Reactions         []string           `json:"reactions"`
+	Storage           string             `json:"storage"`
+	StorageDirectory  string             `json:"storage_directory"`
+	CDNURL            string             `json:"cdn_url"`
+	S3Endpoint        string             `json:"s3_endpoint"`
+	S3Region          string             `json:"s3_region"`
+	S3Bucket          string             `json:"s3_bucket"`
+	S3AccessKey       string             `json:"s3_access_key"`
+	S3SecretKey       string             `json:"s3_secret_key"`
+	S3PathStyle       bool               `json:"s3_path_style"`
+	ImageMaxSize      int64              `json:"image_max_size"`
+	ImageMaxPixels    int64              `json:"image_max_pixels"`
+	ImageMaxDimension int                `json:"image_max_dimension"`
+	ImageVariants     []ImageVariantSize `json:"image_variants"`
+	ImageResizeSizes  []uint             `json:"image_resize_sizes"`
+	WebPEncoder       string             `json:"webp_encoder"`
+	VideoMaxSize      int64              `json:"video_max_size"`
+	VideoMaxDuration  float64            `json:"video_max_duration"`
+	VideoEncoder      string             `json:"video_encoder"`
 }
 
 var mgoSession *mgo.Session
@@ -63,20 +102,38 @@ func GetMongoSession() *mgo.Session {
 	return mgoSession.Clone()
 }
 
-// GetCDN returns the CDN address depending the configuration.
+// EnsureIndexes creates the indexes of the collections. It is called once
+// at startup rather than before the queries relying on them.
+func EnsureIndexes() {
+	session := GetMongoSession()
+	defer session.Close()
+
+	ensureReportIndexes(session)
+	ensureContentFilterIndexes(session)
+	ensureReactionIndexes(session)
+	ensureNotificationUserIndexes(session)
+	ensureNotificationIndexes(session)
+	ensureSearchIndexes(session)
+	ensureOutboxIndexes(session)
+}
+
+// GetCDN returns the address the files of the CDN are served from,
+// depending on the storage.
 func (config Config) GetCDN() string {
-	var cdn string
-
-	switch config.Environment {
-	case "prod":
-		cdn = "https://" + config.Domain + "/cdn/"
-	case "dev":
-		cdn = "https://" + config.Domain + "/cdn/"
-	case "local":
-		cdn = "http://" + config.Domain + "/cdn/"
+	return getBlobStore().URL()
+}
+
+// GetAPI returns the public address of the API, used in the links sent by email.
+func (config Config) GetAPI() string {
+	if config.APIURL != "" {
+		return strings.TrimSuffix(config.APIURL, "/") + "/"
+	}
+
+	if config.Environment == "local" {
+		return "http://" + config.Domain + "/"
 	}
 
-	return cdn
+	return "https://" + config.Domain + "/"
 }
 
 func initMongoConfig() *mgo.DialInfo {
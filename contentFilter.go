@@ -0,0 +1,215 @@
+package insapp
+
+import (
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// ContentFilter defines the rules applied to every new comment.
+// Only one ContentFilter is stored in the database.
+type ContentFilter struct {
+	ID              bson.ObjectId `bson:"_id,omitempty"`
+	Enabled         bool          `json:"enabled"`
+	RejectedWords   []string      `json:"rejectedwords"`
+	HeldWords       []string      `json:"heldwords"`
+	MaxLinks        int           `json:"maxlinks"`
+	LinksAction     string        `json:"linksaction"`
+	RateLimit       int           `json:"ratelimit"`
+	RateLimitWindow int           `json:"ratelimitwindow"`
+}
+
+// FilterVerdict is the decision taken by the ContentFilter on a comment
+type FilterVerdict struct {
+	Action string `json:"action"`
+	Reason string `json:"reason"`
+}
+
+// The actions the ContentFilter can take on a comment
+const (
+	FilterActionAllow  = "allow"
+	FilterActionHold   = "hold"
+	FilterActionReject = "reject"
+)
+
+// CommentRate records the date of a comment, to rate limit users
+type CommentRate struct {
+	ID   bson.ObjectId `bson:"_id,omitempty"`
+	User bson.ObjectId `json:"user"`
+	Date time.Time     `json:"date"`
+}
+
+const filterReasonRateLimit = "too many comments, try again later"
+
+var linkRegexp = regexp.MustCompile(`(?i)(https?://|www\.)\S+`)
+
+var leetspeak = map[rune]rune{
+	'0': 'o',
+	'1': 'i',
+	'3': 'e',
+	'4': 'a',
+	'5': 's',
+	'7': 't',
+	'8': 'b',
+	'@': 'a',
+	'$': 's',
+	'€': 'e',
+}
+
+// defaultContentFilter is used as long as no moderator saved some rules
+func defaultContentFilter() ContentFilter {
+	return ContentFilter{
+		Enabled:         true,
+		RejectedWords:   []string{},
+		HeldWords:       []string{},
+		MaxLinks:        2,
+		LinksAction:     FilterActionHold,
+		RateLimit:       5,
+		RateLimitWindow: 60,
+	}
+}
+
+// GetContentFilter returns the rules applied to new comments
+func GetContentFilter() ContentFilter {
+	session := GetMongoSession()
+	defer session.Close()
+	db := session.DB("insapp").C("content_filter")
+
+	result := defaultContentFilter()
+	_ = db.Find(bson.M{}).One(&result)
+
+	return result
+}
+
+// UpdateContentFilter replaces the rules applied to new comments
+func UpdateContentFilter(filter ContentFilter) ContentFilter {
+	session := GetMongoSession()
+	defer session.Close()
+	db := session.DB("insapp").C("content_filter")
+
+	if filter.LinksAction != FilterActionReject {
+		filter.LinksAction = FilterActionHold
+	}
+	if filter.RejectedWords == nil {
+		filter.RejectedWords = []string{}
+	}
+	if filter.HeldWords == nil {
+		filter.HeldWords = []string{}
+	}
+
+	var current ContentFilter
+	err := db.Find(bson.M{}).One(&current)
+	if err == nil {
+		filter.ID = current.ID
+	} else {
+		filter.ID = bson.NewObjectId()
+	}
+	_, _ = db.UpsertId(filter.ID, filter)
+
+	return GetContentFilter()
+}
+
+// FilterComment checks the given content written by the given user
+// against the stored rules
+func FilterComment(userID bson.ObjectId, content string) FilterVerdict {
+	filter := GetContentFilter()
+	if !filter.Enabled {
+		return FilterVerdict{Action: FilterActionAllow}
+	}
+
+	if filter.RateLimit > 0 && filter.RateLimitWindow > 0 {
+		window := time.Duration(filter.RateLimitWindow) * time.Second
+		if countRecentComments(userID, window) >= filter.RateLimit {
+			return FilterVerdict{Action: FilterActionReject, Reason: filterReasonRateLimit}
+		}
+	}
+
+	normalized := normalizeContent(content)
+	if word := findWord(normalized, filter.RejectedWords); word != "" {
+		return FilterVerdict{Action: FilterActionReject, Reason: "forbidden word"}
+	}
+
+	if filter.MaxLinks >= 0 && len(linkRegexp.FindAllString(content, -1)) > filter.MaxLinks {
+		return FilterVerdict{Action: filter.LinksAction, Reason: "too many links"}
+	}
+
+	if word := findWord(normalized, filter.HeldWords); word != "" {
+		return FilterVerdict{Action: FilterActionHold, Reason: "suspicious word: " + word}
+	}
+
+	return FilterVerdict{Action: FilterActionAllow}
+}
+
+// RecordComment keeps track of a comment posted by the given user.
+// The records expire on their own after a day.
+func RecordComment(userID bson.ObjectId) {
+	session := GetMongoSession()
+	defer session.Close()
+	db := session.DB("insapp").C("comment_rate")
+
+	_ = db.Insert(CommentRate{User: userID, Date: time.Now()})
+}
+
+// ensureContentFilterIndexes makes the comment records expire after a day
+func ensureContentFilterIndexes(session *mgo.Session) {
+	db := session.DB("insapp").C("comment_rate")
+	_ = db.EnsureIndex(mgo.Index{Key: []string{"date"}, ExpireAfter: 24 * time.Hour})
+	_ = db.EnsureIndex(mgo.Index{Key: []string{"user", "date"}})
+}
+
+func countRecentComments(userID bson.ObjectId, window time.Duration) int {
+	session := GetMongoSession()
+	defer session.Close()
+	db := session.DB("insapp").C("comment_rate")
+
+	count, _ := db.Find(bson.M{
+		"user": userID,
+		"date": bson.M{"$gt": time.Now().Add(-window)},
+	}).Count()
+
+	return count
+}
+
+// findWord returns the first word of the list found in the normalized content
+func findWord(normalized string, words []string) string {
+	padded := " " + normalized + " "
+	for _, word := range words {
+		normalizedWord := normalizeContent(word)
+		if normalizedWord != "" && strings.Contains(padded, " "+normalizedWord+" ") {
+			return word
+		}
+	}
+
+	return ""
+}
+
+// normalizeContent lowers the given content, removes the accents, decodes the
+// leetspeak and squeezes repeated letters, so that "Č0nnnnArD" reads "conard".
+// Words are separated by a single space.
+func normalizeContent(content string) string {
+	var builder strings.Builder
+	var last rune
+	for _, r := range norm.NFD.String(strings.ToLower(content)) {
+		if unicode.Is(unicode.Mn, r) {
+			continue
+		}
+		if replacement, ok := leetspeak[r]; ok {
+			r = replacement
+		}
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			r = ' '
+		}
+		if r == last {
+			continue
+		}
+		builder.WriteRune(r)
+		last = r
+	}
+
+	return strings.TrimSpace(builder.String())
+}
@@ -0,0 +1,75 @@
+package insapp
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// GetContentFilterController will answer a JSON of the rules
+// applied to new comments
+func GetContentFilterController(w http.ResponseWriter, r *http.Request) {
+	res := GetContentFilter()
+	_ = json.NewEncoder(w).Encode(res)
+}
+
+// UpdateContentFilterController will answer a JSON of the
+// modified rules (from the JSON Body). The rules left out of the
+// body keep their current value.
+func UpdateContentFilterController(w http.ResponseWriter, r *http.Request) {
+	filter := GetContentFilter()
+	if err := json.NewDecoder(r.Body).Decode(&filter); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(bson.M{"error": "wrong format"})
+		return
+	}
+
+	res := UpdateContentFilter(filter)
+	_ = json.NewEncoder(w).Encode(res)
+}
+
+// filterCommentFromRequest applies the content filter on the given comment.
+// The author of the comment is always the user making the request.
+// It answers the request and returns false if the comment is rejected.
+// Held comments are hidden until a moderator shows them.
+func filterCommentFromRequest(w http.ResponseWriter, r *http.Request, comment *Comment) (FilterVerdict, bool) {
+	userID, err := GetUserFromRequest(r)
+	if err != nil {
+		w.WriteHeader(http.StatusNotAcceptable)
+		_ = json.NewEncoder(w).Encode(bson.M{"error": "could not get user ID"})
+		return FilterVerdict{}, false
+	}
+	comment.User = userID
+
+	verdict := FilterComment(userID, comment.Content)
+	if verdict.Action == FilterActionReject {
+		if verdict.Reason == filterReasonRateLimit {
+			w.WriteHeader(http.StatusTooManyRequests)
+		} else {
+			w.WriteHeader(http.StatusNotAcceptable)
+		}
+		_ = json.NewEncoder(w).Encode(bson.M{"error": "comment rejected: " + verdict.Reason})
+		return verdict, false
+	}
+
+	RecordComment(userID)
+	comment.Hidden = verdict.Action == FilterActionHold
+
+	return verdict, true
+}
+
+// reportHeldComment adds the held comment to the moderation queue
+func reportHeldComment(verdict FilterVerdict, targetType string, comment Comment, parent bson.ObjectId) {
+	if verdict.Action != FilterActionHold {
+		return
+	}
+
+	AddReport(Report{
+		TargetType: targetType,
+		Target:     comment.ID,
+		Parent:     parent,
+		Category:   "other",
+		Reason:     "automatic filter: " + verdict.Reason,
+	})
+}
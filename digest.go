@@ -0,0 +1,364 @@
+package insapp
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// The frequencies of the email digest. Users receive no digest by default.
+const (
+	DigestNever  = ""
+	DigestDaily  = "daily"
+	DigestWeekly = "weekly"
+)
+
+var digestFrequencies = []string{DigestNever, DigestDaily, DigestWeekly}
+
+var digestPeriods = map[string]time.Duration{
+	DigestDaily:  24 * time.Hour,
+	DigestWeekly: 7 * 24 * time.Hour,
+}
+
+const (
+	digestInterval = time.Hour
+	// digests are sent a bit early rather than an interval too late
+	digestSlack       = 30 * time.Minute
+	digestMaxEvents   = 10
+	digestMaxPosts    = 10
+	digestDateLayout  = "02/01 15:04"
+	digestTokenLength = 24
+)
+
+var digestStartOnce sync.Once
+
+// digestEvent is an event as shown in the digest
+type digestEvent struct {
+	Name        string
+	Association string
+	Date        string
+	Image       string
+}
+
+// digestPost is a post as shown in the digest
+type digestPost struct {
+	Title       string
+	Association string
+	Description string
+	Image       string
+}
+
+// StartDigest starts the job sending the email digests.
+// It can safely be called several times.
+func StartDigest() {
+	digestStartOnce.Do(func() {
+		go func() {
+			for {
+				SendDueDigests()
+				time.Sleep(digestInterval)
+			}
+		}()
+	})
+}
+
+// SendDueDigests sends the digest to every user who did not receive
+// one during the period they chose. It returns the number of digests sent.
+func SendDueDigests() int {
+	session := GetMongoSession()
+	defer session.Close()
+	db := session.DB("insapp").C("user")
+
+	count := 0
+	now := time.Now()
+	for frequency, period := range digestPeriods {
+		var users Users
+		_ = db.Find(bson.M{
+			"notificationpreferences.digest": frequency,
+			"$or": []bson.M{
+				{"lastdigest": bson.M{"$exists": false}},
+				{"lastdigest": bson.M{"$lte": now.Add(digestSlack - period)}},
+			},
+		}).All(&users)
+
+		for _, user := range users {
+			if !claimDigest(db, user, now) {
+				continue
+			}
+
+			since := user.LastDigest
+			if since.IsZero() {
+				since = now.Add(-period)
+			}
+			if sendDigest(user, since) {
+				count++
+			}
+		}
+	}
+
+	return count
+}
+
+// claimDigest records that the digest of the user is being sent, so that
+// other instances of the API do not send it too
+func claimDigest(db *mgo.Collection, user User, now time.Time) bool {
+	selector := bson.M{"_id": user.ID}
+	if user.LastDigest.IsZero() {
+		selector["lastdigest"] = bson.M{"$exists": false}
+	} else {
+		selector["lastdigest"] = user.LastDigest
+	}
+
+	return db.Update(selector, bson.M{"$set": bson.M{"lastdigest": now}}) == nil
+}
+
+// sendDigest sends to the user the upcoming events of their promotion and
+// the posts published since the given date by the associations they interacted
+// with. Nothing is sent if there is nothing new.
+func sendDigest(user User, since time.Time) bool {
+	if user.Email == "" || user.DigestToken == "" {
+		return false
+	}
+
+	preferences := normalizePreferences(user.NotificationPreferences)
+	associations := map[bson.ObjectId]string{}
+	associationName := func(id bson.ObjectId) string {
+		if _, ok := associations[id]; !ok {
+			associations[id] = GetAssociation(id).Name
+		}
+		return associations[id]
+	}
+
+	events := []digestEvent{}
+	if preferences.Allows(NotificationTypeEvent, NotificationChannelEmail) {
+		for _, event := range getDigestEvents(user, preferences) {
+			events = append(events, digestEvent{
+				Name:        event.Name,
+				Association: associationName(event.Association),
+				Date:        event.DateStart.Format(digestDateLayout),
+				Image:       config.GetCDN() + event.Image,
+			})
+		}
+	}
+
+	posts := []digestPost{}
+	if preferences.Allows(NotificationTypePost, NotificationChannelEmail) {
+		for _, post := range getDigestPosts(user, preferences, since) {
+			posts = append(posts, digestPost{
+				Title:       post.Title,
+				Association: associationName(post.Association),
+				Description: post.Description,
+				Image:       config.GetCDN() + post.Image,
+			})
+		}
+	}
+
+	if len(events) == 0 && len(posts) == 0 {
+		return false
+	}
+
+	data := struct {
+		Name           string
+		Events         []digestEvent
+		Posts          []digestPost
+		UnsubscribeURL string
+	}{
+		Name:           user.Name,
+		Events:         events,
+		Posts:          posts,
+		UnsubscribeURL: config.GetAPI() + "digest/unsubscribe?token=" + url.QueryEscape(user.DigestToken),
+	}
+
+	body, err := parseTemplate(localizedTemplate(user.Language, "templates/digest_template.html"), data)
+	if err != nil {
+		log.Printf("error rendering the digest of %s: %v\n", user.Username, err)
+		return false
+	}
+
+	// Mail clients show their own unsubscribe button, which posts to this link
+	_, err = EnqueueEmail(Email{
+		To:      user.Email,
+		Subject: localize(user.Language, "email.digest."+preferences.Digest),
+		HTML:    body,
+		Headers: map[string]string{
+			"List-Unsubscribe":      "<" + data.UnsubscribeURL + ">",
+			"List-Unsubscribe-Post": "List-Unsubscribe=One-Click",
+		},
+	})
+	if err != nil {
+		log.Printf("error sending the digest of %s: %v\n", user.Username, err)
+		return false
+	}
+
+	return true
+}
+
+// getDigestEvents returns the upcoming events targeting the promotion of the user
+func getDigestEvents(user User, preferences NotificationPreferences) Events {
+	promotion := strings.ToUpper(user.Promotion)
+
+	result := Events{}
+	for _, event := range GetFutureEvents() {
+		if event.Hidden || !preferences.AllowsFrom(event.Association, promotion, event.Promotions) {
+			continue
+		}
+		result = append(result, event)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].DateStart.Before(result[j].DateStart)
+	})
+	if len(result) > digestMaxEvents {
+		result = result[:digestMaxEvents]
+	}
+
+	return result
+}
+
+// getDigestPosts returns the posts published since the given date
+// by the associations the user interacted with
+func getDigestPosts(user User, preferences NotificationPreferences, since time.Time) Posts {
+	session := GetMongoSession()
+	defer session.Close()
+	db := session.DB("insapp").C("post")
+
+	associations := getInteractedAssociations(user, preferences)
+	result := Posts{}
+	if len(associations) == 0 {
+		return result
+	}
+
+	_ = db.Find(bson.M{
+		"association": bson.M{"$in": associations},
+		"date":        bson.M{"$gt": since},
+		"hidden":      bson.M{"$ne": true},
+	}).Sort("-date").Limit(digestMaxPosts).All(&result)
+
+	return result
+}
+
+// getInteractedAssociations returns the associations followed by the user,
+// or whose events, posts or comments the user interacted with.
+// Muted associations are left out.
+func getInteractedAssociations(user User, preferences NotificationPreferences) []bson.ObjectId {
+	session := GetMongoSession()
+	defer session.Close()
+	events := session.DB("insapp").C("event")
+	posts := session.DB("insapp").C("post")
+
+	var associations []bson.ObjectId
+	add := func(ids ...bson.ObjectId) {
+		for _, id := range ids {
+			if id != "" && !containsObjectID(associations, id) && !containsObjectID(preferences.Muted, id) {
+				associations = append(associations, id)
+			}
+		}
+	}
+
+	add(preferences.Followed...)
+
+	var documents []struct {
+		Association bson.ObjectId `bson:"association"`
+	}
+	if len(user.Events) > 0 {
+		_ = events.Find(bson.M{"_id": bson.M{"$in": user.Events}}).Select(bson.M{"association": 1}).All(&documents)
+		for _, document := range documents {
+			add(document.Association)
+		}
+	}
+
+	reacted := getReactedPosts(user.ID)
+	_ = posts.Find(bson.M{"$or": []bson.M{
+		{"_id": bson.M{"$in": reacted}},
+		{"comments.user": user.ID},
+	}}).Select(bson.M{"association": 1}).All(&documents)
+	for _, document := range documents {
+		add(document.Association)
+	}
+
+	return associations
+}
+
+// getReactedPosts returns the posts the given user reacted to
+func getReactedPosts(userID bson.ObjectId) []bson.ObjectId {
+	session := GetMongoSession()
+	defer session.Close()
+	db := session.DB("insapp").C("reaction")
+
+	result := []bson.ObjectId{}
+	_ = db.Find(bson.M{"user": userID, "contenttype": ReactionTargetPost}).Distinct("content", &result)
+
+	return result
+}
+
+// ensureDigestToken gives the user linked to the given id the token used
+// to unsubscribe from the digest without logging in, if not done yet
+func ensureDigestToken(id bson.ObjectId) error {
+	session := GetMongoSession()
+	defer session.Close()
+	db := session.DB("insapp").C("user")
+
+	buffer := make([]byte, digestTokenLength)
+	if _, err := rand.Read(buffer); err != nil {
+		return err
+	}
+
+	err := db.Update(
+		bson.M{"_id": id, "digesttoken": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"digesttoken": hex.EncodeToString(buffer)}},
+	)
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+
+	return err
+}
+
+// GetUserWithDigestToken returns the user owning the given token
+func GetUserWithDigestToken(token string) (User, error) {
+	session := GetMongoSession()
+	defer session.Close()
+	db := session.DB("insapp").C("user")
+
+	if token == "" {
+		return User{}, errors.New("no user found")
+	}
+
+	var user User
+	err := db.Find(bson.M{"digesttoken": token}).One(&user)
+	if err != nil {
+		return User{}, errors.New("no user found")
+	}
+
+	return user, nil
+}
+
+// UnsubscribeDigest stops sending the digest to the user owning the given
+// token, and returns this user
+func UnsubscribeDigest(token string) (User, error) {
+	session := GetMongoSession()
+	defer session.Close()
+	db := session.DB("insapp").C("user")
+
+	if token == "" {
+		return User{}, errors.New("no user found")
+	}
+
+	var user User
+	_, err := db.Find(bson.M{"digesttoken": token}).Apply(mgo.Change{
+		Update: bson.M{"$unset": bson.M{"notificationpreferences.digest": ""}},
+	}, &user)
+	if err != nil {
+		return User{}, errors.New("no user found")
+	}
+
+	return user, nil
+}
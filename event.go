@@ -1,6 +1,7 @@
 package insapp
 
 import (
+	"errors"
 	"time"
 
 	"gopkg.in/mgo.v2/bson"
@@ -8,25 +9,28 @@ import (
 
 // Event defines what an Event is
 type Event struct {
-	ID             bson.ObjectId   `bson:"_id,omitempty"`
-	Name           string          `json:"name"`
-	Association    bson.ObjectId   `json:"association" bson:"association"`
-	Description    string          `json:"description"`
-	Participants   []bson.ObjectId `json:"participants" bson:"participants,omitempty"`
-	Maybe          []bson.ObjectId `json:"maybe" bson:"maybe,omitempty"`
-	NotGoing       []bson.ObjectId `json:"notgoing" bson:"notgoing,omitempty"`
-	Comments       Comments        `json:"comments"`
-	Status         string          `json:"status"`
-	Palette        [][]int         `json:"palette"`
-	SelectedColor  int             `json:"selectedcolor"`
-	DateStart      time.Time       `json:"dateStart"`
-	DateEnd        time.Time       `json:"dateEnd"`
-	Image          string          `json:"image"`
-	Promotions     []string        `json:"promotions"`
-	Plateforms     []string        `json:"plateforms"`
-	BgColor        string          `json:"bgColor"`
-	FgColor        string          `json:"fgColor"`
-	NoNotification bool            `json:"nonotification"`
+	ID             bson.ObjectId    `bson:"_id,omitempty"`
+	Name           string           `json:"name"`
+	Association    bson.ObjectId    `json:"association" bson:"association"`
+	Description    string           `json:"description"`
+	Participants   []bson.ObjectId  `json:"participants" bson:"participants,omitempty"`
+	Maybe          []bson.ObjectId  `json:"maybe" bson:"maybe,omitempty"`
+	NotGoing       []bson.ObjectId  `json:"notgoing" bson:"notgoing,omitempty"`
+	Comments       Comments         `json:"comments"`
+	Status         string           `json:"status"`
+	Palette        [][]int          `json:"palette"`
+	SelectedColor  int              `json:"selectedcolor"`
+	DateStart      time.Time        `json:"dateStart"`
+	DateEnd        time.Time        `json:"dateEnd"`
+	Image          string           `json:"image"`
+	Media          []Media          `json:"media"`
+	Placeholder    ImagePlaceholder `json:"placeholder"`
+	Promotions     []string         `json:"promotions"`
+	Plateforms     []string         `json:"plateforms"`
+	BgColor        string           `json:"bgColor"`
+	FgColor        string           `json:"fgColor"`
+	NoNotification bool             `json:"nonotification"`
+	Hidden         bool             `json:"hidden"`
 }
 
 // Events is an array of Event
@@ -88,10 +92,12 @@ func AddEvent(event Event) Event {
 	defer session.Close()
 	db := session.DB("insapp").C("event")
 
+	event = withEventMedia(event)
 	_ = db.Insert(event)
 	var result Event
 	_ = db.Find(bson.M{"name": event.Name, "datestart": event.DateStart}).One(&result)
 	AddEventToAssociation(result.Association, result.ID)
+	setEventImageReferences(result)
 
 	return result
 }
@@ -102,12 +108,18 @@ func UpdateEvent(id bson.ObjectId, event Event) Event {
 	defer session.Close()
 	db := session.DB("insapp").C("event")
 
+	if len(event.Media) == 0 {
+		event.Media = keepMedia(GetEvent(id).Media, event.Image)
+	}
+	event = withEventMedia(event)
 	eventID := bson.M{"_id": id}
 	change := bson.M{"$set": bson.M{
 		"name":           event.Name,
 		"description":    event.Description,
 		"status":         event.Status,
 		"image":          event.Image,
+		"media":          event.Media,
+		"placeholder":    event.Placeholder,
 		"palette":        event.Palette,
 		"selectedcolor":  event.SelectedColor,
 		"datestart":      event.DateStart,
@@ -121,6 +133,7 @@ func UpdateEvent(id bson.ObjectId, event Event) Event {
 	_ = db.Update(eventID, change)
 	var result Event
 	_ = db.Find(bson.M{"_id": id}).One(&result)
+	setEventImageReferences(result)
 	return result
 }
 
@@ -132,6 +145,9 @@ func DeleteEvent(event Event) Event {
 
 	_ = db.Remove(event)
 	DeleteNotificationsForEvent(event.ID)
+	MarkReportsTargetDeleted(event.ID)
+	DeleteReactionsForContent(event.ID)
+	RemoveImageReferences(event.ID)
 	RemoveEventFromAssociation(event.Association, event.ID)
 	for _, userID := range event.Participants {
 		RemoveEventFromUser(userID, event.ID)
@@ -226,16 +242,56 @@ func RemoveAttendee(id bson.ObjectId, userID bson.ObjectId, list string) (Event,
 	return event, user
 }
 
-func SearchEvent(name string) Events {
+// SearchEvent returns the events whose name or description match the
+// search, the most relevant first, and whether more events follow. Hidden
+// events are only found if hidden is true.
+func SearchEvent(search Search, hidden bool) (Events, bool) {
+	ids, more := searchIDs("event", search, hiddenFilter(hidden))
+	if len(ids) == 0 {
+		return Events{}, false
+	}
+
 	session := GetMongoSession()
 	defer session.Close()
 	db := session.DB("insapp").C("event")
 
-	var result Events
-	_ = db.Find(bson.M{"$or": []interface{}{
-		bson.M{"name": bson.M{"$regex": bson.RegEx{Pattern: `^.*` + name + `.*`, Options: "i"}}}, bson.M{"description": bson.M{"$regex": bson.RegEx{Pattern: `^.*` + name + `.*`, Options: "i"}}}}}).All(&result)
+	var found Events
+	_ = db.Find(bson.M{"_id": bson.M{"$in": ids}}).All(&found)
 
-	return result
+	byID := map[bson.ObjectId]Event{}
+	for _, event := range found {
+		byID[event.ID] = event
+	}
+	result := Events{}
+	for _, id := range ids {
+		if event, ok := byID[id]; ok {
+			result = append(result, event)
+		}
+	}
+
+	return result, more
+}
+
+// ReportEvent records a report made by the given reporter on the event linked
+// to the given id
+func ReportEvent(id bson.ObjectId, reporterID bson.ObjectId, category string, reason string) (Report, error) {
+	event := GetEvent(id)
+	if event.ID == "" {
+		return Report{}, errors.New("no event found")
+	}
+
+	report, duplicate := AddReport(Report{
+		Reporter:   reporterID,
+		TargetType: ReportTargetEvent,
+		Target:     event.ID,
+		Category:   category,
+		Reason:     reason,
+	})
+	if !duplicate {
+		sendReportEmail(report, event.Name+"\n"+event.Description)
+	}
+
+	return report, nil
 }
 
 //CommentEvent(eventId, comment)
@@ -16,7 +16,12 @@ import (
 func GetEventController(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	associationID := vars["id"]
-	var res = GetEvent(bson.ObjectIdHex(associationID))
+	res, ok := visibleEvent(GetEvent(bson.ObjectIdHex(associationID)), getViewer(r))
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		_ = json.NewEncoder(w).Encode(bson.M{"error": "no event found"})
+		return
+	}
 	_ = json.NewEncoder(w).Encode(res)
 }
 
@@ -32,7 +37,7 @@ func GetFutureEventsController(w http.ResponseWriter, r *http.Request) {
 
 	user := GetUser(id)
 	os := GetNotificationUserForUser(id).Os
-	events := GetFutureEvents()
+	events := visibleEvents(GetFutureEvents(), getViewer(r))
 	res := Events{}
 	if user.ID != "" {
 		for _, event := range events {
@@ -49,7 +54,7 @@ func GetFutureEventsController(w http.ResponseWriter, r *http.Request) {
 func GetEventsForAssociationController(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	associationID := vars["id"]
-	events := GetEventsForAssociation(bson.ObjectIdHex(associationID))
+	events := visibleEvents(GetEventsForAssociation(bson.ObjectIdHex(associationID)), getViewer(r))
 	_ = json.NewEncoder(w).Encode(events)
 }
 
@@ -64,7 +69,7 @@ func AddEventController(w http.ResponseWriter, r *http.Request) {
 	res := AddEvent(event)
 	association := GetAssociation(event.Association)
 	_ = json.NewEncoder(w).Encode(res)
-	go TriggerNotificationForEvent(event, association.ID, res.ID, "@"+strings.ToLower(association.Name)+" t'invite à "+res.Name+" 📅")
+	EnqueueEventNotification(association.ID, res.ID)
 }
 
 // UpdateEventController will answer the JSON
@@ -145,6 +150,7 @@ func CommentEventController(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		_ = json.NewEncoder(w).Encode(bson.M{"error": "Unable to read the request body"})
+		return
 	}
 	var comment Comment
 	if err := json.Unmarshal([]byte(string(body)), &comment); err != nil {
@@ -153,8 +159,14 @@ func CommentEventController(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	verdict, ok := filterCommentFromRequest(w, r, &comment)
+	if !ok {
+		return
+	}
+
 	comment.ID = bson.NewObjectId()
 	comment.Date = time.Now()
+	comment.Tags = removeBlockedTags(comment.User, comment.Tags)
 
 	vars := mux.Vars(r)
 	eventID := vars["id"]
@@ -163,15 +175,26 @@ func CommentEventController(w http.ResponseWriter, r *http.Request) {
 	association := GetAssociation(event.Association)
 	user := GetUser(comment.User)
 
-	_ = json.NewEncoder(w).Encode(event)
+	res, _ := visibleEvent(event, getViewer(r))
+	if comment.Hidden {
+		w.WriteHeader(http.StatusAccepted)
+	}
+	_ = json.NewEncoder(w).Encode(res)
+
+	// Held comments wait for a moderator before anyone is notified
+	if comment.Hidden {
+		reportHeldComment(verdict, ReportTargetEventComment, comment, event.ID)
+		return
+	}
 
 	if !event.NoNotification {
-		_ = SendAssociationEmailForCommentOnEvent(association.Email, event, comment, user)
+		_ = SendAssociationEmailForCommentOnEvent(association, event, comment, user)
 	}
 
 	for _, tag := range comment.Tags {
-		go TriggerNotificationForUserFromEvent(comment.User, bson.ObjectIdHex(tag.User), event.ID, "@"+GetUser(comment.User).Username+" t'a taggé sur '"+event.Name+"'", comment, "eventTag")
+		go TriggerNotificationForUserFromEvent(comment.User, bson.ObjectIdHex(tag.User), event.ID, event.Name, comment, "eventTag")
 	}
+	go TriggerReplyNotificationsForEvent(event, comment)
 }
 
 // UncommentEventController will answer a JSON of the event
@@ -180,7 +203,56 @@ func UncommentEventController(w http.ResponseWriter, r *http.Request) {
 	eventID := vars["id"]
 	commentID := vars["commentID"]
 
-	res := UncommentEvent(bson.ObjectIdHex(eventID), bson.ObjectIdHex(commentID))
+	res, _ := visibleEvent(UncommentEvent(bson.ObjectIdHex(eventID), bson.ObjectIdHex(commentID)), getViewer(r))
+
+	_ = json.NewEncoder(w).Encode(res)
+}
+
+// ReportEventController will answer a JSON of the report
+// made on the event linked to the given id in the URL
+func ReportEventController(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	eventID := vars["id"]
+
+	userID, err := GetUserFromRequest(r)
+	if err != nil {
+		w.WriteHeader(http.StatusNotAcceptable)
+		_ = json.NewEncoder(w).Encode(bson.M{"error": "could not get user ID"})
+		return
+	}
+
+	request := decodeReportRequest(r)
+	res, err := ReportEvent(bson.ObjectIdHex(eventID), userID, request.Category, request.Reason)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		_ = json.NewEncoder(w).Encode(bson.M{"error": err.Error()})
+		return
+	}
+
+	_ = json.NewEncoder(w).Encode(res)
+}
+
+// ReportEventCommentController will answer a JSON of the report
+// made on the given comment of the event
+func ReportEventCommentController(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	eventID := vars["id"]
+	commentID := vars["commentID"]
+
+	userID, err := GetUserFromRequest(r)
+	if err != nil {
+		w.WriteHeader(http.StatusNotAcceptable)
+		_ = json.NewEncoder(w).Encode(bson.M{"error": "could not get user ID"})
+		return
+	}
+
+	request := decodeReportRequest(r)
+	res, err := ReportCommentOnEvent(bson.ObjectIdHex(eventID), bson.ObjectIdHex(commentID), userID, request.Category, request.Reason)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		_ = json.NewEncoder(w).Encode(bson.M{"error": err.Error()})
+		return
+	}
 
 	_ = json.NewEncoder(w).Encode(res)
 }
@@ -1,19 +1,35 @@
 module github.com/thomas-bouvier/insapp-go
 
-go 1.13
+go 1.25
 
 require (
-	cloud.google.com/go/firestore v1.0.0 // indirect
-	cloud.google.com/go/storage v1.1.1 // indirect
 	firebase.google.com/go v3.9.0+incompatible
 	github.com/dgrijalva/jwt-go v3.2.0+incompatible
-	github.com/gorilla/context v1.1.1 // indirect
 	github.com/gorilla/mux v1.7.3
 	github.com/nfnt/resize v0.0.0-20180221191011-83c6a9932646
 	github.com/thomas-bouvier/palette-extractor v0.0.0-20180722182330-7ab9b90f05ff
 	github.com/urfave/cli v1.22.1
 	golang.org/x/net v0.0.0-20191014212845-da9a3fd4c582
-	google.golang.org/api v0.11.0 // indirect
+	golang.org/x/text v0.3.2
 	gopkg.in/mgo.v2 v2.0.0-20190816093944-a6b53ec6cb22
+)
+
+require (
+	cloud.google.com/go v0.46.3 // indirect
+	cloud.google.com/go/firestore v1.0.0 // indirect
+	cloud.google.com/go/storage v1.1.1 // indirect
+	github.com/cpuguy83/go-md2man/v2 v2.0.0-20190314233015-f79a8a8ca69d // indirect
+	github.com/golang/protobuf v1.3.2 // indirect
+	github.com/googleapis/gax-go/v2 v2.0.5 // indirect
+	github.com/gorilla/context v1.1.1 // indirect
+	github.com/hashicorp/golang-lru v0.5.1 // indirect
+	github.com/russross/blackfriday/v2 v2.0.1 // indirect
+	github.com/shurcooL/sanitized_anchor_name v1.0.0 // indirect
+	go.opencensus.io v0.22.0 // indirect
+	golang.org/x/oauth2 v0.0.0-20190604053449-0f29369cfe45 // indirect
+	golang.org/x/sys v0.0.0-20190624142023-c5567b49c5d0 // indirect
+	google.golang.org/api v0.11.0 // indirect
+	google.golang.org/genproto v0.0.0-20190911173649-1774047e7e51 // indirect
+	google.golang.org/grpc v1.21.1 // indirect
 	gopkg.in/yaml.v2 v2.2.4 // indirect
 )
@@ -0,0 +1,119 @@
+package insapp
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The languages messages are translated to
+const (
+	LanguageFrench  = "fr"
+	LanguageEnglish = "en"
+)
+
+var languages = []string{LanguageFrench, LanguageEnglish}
+
+// messages is the catalog of the texts sent to users. Parameters between
+// braces are replaced when the message is rendered.
+var messages = map[string]map[string]string{
+	LanguageFrench: {
+		"notification.post":        "@{association} a posté une news 📰",
+		"notification.event":       "@{association} t'invite à {event} 📅",
+		"notification.tag":         "@{user} t'a taggé sur '{content}'",
+		"notification.reply":       "@{user} a répondu sur '{content}'",
+		"notification.reminder":    "{event} commence à {time} ⏰",
+		"email.subscription":       "Tes identifiants Insapp",
+		"email.comment":            "Nouveau commentaire sur \"{content}\"",
+		"email.digest.daily":       "Ton résumé Insapp du jour",
+		"email.digest.weekly":      "Ton résumé Insapp de la semaine",
+		"email.report":             "Un contenu a été signalé sur Insapp",
+		"email.report.body":        "Ce contenu a été signalé le {date}\n\nReporteur:\n{reporter}\n\nType:\n{type}\n\nCatégorie:\n{category}\n\nRaison:\n{reason}\n\nContenu:\n{content}",
+		"digest.unsubscribed":      "Tu ne recevras plus le résumé Insapp par email.",
+		"digest.unsubscribe.error": "Ce lien de désinscription n'est pas valide.",
+	},
+	LanguageEnglish: {
+		"notification.post":        "@{association} posted some news 📰",
+		"notification.event":       "@{association} invites you to {event} 📅",
+		"notification.tag":         "@{user} tagged you on '{content}'",
+		"notification.reply":       "@{user} replied on '{content}'",
+		"notification.reminder":    "{event} starts at {time} ⏰",
+		"email.subscription":       "Your Insapp credentials",
+		"email.comment":            "New comment on \"{content}\"",
+		"email.digest.daily":       "Your daily Insapp digest",
+		"email.digest.weekly":      "Your weekly Insapp digest",
+		"email.report":             "Some content has been reported on Insapp",
+		"email.report.body":        "This content was reported on {date}\n\nReporter:\n{reporter}\n\nType:\n{type}\n\nCategory:\n{category}\n\nReason:\n{reason}\n\nContent:\n{content}",
+		"digest.unsubscribed":      "You will not receive the Insapp digest by email anymore.",
+		"digest.unsubscribe.error": "This unsubscribe link is not valid.",
+	},
+}
+
+// defaultLanguage returns the language used when the recipient has not chosen one
+func defaultLanguage() string {
+	if config != nil && ContainsString(languages, config.Language) {
+		return config.Language
+	}
+
+	return LanguageFrench
+}
+
+// normalizeLanguage returns the given language if it is supported,
+// the default language otherwise
+func normalizeLanguage(language string) string {
+	language = strings.ToLower(language)
+	if ContainsString(languages, language) {
+		return language
+	}
+
+	return defaultLanguage()
+}
+
+// supportedLanguage returns the given language if it is supported, or an
+// empty string so that the default language is used
+func supportedLanguage(language string) string {
+	language = strings.ToLower(language)
+	if ContainsString(languages, language) {
+		return language
+	}
+
+	return ""
+}
+
+// localize renders the message with the given key in the given language.
+// Params are pairs of names and values, replacing the {name} in the message.
+// The message of the default language is used if a translation is missing.
+func localize(language string, key string, params ...string) string {
+	message, ok := messages[normalizeLanguage(language)][key]
+	if !ok {
+		message, ok = messages[defaultLanguage()][key]
+	}
+	if !ok {
+		return key
+	}
+
+	replacements := make([]string, 0, len(params))
+	for i := 0; i+1 < len(params); i += 2 {
+		replacements = append(replacements, "{"+params[i]+"}", params[i+1])
+	}
+
+	return strings.NewReplacer(replacements...).Replace(message)
+}
+
+// localizedTemplate returns the path of the email template in the given
+// language. Templates are written in French, and their translations are stored
+// in a sub-folder named after the language. The French template is used if
+// a translation is missing.
+func localizedTemplate(language string, templateFileName string) string {
+	language = normalizeLanguage(language)
+	if language == LanguageFrench {
+		return templateFileName
+	}
+
+	localized := filepath.Join(filepath.Dir(templateFileName), language, filepath.Base(templateFileName))
+	if _, err := os.Stat(localized); err != nil {
+		return templateFileName
+	}
+
+	return localized
+}
@@ -1,14 +1,18 @@
 package insapp
 
 import (
+	"bytes"
 	"errors"
 	"image"
 	"image/color"
 	"image/draw"
 	"image/jpeg"
+	"image/png"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
+	"regexp"
 	"strings"
 
 	resize "github.com/nfnt/resize"
@@ -22,6 +26,9 @@ var magicTable = map[string]string{
 	"GIF89a":            "gif",
 }
 
+// imageNamePattern matches the names clients can give to their images
+var imageNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
 func mimeFromIncipit(incipit []byte) string {
 	incipitStr := string(incipit)
 	for magic, mime := range magicTable {
@@ -32,113 +39,187 @@ func mimeFromIncipit(incipit []byte) string {
 	return ""
 }
 
-// UploadImage will give a random name and upload the image
-func UploadImage(r *http.Request) (string, error) {
-	return UploadImageWithName(r, RandomString(40))
+// UploadImage will upload the image, named after its content. Uploading
+// an image already stored gives the existing file.
+func UploadImage(w http.ResponseWriter, r *http.Request) (string, error) {
+	data, imgType, err := readUploadedImage(w, r)
+	if err != nil {
+		return "", err
+	}
+
+	fileName := contentAddressedName(data, imgType)
+	if _, err = getBlobStore().Stat(fileName); err == nil {
+		return fileName, nil
+	}
+
+	err = getBlobStore().Put(fileName, bytes.NewReader(data), "image/"+imgType)
+	if err != nil {
+		return "", err
+	}
+	return fileName, nil
 }
 
 // UploadImageWithName will manage the upload image from a POST request
-func UploadImageWithName(r *http.Request, name string) (string, error) {
-	_ = r.ParseMultipartForm(32 << 20)
-	file, _, err := r.FormFile("file")
+func UploadImageWithName(w http.ResponseWriter, r *http.Request, name string) (string, error) {
+	if !imageNamePattern.MatchString(name) {
+		return "", errors.New("wrong image name")
+	}
+
+	data, imgType, err := readUploadedImage(w, r)
 	if err != nil {
 		return "", err
 	}
-	data, err := ioutil.ReadAll(file)
+
+	fileName := name + "." + imgType
+	err = getBlobStore().Put(fileName, bytes.NewReader(data), "image/"+imgType)
 	if err != nil {
 		return "", err
 	}
-	imgType := mimeFromIncipit(data)
+	return fileName, nil
+}
 
-	if imgType == "" {
-		return "", errors.New("Can't get image format")
+// readUploadedImage reads the image of a POST request. The image is checked
+// and stripped of its metadata before being stored. The connection is
+// closed if the request is too large.
+func readUploadedImage(w http.ResponseWriter, r *http.Request) ([]byte, string, error) {
+	maxSize := imageMaxSize()
+	r.Body = http.MaxBytesReader(w, r.Body, maxSize+imageUploadOverhead)
+	err := r.ParseMultipartForm(32 << 20)
+	if err != nil {
+		if errors.As(err, new(*http.MaxBytesError)) {
+			return nil, "", ErrImageTooLarge
+		}
+		return nil, "", err
+	}
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		return nil, "", err
 	}
 	defer file.Close()
+	if header.Size > maxSize {
+		return nil, "", ErrImageTooLarge
+	}
 
-	fileName := name
-	err = ioutil.WriteFile("./cdn/"+fileName+"."+imgType, data, 0666)
+	data, err := ioutil.ReadAll(io.LimitReader(file, maxSize+1))
 	if err != nil {
-		return "", err
+		return nil, "", err
+	}
+
+	return sanitizeImage(data)
+}
+
+// decodeStoredImage decodes the image with the given name from the storage
+func decodeStoredImage(fileName string) (image.Image, error) {
+	file, _, err := getBlobStore().Get(fileName)
+	if err != nil {
+		return nil, err
 	}
-	return fileName + "." + imgType, nil
+	defer file.Close()
+
+	decodedImage, _, err := image.Decode(file)
+	return decodedImage, err
 }
 
 // GetImageDimension will return image dimention in pixels
 func GetImageDimension(fileName string) (int, int) {
-	file, err := os.Open("./cdn/" + fileName)
+	file, _, err := getBlobStore().Get(fileName)
 	if err != nil {
 		return 0, 0
 	}
+	defer file.Close()
 	decodedImage, _, _ := image.DecodeConfig(file)
 	return decodedImage.Width, decodedImage.Height
 }
 
-// GetImageColors will return a palette of colors found in the image
+// GetImageColors will return a palette of colors found in the image.
+// The colors are extracted from a copy scaled down to imagePaletteSize,
+// made from the smallest variant of the image if it has any.
 func GetImageColors(fileName string) [][]int {
-	return extractor.NewExtractor("./cdn/"+fileName, 10).GetPalette(6)
-}
+	source := fileName
+	if metadata, err := GetImage(fileName); err == nil {
+		smallest := 0
+		for _, variant := range metadata.Variants {
+			if variant.Format == ImageFormatJPEG && (smallest == 0 || variant.Width*variant.Height < smallest) {
+				source, smallest = variant.File, variant.Width*variant.Height
+			}
+		}
+	}
 
-// GetImagesNames will return a string of all images in cdn
-func GetImagesNames() ([]string, error) {
-	files, err := ioutil.ReadDir("./cdn/")
+	decodedImage, err := decodeStoredImage(source)
 	if err != nil {
-		return nil, err
+		return nil
 	}
+	scaled := resize.Thumbnail(imagePaletteSize, imagePaletteSize, decodedImage, resize.Bilinear)
 
-	var result []string
-	for _, file := range files {
-		if file.Name() != ".gitignore" && file.Name() != "archive" && file.Name() != "index.html" {
-			result = append(result, file.Name())
-		}
+	// The extractor reads the image from the filesystem
+	localCopy, err := ioutil.TempFile("", "insapp-*.png")
+	if err != nil {
+		return nil
+	}
+	defer os.Remove(localCopy.Name())
+
+	err = png.Encode(localCopy, scaled)
+	localCopy.Close()
+	if err != nil {
+		return nil
 	}
-	return result, nil
+
+	return extractor.NewExtractor(localCopy.Name(), 10).GetPalette(imagePaletteColors)
+}
+
+// GetImagesNames will return a string of all images in cdn
+func GetImagesNames() ([]string, error) {
+	return getBlobStore().List()
 }
 
 // ResizeImage will resize an image as jpeg and response its new name
 // Put 0 to newWidth or newHeight to make it automatically calculate to keep aspect ratio.
 func ResizeImage(imageName string, newWidth uint, newHeight uint) (string, error) {
-	file, err := os.Open("./cdn/" + imageName)
-	defer file.Close()
+	origanialImage, err := decodeStoredImage(imageName)
 	if err != nil {
 		return "", err
 	}
 
-	origanialImage, _, err := image.Decode(file)
+	finalImage := resize.Resize(newWidth, newHeight, flattenImage(origanialImage), resize.Lanczos3)
+	buffer := new(bytes.Buffer)
+	err = jpeg.Encode(buffer, finalImage, nil)
 	if err != nil {
 		return "", err
 	}
 
-	newImg := image.NewRGBA(origanialImage.Bounds())
-	// paste a white background
-	draw.Draw(newImg, newImg.Bounds(), &image.Uniform{color.White}, image.Point{}, draw.Src)
-	// paste original image
-	draw.Draw(newImg, newImg.Bounds(), origanialImage, origanialImage.Bounds().Min, draw.Over)
+	name := contentAddressedName(buffer.Bytes(), "jpeg")
+	err = getBlobStore().Put(name, buffer, "image/jpeg")
+	return name, err
+}
 
-	finalImage := resize.Resize(newWidth, newHeight, newImg, resize.Lanczos3)
-	name := RandomString(40)
-	out, err := os.Create("./cdn/" + name + ".jpeg")
+// putJPEG encodes the image as JPEG in the storage
+func putJPEG(img image.Image, fileName string, options *jpeg.Options) error {
+	buffer := new(bytes.Buffer)
+	err := jpeg.Encode(buffer, img, options)
 	if err != nil {
-		return "", err
+		return err
 	}
-	defer out.Close()
 
-	err = jpeg.Encode(out, finalImage, nil)
-	return name + ".jpeg", err
+	return getBlobStore().Put(fileName, buffer, "image/jpeg")
 }
 
-// ArchiveImage will move images in a subdirectory "archive"
+// flattenImage pastes the image on a white background,
+// as JPEG has no transparency
+func flattenImage(img image.Image) *image.RGBA {
+	newImg := image.NewRGBA(img.Bounds())
+	// paste a white background
+	draw.Draw(newImg, newImg.Bounds(), &image.Uniform{color.White}, image.Point{}, draw.Src)
+	// paste original image
+	draw.Draw(newImg, newImg.Bounds(), img, img.Bounds().Min, draw.Over)
+	return newImg
+}
+
+// ArchiveImage will move images in the archive of the storage
 func ArchiveImage(fileName string) error {
-	if _, err := os.Stat("./cdn/archive/"); os.IsNotExist(err) {
-		os.Mkdir("./cdn/archive/", 0755) // rwxr-wr-x
-	}
-	oldLocation := "./cdn/" + fileName
-	newLocation := "./cdn/archive/" + fileName
-	err := os.Rename(oldLocation, newLocation)
-	return err
+	return getBlobStore().Archive(fileName)
 }
 
 // DeleteImage will permanently delete an image
 func DeleteImage(fileName string) error {
-	err := os.Remove("./cdn/" + fileName)
-	return err
+	return getBlobStore().Delete(fileName)
 }
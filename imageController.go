@@ -1,8 +1,13 @@
 package insapp
 
 import (
+	"bytes"
 	"encoding/json"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"regexp"
+	"strconv"
 
 	"gopkg.in/mgo.v2/bson"
 
@@ -11,29 +16,186 @@ import (
 
 // UploadNewImageController will upload a new image in the cdn
 func UploadNewImageController(w http.ResponseWriter, r *http.Request) {
-	fileName, err := UploadImage(r)
+	fileName, err := UploadImage(w, r)
 	ResponseHandler(&w, fileName, err)
 }
 
 // UploadImageController will upload a new image in the cdn
 func UploadImageController(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
-	fileName, err := UploadImageWithName(r, vars["name"])
+	fileName, err := UploadImageWithName(w, r, vars["name"])
 	ResponseHandler(&w, fileName, err)
 }
 
+// UploadVideoController will upload a new video in the cdn
+func UploadVideoController(w http.ResponseWriter, r *http.Request) {
+	video, err := UploadVideo(w, r)
+	switch {
+	case err == ErrVideoTooLarge || err == ErrImageTooLarge:
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		_ = json.NewEncoder(w).Encode(bson.M{"error": err.Error()})
+	case err == ErrVideoUnsupported:
+		w.WriteHeader(http.StatusNotImplemented)
+		_ = json.NewEncoder(w).Encode(bson.M{"error": err.Error()})
+	case err == ErrVideoTooLong || err == ErrVideoFormat || err == ErrImageTooManyPixels || err == ErrImageFormat || err == ErrImageCorrupted:
+		w.WriteHeader(http.StatusNotAcceptable)
+		_ = json.NewEncoder(w).Encode(bson.M{"error": err.Error()})
+	case err != nil:
+		w.WriteHeader(http.StatusNotAcceptable)
+		_ = json.NewEncoder(w).Encode(bson.M{"error": "Failed to upload video"})
+	default:
+		poster, _ := GetImage(video.Poster)
+		_ = json.NewEncoder(w).Encode(bson.M{
+			"file":        video.Name,
+			"size":        bson.M{"width": video.Width, "height": video.Height},
+			"duration":    video.Duration,
+			"poster":      video.Poster,
+			"variants":    poster.Variants,
+			"placeholder": video.Placeholder,
+		})
+	}
+}
+
 // ResponseHandler will response to the client
 func ResponseHandler(w *http.ResponseWriter, fileName string, err error) {
-	if err != nil || fileName == "" {
+	switch {
+	case err == ErrImageTooLarge:
+		(*w).WriteHeader(http.StatusRequestEntityTooLarge)
+		_ = json.NewEncoder(*w).Encode(bson.M{"error": err.Error()})
+	case err == ErrImageTooManyPixels || err == ErrImageFormat || err == ErrImageCorrupted:
+		(*w).WriteHeader(http.StatusNotAcceptable)
+		_ = json.NewEncoder(*w).Encode(bson.M{"error": err.Error()})
+	case err != nil || fileName == "":
 		(*w).WriteHeader(http.StatusNotAcceptable)
 		_ = json.NewEncoder(*w).Encode(bson.M{"error": "Failed to upload image"})
-	} else {
+	default:
 		width, height := GetImageDimension(fileName)
 		if width == 0 || height == 0 {
 			_ = json.NewEncoder(*w).Encode(bson.M{"error": "Bad image format"})
 			return
 		}
-		colors := GetImageColors(fileName)
-		_ = json.NewEncoder(*w).Encode(bson.M{"file": fileName, "size": bson.M{"width": width, "height": height}, "colors": colors})
+		metadata, err := ProcessImage(fileName)
+		if err != nil {
+			(*w).WriteHeader(http.StatusNotAcceptable)
+			_ = json.NewEncoder(*w).Encode(bson.M{"error": "Bad image format"})
+			return
+		}
+		// Clients use the colors of the image right away: the color of its
+		// placeholder stands for the palette until it is extracted
+		colors := metadata.Palette
+		if len(colors) == 0 {
+			ExtractImagePalette(fileName)
+			colors = placeholderPalette(metadata.Placeholder)
+		}
+		if colors == nil {
+			colors = [][]int{}
+		}
+		_ = json.NewEncoder(*w).Encode(bson.M{"file": fileName, "size": bson.M{"width": width, "height": height}, "colors": colors, "variants": metadata.Variants, "placeholder": metadata.Placeholder})
 	}
 }
+
+const (
+	imageImmutableCacheControl = "public, max-age=31536000, immutable"
+	imageCacheControl          = "public, max-age=3600"
+)
+
+// servedImagePattern matches the names of the files the image server serves
+var servedImagePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+\.[a-z]+$`)
+
+// ServeImageController serves the image with the given name from the
+// storage. You can provide ?w= and ?h= to get a copy scaled down to fit
+// in this box.
+func ServeImageController(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	fileName := vars["name"]
+	if !servedImagePattern.MatchString(fileName) {
+		w.WriteHeader(http.StatusNotFound)
+		_ = json.NewEncoder(w).Encode(bson.M{"error": "image not found"})
+		return
+	}
+
+	width, errWidth := parseImageSize(r.URL.Query().Get("w"))
+	height, errHeight := parseImageSize(r.URL.Query().Get("h"))
+	if errWidth != nil || errHeight != nil || (width > 0 && !IsImageResizeSize(width)) || (height > 0 && !IsImageResizeSize(height)) {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(bson.M{"error": "wrong image size"})
+		return
+	}
+
+	if width > 0 || height > 0 {
+		resizedName, err := GetResizedImage(fileName, width, height)
+		if err == ErrBlobNotFound {
+			w.WriteHeader(http.StatusNotFound)
+			_ = json.NewEncoder(w).Encode(bson.M{"error": "image not found"})
+			return
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			_ = json.NewEncoder(w).Encode(bson.M{"error": "failed to resize the image"})
+			return
+		}
+		fileName = resizedName
+	}
+
+	file, info, err := getBlobStore().Get(fileName)
+	if err == ErrBlobNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		_ = json.NewEncoder(w).Encode(bson.M{"error": "image not found"})
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		_ = json.NewEncoder(w).Encode(bson.M{"error": "failed to read the image"})
+		return
+	}
+	defer file.Close()
+
+	// Range requests need to seek in the content, which remote storages
+	// do not allow
+	content, ok := file.(io.ReadSeeker)
+	if !ok {
+		data, err := ioutil.ReadAll(file)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			_ = json.NewEncoder(w).Encode(bson.M{"error": "failed to read the image"})
+			return
+		}
+		content = bytes.NewReader(data)
+	}
+
+	contentType := info.ContentType
+	if contentType == "" {
+		contentType = contentTypeOf(fileName)
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("ETag", imageETag(fileName, info))
+	if immutableImagePattern.MatchString(fileName) {
+		w.Header().Set("Cache-Control", imageImmutableCacheControl)
+	} else {
+		w.Header().Set("Cache-Control", imageCacheControl)
+	}
+
+	// ServeContent answers conditional and range requests
+	http.ServeContent(w, r, fileName, info.ModTime, content)
+}
+
+// parseImageSize parses a requested width or height, 0 if not given
+func parseImageSize(value string) (uint, error) {
+	if value == "" {
+		return 0, nil
+	}
+
+	size, err := strconv.ParseUint(value, 10, 16)
+	return uint(size), err
+}
+
+// imageETag returns the entity tag of the image: its name for the images
+// named after their content, its size and date otherwise
+func imageETag(fileName string, info BlobInfo) string {
+	if immutableImagePattern.MatchString(fileName) {
+		return `"` + fileName + `"`
+	}
+
+	return `"` + strconv.FormatInt(info.ModTime.Unix(), 16) + "-" + strconv.FormatInt(info.Size, 16) + `"`
+}
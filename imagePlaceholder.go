@@ -0,0 +1,257 @@
+package insapp
+
+import (
+	"image"
+	"log"
+	"math"
+	"strings"
+
+	resize "github.com/nfnt/resize"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// ImagePlaceholder is displayed by clients while the image loads
+type ImagePlaceholder struct {
+	// BlurHash is a blurred version of the image, encoded in a few characters.
+	// Please refer to https://blurha.sh
+	BlurHash string `json:"blurhash"`
+	// Color is the average color of the image, like "ff8800"
+	Color string `json:"color"`
+}
+
+const (
+	// Images are scaled down to fit in this box before being blurred
+	blurHashImageSize = 32
+	// blurHashComponents is the number of components along the longest side
+	blurHashComponents = 4
+	blurHashCharacters = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+)
+
+// GetImagePlaceholder returns the placeholder of the image with the given
+// file name. The placeholders of the images uploaded before them are computed
+// in the background, and an empty placeholder is returned until then.
+func GetImagePlaceholder(fileName string) ImagePlaceholder {
+	if fileName == "" {
+		return ImagePlaceholder{}
+	}
+
+	metadata, err := GetImage(fileName)
+	if err != nil {
+		return ImagePlaceholder{}
+	}
+	if metadata.Placeholder.BlurHash == "" {
+		runImageTask("placeholder "+fileName, func() {
+			if err := saveImagePlaceholder(fileName); err != nil {
+				log.Printf("no placeholder computed for %s: %v\n", fileName, err)
+			}
+		})
+	}
+
+	return metadata.Placeholder
+}
+
+// saveImagePlaceholder computes the placeholder of the image with the given
+// file name, saves it with the image and gives it to the contents using the
+// image
+func saveImagePlaceholder(fileName string) error {
+	decodedImage, err := decodeStoredImage(fileName)
+	if err != nil {
+		return err
+	}
+
+	session := GetMongoSession()
+	defer session.Close()
+	db := session.DB("insapp").C("image")
+
+	var result Image
+	_, err = db.FindId(fileName).Apply(mgo.Change{
+		Update:    bson.M{"$set": bson.M{"placeholder": imagePlaceholderOf(decodedImage)}},
+		ReturnNew: true,
+	}, &result)
+	if err != nil {
+		return err
+	}
+	applyImagePlaceholder(session, result)
+
+	return nil
+}
+
+// applyImagePlaceholder gives the placeholder of the image to the contents
+// using it, which were saved before it was computed
+func applyImagePlaceholder(session *mgo.Session, img Image) {
+	for _, reference := range img.References {
+		var db *mgo.Collection
+		var field, placeholderField string
+		switch reference.Kind {
+		case ImageReferencePostImage, ImageReferencePostMedia:
+			db, field, placeholderField = session.DB("insapp").C("post"), "image", "placeholder"
+		case ImageReferenceEventImage, ImageReferenceEventMedia:
+			db, field, placeholderField = session.DB("insapp").C("event"), "image", "placeholder"
+		case ImageReferenceAssociationProfile:
+			db, field, placeholderField = session.DB("insapp").C("association"), "profile", "profileplaceholder"
+		case ImageReferenceAssociationCover:
+			db, field, placeholderField = session.DB("insapp").C("association"), "cover", "coverplaceholder"
+		default:
+			continue
+		}
+
+		if reference.Kind == ImageReferencePostMedia || reference.Kind == ImageReferenceEventMedia {
+			// Each update gives the placeholder to a single item of the gallery
+			for i := 0; i < maxMediaCount; i++ {
+				err := db.Update(
+					bson.M{"_id": reference.ID, "media": bson.M{"$elemMatch": bson.M{"image": img.Name, "placeholder.blurhash": bson.M{"$ne": img.Placeholder.BlurHash}}}},
+					bson.M{"$set": bson.M{"media.$.placeholder": img.Placeholder}},
+				)
+				if err != nil {
+					break
+				}
+			}
+			continue
+		}
+
+		_ = db.Update(
+			bson.M{"_id": reference.ID, field: img.Name},
+			bson.M{"$set": bson.M{placeholderField: img.Placeholder}},
+		)
+	}
+}
+
+// imagePlaceholderOf computes the placeholder of the image
+func imagePlaceholderOf(img image.Image) ImagePlaceholder {
+	small := resize.Thumbnail(blurHashImageSize, blurHashImageSize, img, resize.Bilinear)
+
+	// Portrait images get more components vertically
+	xComponents, yComponents := blurHashComponents, blurHashComponents-1
+	if small.Bounds().Dy() > small.Bounds().Dx() {
+		xComponents, yComponents = yComponents, xComponents
+	}
+
+	hash, average := encodeBlurHash(flattenImage(small), xComponents, yComponents)
+	return ImagePlaceholder{
+		BlurHash: hash,
+		Color:    hexColor(average[:]),
+	}
+}
+
+// encodeBlurHash encodes the image as a BlurHash with the given number of
+// components, from 1 to 9 in each direction. It also returns the average
+// color of the image, which is the first component.
+// Please refer to https://github.com/woltapp/blurhash/blob/master/Algorithm.md
+func encodeBlurHash(img *image.RGBA, xComponents int, yComponents int) (string, [3]int) {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width == 0 || height == 0 {
+		return "", [3]int{}
+	}
+
+	// The pixels are converted once to linear RGB
+	linear := make([][3]float64, width*height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			offset := img.PixOffset(bounds.Min.X+x, bounds.Min.Y+y)
+			for channel := 0; channel < 3; channel++ {
+				linear[y*width+x][channel] = sRGBToLinear(img.Pix[offset+channel])
+			}
+		}
+	}
+
+	factors := make([][3]float64, 0, xComponents*yComponents)
+	for j := 0; j < yComponents; j++ {
+		for i := 0; i < xComponents; i++ {
+			normalisation := 2.0
+			if i == 0 && j == 0 {
+				normalisation = 1
+			}
+
+			var factor [3]float64
+			for y := 0; y < height; y++ {
+				for x := 0; x < width; x++ {
+					basis := normalisation *
+						math.Cos(math.Pi*float64(i)*float64(x)/float64(width)) *
+						math.Cos(math.Pi*float64(j)*float64(y)/float64(height))
+					for channel := 0; channel < 3; channel++ {
+						factor[channel] += basis * linear[y*width+x][channel]
+					}
+				}
+			}
+
+			scale := 1 / float64(width*height)
+			factors = append(factors, [3]float64{factor[0] * scale, factor[1] * scale, factor[2] * scale})
+		}
+	}
+
+	var hash strings.Builder
+	hash.WriteString(encodeBase83((xComponents-1)+(yComponents-1)*9, 1))
+
+	maximumValue := 1.0
+	if len(factors) > 1 {
+		actualMaximum := 0.0
+		for _, factor := range factors[1:] {
+			for _, value := range factor {
+				actualMaximum = math.Max(actualMaximum, math.Abs(value))
+			}
+		}
+		quantisedMaximum := clampInt(int(math.Floor(actualMaximum*166-0.5)), 0, 82)
+		maximumValue = float64(quantisedMaximum+1) / 166
+		hash.WriteString(encodeBase83(quantisedMaximum, 1))
+	} else {
+		hash.WriteString(encodeBase83(0, 1))
+	}
+
+	average := [3]int{linearToSRGB(factors[0][0]), linearToSRGB(factors[0][1]), linearToSRGB(factors[0][2])}
+	hash.WriteString(encodeBase83(average[0]<<16+average[1]<<8+average[2], 4))
+
+	for _, factor := range factors[1:] {
+		var quantised [3]int
+		for channel, value := range factor {
+			quantised[channel] = clampInt(int(math.Floor(signedPow(value/maximumValue, 0.5)*9+9.5)), 0, 18)
+		}
+		hash.WriteString(encodeBase83(quantised[0]*19*19+quantised[1]*19+quantised[2], 2))
+	}
+
+	return hash.String(), average
+}
+
+func encodeBase83(value int, length int) string {
+	result := make([]byte, length)
+	for i := length - 1; i >= 0; i-- {
+		result[i] = blurHashCharacters[value%83]
+		value /= 83
+	}
+
+	return string(result)
+}
+
+func sRGBToLinear(value uint8) float64 {
+	v := float64(value) / 255
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(value float64) int {
+	v := math.Max(0, math.Min(1, value))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+func signedPow(value float64, exponent float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(value), exponent), value)
+}
+
+func clampInt(value int, minimum int, maximum int) int {
+	if value < minimum {
+		return minimum
+	}
+	if value > maximum {
+		return maximum
+	}
+
+	return value
+}
@@ -0,0 +1,33 @@
+package insapp
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestEncodeBlurHash(t *testing.T) {
+	// A gradient, whose largest component is positive so that the
+	// TypeScript and the C encoders of woltapp/blurhash agree
+	img := image.NewRGBA(image.Rect(0, 0, 32, 24))
+	for y := 0; y < 24; y++ {
+		for x := 0; x < 32; x++ {
+			img.Set(x, y, color.RGBA{R: uint8(248 - x*8), G: uint8(230 - y*10), B: uint8(216 - (x+y)*4), A: 255})
+		}
+	}
+
+	// Encoded with the reference encoder.
+	// Please refer to https://github.com/woltapp/blurhash/blob/master/TypeScript/src/encode.ts
+	expected := "L*H27b|~$8xHp[oNjuj[gefkfQfk"
+	hash, average := encodeBlurHash(img, 4, 3)
+	if hash != expected {
+		t.Errorf("got the hash %q, expected %q", hash, expected)
+	}
+	if hash[2:6] != encodeBase83(average[0]<<16+average[1]<<8+average[2], 4) {
+		t.Errorf("got the average color %v, which is not the one of the hash", average)
+	}
+
+	if hash, _ = encodeBlurHash(image.NewRGBA(image.Rect(0, 0, 0, 0)), 4, 3); hash != "" {
+		t.Errorf("got the hash %q for an empty image", hash)
+	}
+}
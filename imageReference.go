@@ -0,0 +1,236 @@
+package insapp
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"regexp"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// ImageReference is a use of an image by an association, an event or a post
+type ImageReference struct {
+	Kind string        `json:"kind"`
+	ID   bson.ObjectId `json:"id"`
+}
+
+// The ways an image can be used
+const (
+	ImageReferenceAssociationProfile         = "association.profile"
+	ImageReferenceAssociationProfileUploaded = "association.profileuploaded"
+	ImageReferenceAssociationCover           = "association.cover"
+	ImageReferenceEventImage                 = "event.image"
+	ImageReferenceEventMedia                 = "event.media"
+	ImageReferencePostImage                  = "post.image"
+	ImageReferencePostMedia                  = "post.media"
+)
+
+// imageCollectGrace is how long an unreferenced image is kept, as images
+// are uploaded before the content using them is saved
+const imageCollectGrace = 24 * time.Hour
+
+// contentAddressedPattern matches the names derived from the content of the images
+var contentAddressedPattern = regexp.MustCompile(`^[0-9a-f]{64}\.[a-z]+$`)
+
+// immutableImagePattern matches the images named after their content along
+// with their variants and resized copies, whose content never changes
+var immutableImagePattern = regexp.MustCompile(`^[0-9a-f]{64}(_[0-9a-z]+)?\.[a-z]+$`)
+
+// contentAddressedName returns the name of an image derived from its
+// content, so that identical images share the same file
+func contentAddressedName(data []byte, format string) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]) + "." + format
+}
+
+// SetImageReference records that the content with the given id uses the
+// given image in the given way, in place of the image it used before.
+// An empty image only removes the previous reference.
+func SetImageReference(kind string, id bson.ObjectId, image string) {
+	if image == "" {
+		SetImageReferences(kind, id, nil)
+		return
+	}
+
+	SetImageReferences(kind, id, []string{image})
+}
+
+// SetImageReferences records that the content with the given id uses the
+// given images in the given way, in place of the images it used before
+func SetImageReferences(kind string, id bson.ObjectId, images []string) {
+	if id == "" {
+		return
+	}
+
+	session := GetMongoSession()
+	defer session.Close()
+	db := session.DB("insapp").C("image")
+
+	reference := ImageReference{Kind: kind, ID: id}
+	_, _ = db.UpdateAll(
+		bson.M{"references": reference, "_id": bson.M{"$nin": images}},
+		bson.M{"$pull": bson.M{"references": reference}},
+	)
+
+	for _, image := range images {
+		// Images uploaded before the references were tracked get a record too
+		_, _ = db.UpsertId(image, bson.M{
+			"$addToSet":    bson.M{"references": reference},
+			"$setOnInsert": bson.M{"date": time.Now()},
+		})
+	}
+}
+
+// RemoveImageReferences removes every reference of the content with the
+// given id, once it is deleted
+func RemoveImageReferences(id bson.ObjectId) {
+	session := GetMongoSession()
+	defer session.Close()
+	db := session.DB("insapp").C("image")
+
+	_, _ = db.UpdateAll(
+		bson.M{"references.id": id},
+		bson.M{"$pull": bson.M{"references": bson.M{"id": id}}},
+	)
+}
+
+// setAssociationImageReferences records the images used by the association
+func setAssociationImageReferences(association Association) {
+	SetImageReference(ImageReferenceAssociationProfile, association.ID, association.Profile)
+	SetImageReference(ImageReferenceAssociationProfileUploaded, association.ID, association.ProfileUploaded)
+	SetImageReference(ImageReferenceAssociationCover, association.ID, association.Cover)
+}
+
+// setEventImageReferences records the images used by the event
+func setEventImageReferences(event Event) {
+	SetImageReference(ImageReferenceEventImage, event.ID, event.Image)
+	SetImageReferences(ImageReferenceEventMedia, event.ID, mediaImages(event.Media))
+}
+
+// setPostImageReferences records the images used by the post
+func setPostImageReferences(post Post) {
+	SetImageReference(ImageReferencePostImage, post.ID, post.Image)
+	SetImageReferences(ImageReferencePostMedia, post.ID, mediaImages(post.Media))
+}
+
+// IndexImageReferences records the images used by every association, event
+// and post. It is only needed once, for the images uploaded before the
+// references were tracked.
+func IndexImageReferences() int {
+	count := 0
+	for _, association := range GetAllAssociations() {
+		setAssociationImageReferences(association)
+		count++
+	}
+	for _, event := range GetEvents() {
+		setEventImageReferences(event)
+		count++
+	}
+	for _, post := range GetPosts() {
+		setPostImageReferences(post)
+		count++
+	}
+
+	return count
+}
+
+// GetUnreferencedImages returns the images no content uses anymore,
+// leaving out the ones uploaded recently
+func GetUnreferencedImages() []Image {
+	session := GetMongoSession()
+	defer session.Close()
+	db := session.DB("insapp").C("image")
+
+	var result []Image
+	_ = db.Find(bson.M{
+		"$or": []bson.M{
+			{"references": bson.M{"$exists": false}},
+			{"references": bson.M{"$size": 0}},
+		},
+		"date": bson.M{"$lt": time.Now().Add(-imageCollectGrace)},
+	}).All(&result)
+
+	return result
+}
+
+// GetUntrackedImages returns the files of the storage belonging to no
+// image record, like the images uploaded before the references were tracked
+// and not indexed since
+func GetUntrackedImages() ([]string, error) {
+	files, err := getBlobStore().List()
+	if err != nil {
+		return nil, err
+	}
+
+	session := GetMongoSession()
+	defer session.Close()
+	db := session.DB("insapp").C("image")
+
+	var images []Image
+	err = db.Find(nil).All(&images)
+	if err != nil {
+		return nil, err
+	}
+
+	tracked := map[string]bool{}
+	for _, image := range images {
+		tracked[image.Name] = true
+		for _, variant := range image.Variants {
+			tracked[variant.File] = true
+		}
+		for _, resized := range image.Resized {
+			tracked[resized] = true
+		}
+	}
+
+	var result []string
+	for _, file := range files {
+		if !tracked[file] {
+			result = append(result, file)
+		}
+	}
+
+	return result, nil
+}
+
+// CollectImage archives or deletes the files of the given image, its
+// variants and resized copies along with its record, unless it has been
+// referenced in the meantime
+func CollectImage(name string, archive bool) error {
+	session := GetMongoSession()
+	defer session.Close()
+	db := session.DB("insapp").C("image")
+
+	var image Image
+	_, err := db.Find(bson.M{
+		"_id": name,
+		"$or": []bson.M{
+			{"references": bson.M{"$exists": false}},
+			{"references": bson.M{"$size": 0}},
+		},
+	}).Apply(mgo.Change{Remove: true}, &image)
+	if err != nil {
+		return err
+	}
+
+	files := []string{image.Name}
+	for _, variant := range image.Variants {
+		files = append(files, variant.File)
+	}
+	files = append(files, image.Resized...)
+
+	for _, file := range files {
+		if archive {
+			err = ArchiveImage(file)
+		} else {
+			err = DeleteImage(file)
+		}
+		if err != nil && err != ErrBlobNotFound {
+			return err
+		}
+	}
+
+	return nil
+}
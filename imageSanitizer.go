@@ -0,0 +1,308 @@
+package insapp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+)
+
+// The errors returned when an uploaded image is refused
+var (
+	ErrImageTooLarge      = errors.New("the image is too large")
+	ErrImageTooManyPixels = errors.New("the image has too many pixels")
+	ErrImageFormat        = errors.New("the image format is not supported")
+	ErrImageCorrupted     = errors.New("the image is corrupted")
+)
+
+const (
+	defaultImageMaxSize      = 10 << 20
+	defaultImageMaxPixels    = 50000000
+	defaultImageMaxDimension = 12000
+	// Multipart headers around the file
+	imageUploadOverhead    = 1 << 20
+	imageSanitizedQuality  = 90
+	exifOrientationTag     = 0x0112
+	jpegStartOfImage       = 0xd8
+	jpegApp1               = 0xe1
+	jpegStartOfScan        = 0xda
+	exifHeader             = "Exif\x00\x00"
+	exifOrientationDefault = 1
+	gifExtension           = 0x21
+	gifImageDescriptor     = 0x2c
+	gifTrailer             = 0x3b
+	gifColorTableFlag      = 0x80
+	gifColorTableSize      = 0x07
+)
+
+// imageMaxSize returns the maximum size of an uploaded image, in bytes
+func imageMaxSize() int64 {
+	if config != nil && config.ImageMaxSize > 0 {
+		return config.ImageMaxSize
+	}
+
+	return defaultImageMaxSize
+}
+
+// checkImageDimensions refuses images whose decoding would use too much
+// memory, before decoding them
+func checkImageDimensions(width int, height int) error {
+	maxPixels := int64(defaultImageMaxPixels)
+	if config != nil && config.ImageMaxPixels > 0 {
+		maxPixels = config.ImageMaxPixels
+	}
+	maxDimension := defaultImageMaxDimension
+	if config != nil && config.ImageMaxDimension > 0 {
+		maxDimension = config.ImageMaxDimension
+	}
+
+	if width <= 0 || height <= 0 {
+		return ErrImageCorrupted
+	}
+	if width > maxDimension || height > maxDimension || int64(width)*int64(height) > maxPixels {
+		return ErrImageTooManyPixels
+	}
+
+	return nil
+}
+
+// sanitizeImage decodes the uploaded image and encodes it again in the same
+// format. Only the pixels are kept: the metadata, like the EXIF data with the
+// GPS position of phone photos, and anything appended to the image are left
+// out. JPEG images are rotated according to their EXIF orientation.
+// It returns the new image along with its format.
+func sanitizeImage(data []byte) ([]byte, string, error) {
+	if int64(len(data)) > imageMaxSize() {
+		return nil, "", ErrImageTooLarge
+	}
+
+	magicFormat := mimeFromIncipit(data)
+	if magicFormat == "" {
+		return nil, "", ErrImageFormat
+	}
+
+	imageConfig, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", ErrImageCorrupted
+	}
+	// A file starting like a PNG but decoded as something else is a polyglot
+	if format != magicFormat {
+		return nil, "", ErrImageFormat
+	}
+	if err = checkImageDimensions(imageConfig.Width, imageConfig.Height); err != nil {
+		return nil, "", err
+	}
+
+	output := new(bytes.Buffer)
+	switch format {
+	case "jpeg":
+		decoded, err := jpeg.Decode(bytes.NewReader(data))
+		if err != nil {
+			return nil, "", ErrImageCorrupted
+		}
+		oriented := applyOrientation(decoded, jpegOrientation(data))
+		err = jpeg.Encode(output, oriented, &jpeg.Options{Quality: imageSanitizedQuality})
+		if err != nil {
+			return nil, "", err
+		}
+	case "png":
+		decoded, err := png.Decode(bytes.NewReader(data))
+		if err != nil {
+			return nil, "", ErrImageCorrupted
+		}
+		err = png.Encode(output, decoded)
+		if err != nil {
+			return nil, "", err
+		}
+	case "gif":
+		gifConfig, err := gif.DecodeConfig(bytes.NewReader(data))
+		if err != nil {
+			return nil, "", ErrImageCorrupted
+		}
+		// Every frame is decoded in memory, so they are counted first
+		if err = checkGIFFrames(data, gifConfig.Width, gifConfig.Height); err != nil {
+			return nil, "", err
+		}
+		decoded, err := gif.DecodeAll(bytes.NewReader(data))
+		if err != nil {
+			return nil, "", ErrImageCorrupted
+		}
+		decoded.Config = image.Config{}
+		err = gif.EncodeAll(output, decoded)
+		if err != nil {
+			return nil, "", err
+		}
+	default:
+		return nil, "", ErrImageFormat
+	}
+
+	return output.Bytes(), format, nil
+}
+
+// checkGIFFrames goes through the blocks of the GIF image without decoding
+// them, and refuses it as soon as its frames have too many pixels together.
+// Please refer to https://www.w3.org/Graphics/GIF/spec-gif89a.txt, 17 to 27.
+func checkGIFFrames(data []byte, width int, height int) error {
+	// The header is followed by the logical screen descriptor
+	offset := 13
+	if len(data) < offset {
+		return ErrImageCorrupted
+	}
+	if data[10]&gifColorTableFlag != 0 {
+		offset += 3 << (data[10]&gifColorTableSize + 1)
+	}
+
+	frames := 0
+	for offset < len(data) {
+		switch data[offset] {
+		case gifExtension:
+			offset += 2
+		case gifImageDescriptor:
+			frames++
+			if err := checkImageDimensions(width, height*frames); err != nil {
+				return err
+			}
+			if offset+10 > len(data) {
+				return ErrImageCorrupted
+			}
+			flags := data[offset+9]
+			offset += 10
+			if flags&gifColorTableFlag != 0 {
+				offset += 3 << (flags&gifColorTableSize + 1)
+			}
+			// The minimum code size of the LZW data
+			offset++
+		case gifTrailer:
+			return nil
+		default:
+			return ErrImageCorrupted
+		}
+
+		// Both extensions and images end with data sub-blocks
+		for offset < len(data) && data[offset] != 0 {
+			offset += int(data[offset]) + 1
+		}
+		offset++
+	}
+
+	return ErrImageCorrupted
+}
+
+// jpegOrientation returns the EXIF orientation of the JPEG image,
+// from 1 to 8. Please refer to https://www.exif.org/Exif2-2.PDF, 4.6.4.
+func jpegOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xff || data[1] != jpegStartOfImage {
+		return exifOrientationDefault
+	}
+
+	for offset := 2; offset+4 <= len(data); {
+		if data[offset] != 0xff {
+			return exifOrientationDefault
+		}
+		marker := data[offset+1]
+		if marker == jpegStartOfScan {
+			return exifOrientationDefault
+		}
+		length := int(binary.BigEndian.Uint16(data[offset+2:]))
+		if length < 2 || offset+2+length > len(data) {
+			return exifOrientationDefault
+		}
+		segment := data[offset+4 : offset+2+length]
+		if marker == jpegApp1 && bytes.HasPrefix(segment, []byte(exifHeader)) {
+			return exifOrientation(segment[len(exifHeader):])
+		}
+		offset += 2 + length
+	}
+
+	return exifOrientationDefault
+}
+
+// exifOrientation reads the orientation in the first IFD of the TIFF
+// structure holding the EXIF data
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return exifOrientationDefault
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return exifOrientationDefault
+	}
+
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return exifOrientationDefault
+	}
+
+	entries := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < entries; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			break
+		}
+		if order.Uint16(tiff[entry:]) == exifOrientationTag {
+			orientation := int(order.Uint16(tiff[entry+8:]))
+			if orientation >= 1 && orientation <= 8 {
+				return orientation
+			}
+			break
+		}
+	}
+
+	return exifOrientationDefault
+}
+
+// applyOrientation rotates and flips the image so that it is displayed
+// upright once its EXIF orientation is removed
+func applyOrientation(img image.Image, orientation int) image.Image {
+	if orientation <= exifOrientationDefault || orientation > 8 {
+		return img
+	}
+
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+
+	// Orientations from 5 to 8 swap the width and the height
+	result := image.NewRGBA(image.Rect(0, 0, width, height))
+	if orientation >= 5 {
+		result = image.NewRGBA(image.Rect(0, 0, height, width))
+	}
+
+	source := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(source, source.Bounds(), img, bounds.Min, draw.Src)
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2:
+				dx, dy = width-1-x, y
+			case 3:
+				dx, dy = width-1-x, height-1-y
+			case 4:
+				dx, dy = x, height-1-y
+			case 5:
+				dx, dy = y, x
+			case 6:
+				dx, dy = height-1-y, x
+			case 7:
+				dx, dy = height-1-y, width-1-x
+			case 8:
+				dx, dy = y, width-1-x
+			}
+			sourceOffset := source.PixOffset(x, y)
+			copy(result.Pix[result.PixOffset(dx, dy):], source.Pix[sourceOffset:sourceOffset+4])
+		}
+	}
+
+	return result
+}
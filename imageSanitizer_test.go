@@ -0,0 +1,77 @@
+package insapp
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/gif"
+	"mime/multipart"
+	"net/http/httptest"
+	"testing"
+)
+
+// animatedGIF encodes an animation of the given number of frames
+func animatedGIF(t *testing.T, width int, height int, frames int) []byte {
+	palette := color.Palette{color.Black, color.White}
+	animation := &gif.GIF{}
+	for i := 0; i < frames; i++ {
+		frame := image.NewPaletted(image.Rect(0, 0, width, height), palette)
+		frame.SetColorIndex(i%width, 0, 1)
+		animation.Image = append(animation.Image, frame)
+		animation.Delay = append(animation.Delay, 10)
+	}
+
+	output := new(bytes.Buffer)
+	if err := gif.EncodeAll(output, animation); err != nil {
+		t.Fatal(err)
+	}
+
+	return output.Bytes()
+}
+
+func TestSanitizeGIFFrames(t *testing.T) {
+	previous := config
+	config = &Config{ImageMaxPixels: 10 * 10 * 20}
+	defer func() { config = previous }()
+
+	data, format, err := sanitizeImage(animatedGIF(t, 10, 10, 20))
+	if err != nil || format != "gif" {
+		t.Fatalf("got %q and %v for an animation within the limit", format, err)
+	}
+	decoded, err := gif.DecodeAll(bytes.NewReader(data))
+	if err != nil || len(decoded.Image) != 20 {
+		t.Errorf("the frames were not kept: %v", err)
+	}
+
+	_, _, err = sanitizeImage(animatedGIF(t, 10, 10, 21))
+	if err != ErrImageTooManyPixels {
+		t.Errorf("got %v for too many frames, expected ErrImageTooManyPixels", err)
+	}
+
+	truncated := animatedGIF(t, 10, 10, 2)
+	_, _, err = sanitizeImage(truncated[:len(truncated)-1])
+	if err != ErrImageCorrupted {
+		t.Errorf("got %v for a truncated animation, expected ErrImageCorrupted", err)
+	}
+}
+
+func TestReadUploadedImageTooLarge(t *testing.T) {
+	previous := config
+	config = &Config{ImageMaxSize: 10}
+	defer func() { config = previous }()
+
+	body := new(bytes.Buffer)
+	form := multipart.NewWriter(body)
+	file, _ := form.CreateFormFile("file", "large.gif")
+	_, _ = file.Write(bytes.Repeat([]byte{0}, imageUploadOverhead+100))
+	form.Close()
+
+	request := httptest.NewRequest("POST", "/images", body)
+	request.Header.Set("Content-Type", form.FormDataContentType())
+	recorder := httptest.NewRecorder()
+
+	_, _, err := readUploadedImage(recorder, request)
+	if err != ErrImageTooLarge {
+		t.Errorf("got %v, expected ErrImageTooLarge", err)
+	}
+}
@@ -0,0 +1,408 @@
+package insapp
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	resize "github.com/nfnt/resize"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Image defines the metadata of an uploaded image, or of an uploaded video
+// along with its poster image
+type Image struct {
+	Name        string           `json:"file" bson:"_id"`
+	Type        string           `json:"type" bson:"type,omitempty"`
+	Width       int              `json:"width"`
+	Height      int              `json:"height"`
+	Variants    []ImageVariant   `json:"variants"`
+	Palette     [][]int          `json:"palette" bson:"palette,omitempty"`
+	Placeholder ImagePlaceholder `json:"placeholder"`
+	References  []ImageReference `json:"references" bson:"references,omitempty"`
+	// Duration is the duration of a video, in seconds
+	Duration float64 `json:"duration,omitempty" bson:"duration,omitempty"`
+	Poster   string  `json:"poster,omitempty" bson:"poster,omitempty"`
+	// Resized are the copies generated on demand for the image server
+	Resized []string  `json:"-" bson:"resized,omitempty"`
+	Date    time.Time `json:"date"`
+}
+
+// ImageVariant is a resized copy of an image, letting clients download
+// the size they display
+type ImageVariant struct {
+	Name   string `json:"name"`
+	Format string `json:"format"`
+	File   string `json:"file"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+}
+
+// ImageVariantSize defines a variant generated for every uploaded image.
+// The image is scaled down to fit in the given box, keeping its aspect ratio.
+type ImageVariantSize struct {
+	Name   string `json:"name"`
+	Width  uint   `json:"width"`
+	Height uint   `json:"height"`
+}
+
+// The formats of the image variants
+const (
+	ImageFormatJPEG = "jpeg"
+	ImageFormatWebP = "webp"
+)
+
+var defaultImageVariantSizes = []ImageVariantSize{
+	{Name: "thumbnail", Width: 256, Height: 256},
+	{Name: "medium", Width: 800, Height: 800},
+	{Name: "large", Width: 1600, Height: 1600},
+}
+
+// defaultImageResizeSizes are the widths and heights clients can request
+// to the image server
+var defaultImageResizeSizes = []uint{64, 128, 256, 384, 512, 640, 800, 1024, 1280, 1600, 1920, 2560}
+
+const (
+	imageVariantJPEGQuality = 85
+	imageVariantWebPQuality = "80"
+	defaultWebPEncoder      = "cwebp"
+)
+
+var webPEncoderWarning sync.Once
+
+// imageResizeCall is a copy being generated. The requests for the same
+// copy wait for it instead of generating it again.
+type imageResizeCall struct {
+	done chan struct{}
+	err  error
+}
+
+var (
+	imageResizeMutex sync.Mutex
+	imageResizeCalls = map[string]*imageResizeCall{}
+	// imageResizeSlots bounds the number of images resized at the same
+	// time, and so the memory used by the decoded images
+	imageResizeSlots = make(chan struct{}, runtime.NumCPU())
+)
+
+// imageVariantSizes returns the variants chosen in the configuration,
+// or the default ones
+func imageVariantSizes() []ImageVariantSize {
+	if config != nil && len(config.ImageVariants) > 0 {
+		return config.ImageVariants
+	}
+
+	return defaultImageVariantSizes
+}
+
+// IsImageResizeSize tells if clients can request the given width or height
+// to the image server
+func IsImageResizeSize(size uint) bool {
+	sizes := defaultImageResizeSizes
+	if config != nil && len(config.ImageResizeSizes) > 0 {
+		sizes = config.ImageResizeSizes
+	}
+
+	for _, allowed := range sizes {
+		if size == allowed {
+			return true
+		}
+	}
+
+	return false
+}
+
+// GetImage returns the metadata of the image with the given file name
+func GetImage(fileName string) (Image, error) {
+	session := GetMongoSession()
+	defer session.Close()
+	db := session.DB("insapp").C("image")
+
+	var result Image
+	err := db.FindId(fileName).One(&result)
+	if err != nil {
+		return Image{}, errors.New("no image found")
+	}
+
+	return result, nil
+}
+
+// GetImageFiles returns the file of the given image along with
+// the files of its variants
+func GetImageFiles(fileName string) []string {
+	result := []string{fileName}
+	metadata, err := GetImage(fileName)
+	if err != nil {
+		return result
+	}
+
+	for _, variant := range metadata.Variants {
+		result = append(result, variant.File)
+	}
+	result = append(result, metadata.Resized...)
+
+	return result
+}
+
+// GetResizedImage returns the name of a copy of the given image scaled down
+// to fit in the given box, generating it on the first request. A width or
+// a height of 0 leaves that dimension free. The original image is returned
+// if it already fits, or if it has no record to keep track of the copy.
+func GetResizedImage(fileName string, width uint, height uint) (string, error) {
+	metadata, err := GetImage(fileName)
+	if err != nil || metadata.Width == 0 || metadata.Height == 0 {
+		return fileName, nil
+	}
+	// Animations and videos are served as they are
+	if metadata.Type == MediaTypeGIF || metadata.Type == MediaTypeVideo {
+		return fileName, nil
+	}
+
+	width = fittingImageSize(width, metadata.Width)
+	height = fittingImageSize(height, metadata.Height)
+	if width == 0 && height == 0 {
+		return fileName, nil
+	}
+
+	format := strings.TrimPrefix(filepath.Ext(fileName), ".")
+	if format != ImageFormatJPEG {
+		format = "png"
+	}
+	base := strings.TrimSuffix(fileName, filepath.Ext(fileName))
+	resizedName := base + "_" + strconv.Itoa(int(width)) + "x" + strconv.Itoa(int(height)) + "." + format
+
+	if _, err = getBlobStore().Stat(resizedName); err == nil {
+		return resizedName, nil
+	}
+
+	imageResizeMutex.Lock()
+	if call, ok := imageResizeCalls[resizedName]; ok {
+		imageResizeMutex.Unlock()
+		<-call.done
+		if call.err != nil {
+			return "", call.err
+		}
+		return resizedName, nil
+	}
+	call := &imageResizeCall{done: make(chan struct{})}
+	imageResizeCalls[resizedName] = call
+	imageResizeMutex.Unlock()
+
+	imageResizeSlots <- struct{}{}
+	call.err = resizeStoredImage(metadata, resizedName, format, width, height)
+	<-imageResizeSlots
+
+	imageResizeMutex.Lock()
+	delete(imageResizeCalls, resizedName)
+	imageResizeMutex.Unlock()
+	close(call.done)
+
+	if call.err != nil {
+		return "", call.err
+	}
+	return resizedName, nil
+}
+
+// resizeStoredImage stores a copy of the image scaled down to fit in the
+// given box, and records it along with the image
+func resizeStoredImage(metadata Image, resizedName string, format string, width uint, height uint) error {
+	original, err := decodeStoredImage(metadata.Name)
+	if err != nil {
+		return err
+	}
+
+	// resize.Thumbnail needs both dimensions, the free one is the original one
+	boxWidth, boxHeight := width, height
+	if boxWidth == 0 {
+		boxWidth = uint(metadata.Width)
+	}
+	if boxHeight == 0 {
+		boxHeight = uint(metadata.Height)
+	}
+	resized := resize.Thumbnail(boxWidth, boxHeight, original, resize.Lanczos3)
+
+	buffer := new(bytes.Buffer)
+	if format == ImageFormatJPEG {
+		err = jpeg.Encode(buffer, flattenImage(resized), &jpeg.Options{Quality: imageVariantJPEGQuality})
+	} else {
+		err = png.Encode(buffer, resized)
+	}
+	if err != nil {
+		return err
+	}
+
+	err = getBlobStore().Put(resizedName, buffer, contentTypeOf(resizedName))
+	if err != nil {
+		return err
+	}
+
+	session := GetMongoSession()
+	defer session.Close()
+	db := session.DB("insapp").C("image")
+
+	_ = db.UpdateId(metadata.Name, bson.M{"$addToSet": bson.M{"resized": resizedName}})
+
+	return nil
+}
+
+// fittingImageSize returns 0 if the original size already fits in the
+// requested size, which is returned otherwise
+func fittingImageSize(size uint, original int) uint {
+	if size >= uint(original) {
+		return 0
+	}
+
+	return size
+}
+
+// ProcessImage generates the variants of the uploaded image with the given
+// file name, and stores them along with its dimensions and placeholder. Images named after
+// their content never change, so their variants are only generated once.
+func ProcessImage(fileName string) (Image, error) {
+	if contentAddressedPattern.MatchString(fileName) {
+		existing, err := GetImage(fileName)
+		if err == nil && len(existing.Variants) > 0 && existing.Placeholder.BlurHash != "" {
+			// The image was uploaded again, it must not be collected before being used
+			touchImage(fileName)
+			return existing, nil
+		}
+	}
+
+	original, err := decodeStoredImage(fileName)
+	if err != nil {
+		return Image{}, err
+	}
+
+	result := Image{
+		Name:        fileName,
+		Type:        imageTypeOf(fileName),
+		Width:       original.Bounds().Dx(),
+		Height:      original.Bounds().Dy(),
+		Variants:    []ImageVariant{},
+		Placeholder: imagePlaceholderOf(original),
+		Date:        time.Now(),
+	}
+
+	base := strings.TrimSuffix(fileName, filepath.Ext(fileName))
+	for _, size := range imageVariantSizes() {
+		variant := resize.Thumbnail(size.Width, size.Height, original, resize.Lanczos3)
+		width, height := variant.Bounds().Dx(), variant.Bounds().Dy()
+
+		jpegName := base + "_" + size.Name + "." + ImageFormatJPEG
+		err = putJPEG(flattenImage(variant), jpegName, &jpeg.Options{Quality: imageVariantJPEGQuality})
+		if err != nil {
+			return Image{}, err
+		}
+		result.Variants = append(result.Variants, ImageVariant{Name: size.Name, Format: ImageFormatJPEG, File: jpegName, Width: width, Height: height})
+
+		webPName := base + "_" + size.Name + "." + ImageFormatWebP
+		err = writeWebPVariant(variant, webPName)
+		if err != nil {
+			// WebP is optional, clients fall back on JPEG
+			webPEncoderWarning.Do(func() {
+				log.Printf("WebP variants are not generated: %v\n", err)
+			})
+			continue
+		}
+		result.Variants = append(result.Variants, ImageVariant{Name: size.Name, Format: ImageFormatWebP, File: webPName, Width: width, Height: height})
+	}
+
+	session := GetMongoSession()
+	defer session.Close()
+	db := session.DB("insapp").C("image")
+
+	// The references are kept, as the image may already be used
+	_, err = db.UpsertId(result.Name, bson.M{
+		"$set":         bson.M{"type": result.Type, "width": result.Width, "height": result.Height, "variants": result.Variants, "placeholder": result.Placeholder},
+		"$setOnInsert": bson.M{"date": result.Date},
+	})
+	if err != nil {
+		return Image{}, err
+	}
+
+	return GetImage(result.Name)
+}
+
+// imageTypeOf returns MediaTypeGIF for the animated GIF images, whose
+// variants only show the first frame, and MediaTypeImage otherwise
+func imageTypeOf(fileName string) string {
+	if filepath.Ext(fileName) != ".gif" {
+		return MediaTypeImage
+	}
+
+	file, _, err := getBlobStore().Get(fileName)
+	if err != nil {
+		return MediaTypeImage
+	}
+	defer file.Close()
+
+	animation, err := gif.DecodeAll(file)
+	if err != nil || len(animation.Image) < 2 {
+		return MediaTypeImage
+	}
+
+	return MediaTypeGIF
+}
+
+// touchImage records that the image with the given file name was just uploaded
+func touchImage(fileName string) {
+	session := GetMongoSession()
+	defer session.Close()
+	db := session.DB("insapp").C("image")
+
+	_ = db.UpdateId(fileName, bson.M{"$set": bson.M{"date": time.Now()}})
+}
+
+// writeWebPVariant encodes the image with the cwebp tool of libwebp,
+// as Go has no WebP encoder
+func writeWebPVariant(img image.Image, fileName string) error {
+	encoder := defaultWebPEncoder
+	if config != nil && config.WebPEncoder != "" {
+		encoder = config.WebPEncoder
+	}
+	encoder, err := exec.LookPath(encoder)
+	if err != nil {
+		return err
+	}
+
+	source, err := ioutil.TempFile("", "insapp-*.png")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(source.Name())
+
+	err = png.Encode(source, img)
+	source.Close()
+	if err != nil {
+		return err
+	}
+
+	encoded := source.Name() + ".webp"
+	defer os.Remove(encoded)
+
+	output, err := exec.Command(encoder, "-quiet", "-q", imageVariantWebPQuality, source.Name(), "-o", encoded).CombinedOutput()
+	if err != nil {
+		return errors.New(strings.TrimSpace(string(output)) + " " + err.Error())
+	}
+
+	file, err := os.Open(encoded)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return getBlobStore().Put(fileName, file, "image/webp")
+}
@@ -17,8 +17,9 @@ import (
 
 // TokenJTI models JTI keeping track of tokens.
 type TokenJTI struct {
-	ID  bson.ObjectId `bson:"_id,omitempty"`
-	JTI string        `json:"jti"`
+	ID     bson.ObjectId `bson:"_id,omitempty"`
+	JTI    string        `json:"jti"`
+	UserID bson.ObjectId `json:"userid" bson:"userid,omitempty"`
 }
 
 // AssociationLogin is the data provided by an association to authenticate.
@@ -84,6 +85,16 @@ func AuthMiddleware(next http.HandlerFunc, role string) http.HandlerFunc {
 			return
 		}
 
+		// Suspended users are not allowed to use the API anymore
+		claims := getTokenClaims(authToken)
+		if claims != nil && claims.Role == "user" {
+			if user := GetUser(claims.ID); user.IsSuspended() {
+				nullifyTokenCookies(&w, r)
+				writeSuspendedError(w, user)
+				return
+			}
+		}
+
 		setAuthAndRefreshCookies(&w, r, authToken, refreshToken)
 
 		next.ServeHTTP(w, r)
@@ -120,12 +131,18 @@ func LoginUserController(w http.ResponseWriter, r *http.Request) {
 		}).One(&user)
 	}
 
+	if user.IsSuspended() {
+		writeSuspendedError(w, user)
+		return
+	}
+
 	authToken, refreshToken := CreateNewTokens(user.ID, "user")
 
 	// Set the cookies to these newly created tokens
 	setAuthAndRefreshCookies(&w, r, authToken, refreshToken)
 	w.WriteHeader(http.StatusOK)
 
+	fillPostsLiked(&user)
 	json.NewEncoder(w).Encode(user)
 }
 
@@ -161,7 +178,16 @@ func LoginAssociationController(w http.ResponseWriter, r *http.Request) {
 }
 
 // LogoutUserController logs a user out.
+// The device whose {token} is given in the body stops receiving push notifications.
 func LogoutUserController(w http.ResponseWriter, r *http.Request) {
+	var device NotificationUser
+	_ = json.NewDecoder(r.Body).Decode(&device)
+
+	userID, err := GetUserFromRequest(r)
+	if err == nil && device.Token != "" {
+		DeleteNotificationUserWithToken(userID, device.Token)
+	}
+
 	DeleteTokenCookies(&w, r)
 
 	w.WriteHeader(http.StatusOK)
@@ -3,32 +3,39 @@ package insapp
 import (
 	"bytes"
 	"html/template"
-	"net/smtp"
 )
 
-// SendEmail sends an email to the given recipient.
-func SendEmail(to string, subject string, body string) {
-	from := config.GoogleEmail
-	pass := config.GooglePassword
-	cc := config.GoogleEmail
+// SendEmail stores an HTML email for the given recipient in the outbox,
+// which takes care of sending it.
+func SendEmail(to string, subject string, body string) error {
+	_, err := EnqueueEmail(Email{To: to, Subject: subject, HTML: body})
+	return err
+}
+
+// SendTextEmail stores a plain text email for the given recipient in the
+// outbox, which takes care of sending it.
+func SendTextEmail(to string, subject string, text string) error {
+	_, err := EnqueueEmail(Email{To: to, Subject: subject, Text: text})
+	return err
+}
+
+// deliverEmail sends an email with the mailer. Outside of production,
+// emails are sent to the sender instead of their recipient.
+func deliverEmail(email Email) error {
+	from := mailSender()
 
 	if config.Environment != "prod" {
-		to = from
-		subject = "[DEV] " + subject
+		email.To = from
+		email.Subject = "[DEV] " + email.Subject
 	}
 
-	msg := "From: " + from + "\n" +
-		"To: " + to + "\n" +
-		"Cc: " + cc + "\n" +
-		"Subject: " + subject + "\n" +
-		"MIME-version: 1.0;\nContent-Type: text/html; charset=\"UTF-8\";\n\n" +
-		body
-
-	smtp.SendMail("smtp.gmail.com:587", smtp.PlainAuth("", from, pass, "smtp.gmail.com"), from, []string{to}, []byte(msg))
+	return getMailer().Send(from, email)
 }
 
-// SendAssociationEmailSubscription sends a subscription email containing the credentials.
-func SendAssociationEmailSubscription(email string, password string) error {
+// SendAssociationEmailSubscription sends a subscription email containing the credentials,
+// in the given language. The email is sent right away rather than stored in
+// the outbox, so that the password is never saved.
+func SendAssociationEmailSubscription(email string, language string, password string) error {
 	data := struct {
 		Email    string
 		Password string
@@ -37,17 +44,17 @@ func SendAssociationEmailSubscription(email string, password string) error {
 		Password: password,
 	}
 
-	body, err := parseTemplate("templates/association_subscription_template.html", data)
-	if err == nil {
-		SendEmail(email, "Tes identifiants Insapp", body)
+	body, err := parseTemplate(localizedTemplate(language, "templates/association_subscription_template.html"), data)
+	if err != nil {
+		return err
 	}
 
-	return err
+	return deliverEmail(Email{To: email, Subject: localize(language, "email.subscription"), HTML: body})
 }
 
 // SendAssociationEmailForCommentOnEvent sends an email indicating
-// a new comment has been added on an event
-func SendAssociationEmailForCommentOnEvent(email string, event Event, comment Comment, user User) error {
+// a new comment has been added on an event, in the language of the association
+func SendAssociationEmailForCommentOnEvent(association Association, event Event, comment Comment, user User) error {
 	data := struct {
 		EventName        string
 		EventImage       string
@@ -62,17 +69,17 @@ func SendAssociationEmailForCommentOnEvent(email string, event Event, comment Co
 		Username:         user.Username,
 	}
 
-	body, err := parseTemplate("templates/association_comment_event_template.html", data)
-	if err == nil {
-		SendEmail(email, "Nouveau commentaire sur \""+event.Name+"\"", body)
+	body, err := parseTemplate(localizedTemplate(association.Language, "templates/association_comment_event_template.html"), data)
+	if err != nil {
+		return err
 	}
 
-	return err
+	return SendEmail(association.Email, localize(association.Language, "email.comment", "content", event.Name), body)
 }
 
 // SendAssociationEmailForCommentOnPost sends an email indicating
-// a new comment has been added on a post
-func SendAssociationEmailForCommentOnPost(email string, post Post, comment Comment, user User) error {
+// a new comment has been added on a post, in the language of the association
+func SendAssociationEmailForCommentOnPost(association Association, post Post, comment Comment, user User) error {
 	data := struct {
 		PostName        string
 		PostImage       string
@@ -87,12 +94,12 @@ func SendAssociationEmailForCommentOnPost(email string, post Post, comment Comme
 		Username:        user.Username,
 	}
 
-	body, err := parseTemplate("templates/association_comment_post_template.html", data)
-	if err == nil {
-		SendEmail(email, "Nouveau commentaire sur \""+post.Title+"\"", body)
+	body, err := parseTemplate(localizedTemplate(association.Language, "templates/association_comment_post_template.html"), data)
+	if err != nil {
+		return err
 	}
 
-	return err
+	return SendEmail(association.Email, localize(association.Language, "email.comment", "content", post.Title), body)
 }
 
 func parseTemplate(templateFileName string, data interface{}) (string, error) {
@@ -0,0 +1,510 @@
+package insapp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/html"
+)
+
+// Email defines an email sent to a single recipient. The plain text
+// version is generated from the HTML one when missing.
+type Email struct {
+	To      string `json:"to"`
+	Subject string `json:"subject"`
+	HTML    string `json:"html" bson:"body,omitempty"`
+	Text    string `json:"text" bson:"text,omitempty"`
+	// Headers are added to the headers of the message
+	Headers map[string]string `json:"headers,omitempty" bson:"headers,omitempty"`
+}
+
+// Mailer sends emails
+type Mailer interface {
+	Send(from string, email Email) error
+}
+
+// The TLS modes of the SMTP connection
+const (
+	SMTPTLSStartTLS = "starttls"
+	SMTPTLSImplicit = "tls"
+	SMTPTLSNone     = "none"
+)
+
+const (
+	defaultSMTPHost      = "smtp.gmail.com"
+	defaultSMTPPort      = 587
+	smtpTimeout          = 30 * time.Second
+	defaultMailDirectory = "mails"
+	mailMessageIDBytes   = 16
+)
+
+var (
+	mailer      Mailer
+	mailerMutex sync.RWMutex
+)
+
+// SetMailer replaces the mailer used to send emails.
+// It can be called while emails are being sent.
+func SetMailer(m Mailer) {
+	mailerMutex.Lock()
+	defer mailerMutex.Unlock()
+
+	mailer = m
+}
+
+// getMailer returns the mailer chosen in the configuration.
+// Emails are sent with SMTP by default, except in a local environment
+// where they are only logged.
+func getMailer() Mailer {
+	mailerMutex.RLock()
+	current := mailer
+	mailerMutex.RUnlock()
+	if current != nil {
+		return current
+	}
+
+	mailerMutex.Lock()
+	defer mailerMutex.Unlock()
+
+	if mailer == nil {
+		mailer = newMailer(config.MailTransport)
+	}
+
+	return mailer
+}
+
+func newMailer(name string) Mailer {
+	if name == "" {
+		if config.Environment == "local" {
+			name = "log"
+		} else {
+			name = "smtp"
+		}
+	}
+
+	switch name {
+	case "smtp":
+		return newSMTPMailerFromConfig()
+	case "file":
+		directory := config.MailDirectory
+		if directory == "" {
+			directory = defaultMailDirectory
+		}
+		return FileMailer{Directory: directory}
+	case "log":
+		return LogMailer{}
+	}
+
+	log.Printf("unknown mail transport %q, emails will only be logged\n", name)
+	return LogMailer{}
+}
+
+// newSMTPMailerFromConfig creates the SMTPMailer described by the
+// configuration. The Gmail server and the Google credentials are used
+// when no SMTP server is configured.
+func newSMTPMailerFromConfig() *SMTPMailer {
+	if config.SMTPHost == "" {
+		return &SMTPMailer{
+			Host:     defaultSMTPHost,
+			Port:     defaultSMTPPort,
+			TLS:      SMTPTLSStartTLS,
+			Username: config.GoogleEmail,
+			Password: config.GooglePassword,
+		}
+	}
+
+	port := config.SMTPPort
+	if port == 0 {
+		port = defaultSMTPPort
+	}
+	tlsMode := config.SMTPTLS
+	if tlsMode == "" {
+		tlsMode = SMTPTLSStartTLS
+	}
+
+	return &SMTPMailer{
+		Host:     config.SMTPHost,
+		Port:     port,
+		TLS:      tlsMode,
+		Username: config.SMTPUsername,
+		Password: config.SMTPPassword,
+	}
+}
+
+// mailSender returns the address emails are sent from
+func mailSender() string {
+	if config.MailFrom != "" {
+		return config.MailFrom
+	}
+
+	return config.GoogleEmail
+}
+
+// SMTPMailer sends emails to an SMTP server. The connection is secured
+// according to the TLS mode, and authenticated if a username is given.
+type SMTPMailer struct {
+	Host     string
+	Port     int
+	TLS      string
+	Username string
+	Password string
+}
+
+// Send sends the email to its recipient
+func (m *SMTPMailer) Send(from string, email Email) error {
+	sender, err := mail.ParseAddress(from)
+	if err != nil {
+		return fmt.Errorf("wrong sender address %q: %v", from, err)
+	}
+	recipient, err := mail.ParseAddress(email.To)
+	if err != nil {
+		return fmt.Errorf("wrong recipient address %q: %v", email.To, err)
+	}
+
+	message, err := buildMailMessage(from, email)
+	if err != nil {
+		return err
+	}
+
+	client, err := m.dial()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	if m.Username != "" {
+		err = client.Auth(smtp.PlainAuth("", m.Username, m.Password, m.Host))
+		if err != nil {
+			return err
+		}
+	}
+
+	if err = client.Mail(sender.Address); err != nil {
+		return err
+	}
+	if err = client.Rcpt(recipient.Address); err != nil {
+		return err
+	}
+
+	writer, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = writer.Write(message); err != nil {
+		return err
+	}
+	if err = writer.Close(); err != nil {
+		return err
+	}
+
+	// The email is sent once its data is accepted. Failing to end the
+	// session must not make the outbox send it again.
+	if err = client.Quit(); err != nil {
+		log.Printf("error ending the SMTP session after sending to %q: %v\n", recipient.Address, err)
+	}
+
+	return nil
+}
+
+// dial connects to the SMTP server and secures the connection
+func (m *SMTPMailer) dial() (*smtp.Client, error) {
+	address := net.JoinHostPort(m.Host, strconv.Itoa(m.Port))
+	tlsConfig := &tls.Config{ServerName: m.Host}
+
+	var connection net.Conn
+	var err error
+	if m.TLS == SMTPTLSImplicit {
+		connection, err = tls.DialWithDialer(&net.Dialer{Timeout: smtpTimeout}, "tcp", address, tlsConfig)
+	} else {
+		connection, err = net.DialTimeout("tcp", address, smtpTimeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+	_ = connection.SetDeadline(time.Now().Add(smtpTimeout))
+
+	client, err := smtp.NewClient(connection, m.Host)
+	if err != nil {
+		connection.Close()
+		return nil, err
+	}
+
+	switch m.TLS {
+	case SMTPTLSImplicit, SMTPTLSNone:
+		return client, nil
+	case SMTPTLSStartTLS:
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			client.Close()
+			return nil, errors.New("the SMTP server does not support STARTTLS")
+		}
+		if err = client.StartTLS(tlsConfig); err != nil {
+			client.Close()
+			return nil, err
+		}
+		return client, nil
+	}
+
+	client.Close()
+	return nil, fmt.Errorf("unknown SMTP TLS mode %q", m.TLS)
+}
+
+// FileMailer writes the emails in a directory instead of sending them,
+// one .eml file per email. It is meant to be used in development.
+type FileMailer struct {
+	Directory string
+}
+
+// Send writes the email in the directory
+func (m FileMailer) Send(from string, email Email) error {
+	message, err := buildMailMessage(from, email)
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(m.Directory, 0755); err != nil {
+		return err
+	}
+
+	name := time.Now().Format("20060102-150405.000000000") + ".eml"
+	return ioutil.WriteFile(filepath.Join(m.Directory, name), message, 0644)
+}
+
+// LogMailer only logs the emails, without sending them
+type LogMailer struct{}
+
+// Send logs the email
+func (LogMailer) Send(from string, email Email) error {
+	log.Printf("email from %q to %q: %s\n%s\n", from, email.To, email.Subject, email.plainText())
+	return nil
+}
+
+// plainText returns the plain text version of the email
+func (email Email) plainText() string {
+	if email.Text != "" || email.HTML == "" {
+		return email.Text
+	}
+
+	return htmlToText(email.HTML)
+}
+
+// buildMailMessage returns the email formatted as a MIME message. Emails
+// having an HTML version are sent as multipart/alternative, with the plain
+// text version first.
+func buildMailMessage(from string, email Email) ([]byte, error) {
+	sender, err := mail.ParseAddress(from)
+	if err != nil {
+		return nil, fmt.Errorf("wrong sender address %q: %v", from, err)
+	}
+	recipient, err := mail.ParseAddress(email.To)
+	if err != nil {
+		return nil, fmt.Errorf("wrong recipient address %q: %v", email.To, err)
+	}
+
+	messageID, err := newMessageID(sender.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	buffer := new(bytes.Buffer)
+	writeMailHeader(buffer, "From", sender.String())
+	writeMailHeader(buffer, "To", recipient.String())
+	writeMailHeader(buffer, "Subject", mime.QEncoding.Encode("UTF-8", email.Subject))
+	writeMailHeader(buffer, "Date", time.Now().Format(time.RFC1123Z))
+	writeMailHeader(buffer, "Message-ID", messageID)
+	writeMailHeader(buffer, "MIME-Version", "1.0")
+
+	names := make([]string, 0, len(email.Headers))
+	for name := range email.Headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		writeMailHeader(buffer, textproto.CanonicalMIMEHeaderKey(name), email.Headers[name])
+	}
+
+	if email.HTML == "" {
+		writeMailHeader(buffer, "Content-Type", "text/plain; charset=UTF-8")
+		writeMailHeader(buffer, "Content-Transfer-Encoding", "quoted-printable")
+		buffer.WriteString("\r\n")
+		err = writeQuotedPrintable(buffer, email.Text)
+		return buffer.Bytes(), err
+	}
+
+	writer := multipart.NewWriter(buffer)
+	writeMailHeader(buffer, "Content-Type", "multipart/alternative; boundary="+writer.Boundary())
+	buffer.WriteString("\r\n")
+
+	parts := []struct {
+		contentType string
+		content     string
+	}{
+		{"text/plain; charset=UTF-8", email.plainText()},
+		{"text/html; charset=UTF-8", email.HTML},
+	}
+	for _, part := range parts {
+		partWriter, err := writer.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err = writeQuotedPrintable(partWriter, part.content); err != nil {
+			return nil, err
+		}
+	}
+
+	if err = writer.Close(); err != nil {
+		return nil, err
+	}
+
+	return buffer.Bytes(), nil
+}
+
+func writeMailHeader(buffer *bytes.Buffer, name string, value string) {
+	// Line breaks would let the value inject other headers
+	value = strings.NewReplacer("\r", "", "\n", "").Replace(value)
+	buffer.WriteString(name + ": " + value + "\r\n")
+}
+
+func writeQuotedPrintable(w io.Writer, content string) error {
+	writer := quotedprintable.NewWriter(w)
+	if _, err := writer.Write([]byte(content)); err != nil {
+		return err
+	}
+
+	return writer.Close()
+}
+
+// newMessageID returns a unique Message-ID for an email sent from the given address
+func newMessageID(from string) (string, error) {
+	buffer := make([]byte, mailMessageIDBytes)
+	if _, err := rand.Read(buffer); err != nil {
+		return "", err
+	}
+
+	domain := "insapp"
+	if at := strings.LastIndex(from, "@"); at >= 0 {
+		domain = from[at+1:]
+	}
+
+	return "<" + hex.EncodeToString(buffer) + "@" + domain + ">", nil
+}
+
+// htmlToText returns the text of an HTML document, keeping its paragraphs
+// and the address of its links
+func htmlToText(document string) string {
+	tokenizer := html.NewTokenizer(strings.NewReader(document))
+	text := new(strings.Builder)
+	skipped := 0
+	var links []string
+
+	newLine := func() {
+		current := text.String()
+		if current != "" && !strings.HasSuffix(current, "\n\n") {
+			text.WriteString("\n")
+		}
+	}
+
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			return collapseBlankLines(text.String())
+		case html.TextToken:
+			if skipped > 0 {
+				continue
+			}
+			words := strings.Fields(string(tokenizer.Text()))
+			if len(words) == 0 {
+				continue
+			}
+			current := text.String()
+			if current != "" && !strings.HasSuffix(current, "\n") && !strings.HasSuffix(current, " ") {
+				text.WriteString(" ")
+			}
+			text.WriteString(strings.Join(words, " "))
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, hasAttributes := tokenizer.TagName()
+			switch string(name) {
+			case "head", "style", "script", "title":
+				skipped++
+			case "br", "p", "div", "tr", "table", "h1", "h2", "h3", "h4", "li":
+				newLine()
+			case "a":
+				href := ""
+				for hasAttributes {
+					var key, value []byte
+					key, value, hasAttributes = tokenizer.TagAttr()
+					if string(key) == "href" {
+						href = string(value)
+					}
+				}
+				links = append(links, href)
+			}
+		case html.EndTagToken:
+			name, _ := tokenizer.TagName()
+			switch string(name) {
+			case "head", "style", "script", "title":
+				if skipped > 0 {
+					skipped--
+				}
+			case "p", "div", "table", "h1", "h2", "h3", "h4":
+				newLine()
+				newLine()
+			case "a":
+				if len(links) == 0 {
+					continue
+				}
+				href := links[len(links)-1]
+				links = links[:len(links)-1]
+				// Links showing their address are left as they are
+				if href != "" && !strings.HasPrefix(href, "mailto:") && !strings.HasSuffix(text.String(), href) {
+					text.WriteString(" (" + href + ")")
+				}
+			}
+		}
+	}
+}
+
+// collapseBlankLines removes the trailing spaces and keeps at most
+// one blank line between paragraphs
+func collapseBlankLines(text string) string {
+	lines := strings.Split(text, "\n")
+	result := make([]string, 0, len(lines))
+	blank := false
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			if !blank && len(result) > 0 {
+				result = append(result, "")
+			}
+			blank = true
+			continue
+		}
+		blank = false
+		result = append(result, line)
+	}
+
+	return strings.TrimSpace(strings.Join(result, "\n")) + "\n"
+}
@@ -0,0 +1,144 @@
+package insapp
+
+import (
+	"bytes"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+// startSMTPStub accepts a single SMTP session and sends the data of the
+// email it receives. The session is cut without answering QUIT if asked.
+func startSMTPStub(t *testing.T, answerQuit bool) (*SMTPMailer, chan []byte) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	messages := make(chan []byte, 1)
+	go func() {
+		defer listener.Close()
+		connection, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer connection.Close()
+
+		session := textproto.NewConn(connection)
+		_ = session.PrintfLine("220 stub ESMTP")
+		for {
+			line, err := session.ReadLine()
+			if err != nil {
+				return
+			}
+			switch command := strings.ToUpper(strings.SplitN(line, " ", 2)[0]); command {
+			case "EHLO", "HELO", "MAIL", "RCPT":
+				_ = session.PrintfLine("250 OK")
+			case "DATA":
+				_ = session.PrintfLine("354 Go ahead")
+				data, err := session.ReadDotBytes()
+				if err != nil {
+					return
+				}
+				messages <- data
+				_ = session.PrintfLine("250 Queued")
+			case "QUIT":
+				if answerQuit {
+					_ = session.PrintfLine("221 Bye")
+				}
+				return
+			default:
+				_ = session.PrintfLine("502 Unknown command")
+			}
+		}
+	}()
+
+	address := listener.Addr().(*net.TCPAddr)
+	return &SMTPMailer{Host: "127.0.0.1", Port: address.Port, TLS: SMTPTLSNone}, messages
+}
+
+func TestSMTPMailerSendsMultipartMessage(t *testing.T) {
+	m, messages := startSMTPStub(t, true)
+
+	email := Email{
+		To:      "Étudiant <etudiant@insa-rennes.fr>",
+		Subject: "Résumé de la semaine",
+		HTML:    `<p>Bonjour à tous</p><p><a href="https://insapp.fr/">Insapp</a></p>`,
+		Headers: map[string]string{"list-unsubscribe": "<https://api.insapp.fr/digest/unsubscribe?token=t>"},
+	}
+	if err := m.Send("Insapp <contact@insapp.fr>", email); err != nil {
+		t.Fatal(err)
+	}
+
+	message, err := mail.ReadMessage(bytes.NewReader(<-messages))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	subject := message.Header.Get("Subject")
+	if !strings.HasPrefix(subject, "=?UTF-8?") {
+		t.Errorf("subject %q is not encoded", subject)
+	}
+	decoded, err := new(mime.WordDecoder).DecodeHeader(subject)
+	if err != nil || decoded != email.Subject {
+		t.Errorf("subject decoded as %q (%v), want %q", decoded, err, email.Subject)
+	}
+	recipient, err := message.Header.AddressList("To")
+	if err != nil || len(recipient) != 1 || recipient[0].Name != "Étudiant" || recipient[0].Address != "etudiant@insa-rennes.fr" {
+		t.Errorf("unexpected recipient %v (%v)", recipient, err)
+	}
+	if message.Header.Get("List-Unsubscribe") != email.Headers["list-unsubscribe"] {
+		t.Errorf("unexpected List-Unsubscribe header %q", message.Header.Get("List-Unsubscribe"))
+	}
+	if message.Header.Get("Message-ID") == "" || message.Header.Get("Date") == "" {
+		t.Error("missing Message-ID or Date header")
+	}
+
+	mediaType, parameters, err := mime.ParseMediaType(message.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/alternative" {
+		t.Fatalf("unexpected content type %q (%v)", mediaType, err)
+	}
+
+	reader := multipart.NewReader(message.Body, parameters["boundary"])
+	var types, contents []string
+	for {
+		part, err := reader.NextPart()
+		if err != nil {
+			break
+		}
+		content, err := ioutil.ReadAll(quotedprintable.NewReader(part))
+		if err != nil {
+			t.Fatal(err)
+		}
+		types = append(types, part.Header.Get("Content-Type"))
+		contents = append(contents, string(content))
+	}
+
+	if len(types) != 2 || !strings.HasPrefix(types[0], "text/plain") || !strings.HasPrefix(types[1], "text/html") {
+		t.Fatalf("unexpected parts %v", types)
+	}
+	if !strings.Contains(contents[0], "Bonjour à tous") || !strings.Contains(contents[0], "https://insapp.fr/") {
+		t.Errorf("unexpected plain text %q", contents[0])
+	}
+	if contents[1] != email.HTML {
+		t.Errorf("unexpected HTML %q", contents[1])
+	}
+}
+
+func TestSMTPMailerIgnoresQuitErrors(t *testing.T) {
+	m, messages := startSMTPStub(t, false)
+
+	err := m.Send("contact@insapp.fr", Email{To: "etudiant@insa-rennes.fr", Subject: "Test", Text: "Bonjour"})
+	if err != nil {
+		t.Errorf("accepted email reported as failed: %v", err)
+	}
+	if len(messages) != 1 {
+		t.Error("the email was not sent")
+	}
+}
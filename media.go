@@ -0,0 +1,187 @@
+package insapp
+
+import (
+	"strings"
+	"unicode/utf8"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Media is an image or a video of the gallery of a post or an event
+type Media struct {
+	// Type is MediaTypeImage, MediaTypeGIF or MediaTypeVideo
+	Type string `json:"type"`
+	// Image is the image, or the poster of the video
+	Image string `json:"image"`
+	Video string `json:"video,omitempty"`
+	// Duration is the duration of the video, in seconds
+	Duration float64 `json:"duration,omitempty"`
+	Width    int     `json:"width"`
+	Height   int     `json:"height"`
+	Palette  [][]int `json:"palette"`
+	// Placeholder is displayed while the image loads
+	Placeholder ImagePlaceholder `json:"placeholder"`
+	// Alt describes the image for the people who cannot see it
+	Alt string `json:"alt"`
+}
+
+const (
+	maxMediaCount     = 50
+	maxMediaAltLength = 1000
+)
+
+// withPostMedia fills the gallery of the post. Older clients only send a
+// single image, which becomes the gallery, while the first image of the
+// gallery is kept as the single image for them, a poster for a video, along
+// with its type. The colors of the post are derived from the palette of
+// this image.
+func withPostMedia(post Post) Post {
+	if len(post.Media) == 0 && post.Image != "" {
+		width, height := imageSizeOf(post.ImageSize)
+		post.Media = []Media{{Image: post.Image, Width: width, Height: height}}
+	}
+
+	post.Media = describeMedia(post.Media)
+	if len(post.Media) > 0 {
+		post.Image = post.Media[0].Image
+		post.ImageSize = bson.M{"width": post.Media[0].Width, "height": post.Media[0].Height}
+		post.Placeholder = post.Media[0].Placeholder
+		post.MediaType, post.Video = post.Media[0].Type, post.Media[0].Video
+		if len(post.Palette) == 0 {
+			post.Palette = post.Media[0].Palette
+		}
+	} else {
+		post.MediaType, post.Video = "", ""
+	}
+	post.Palette, post.SelectedColor, post.BgColor, post.FgColor = deriveColors(post.Image, post.Palette, post.SelectedColor, post.BgColor, post.FgColor)
+
+	return post
+}
+
+// withEventMedia fills the gallery of the event, like withPostMedia.
+// The palette of the first image is used if the event has none, and its
+// colors are derived from it.
+func withEventMedia(event Event) Event {
+	if len(event.Media) == 0 && event.Image != "" {
+		event.Media = []Media{{Image: event.Image}}
+	}
+
+	event.Media = describeMedia(event.Media)
+	if len(event.Media) > 0 {
+		event.Image = event.Media[0].Image
+		event.Placeholder = event.Media[0].Placeholder
+		if len(event.Palette) == 0 {
+			event.Palette = event.Media[0].Palette
+		}
+	}
+	event.Palette, event.SelectedColor, event.BgColor, event.FgColor = deriveColors(event.Image, event.Palette, event.SelectedColor, event.BgColor, event.FgColor)
+
+	return event
+}
+
+// keepMedia returns the gallery to save when an older client updates the
+// single image of a content, replacing only its first image
+func keepMedia(current []Media, image string) []Media {
+	if len(current) == 0 || image == "" {
+		return nil
+	}
+	if current[0].Image == image {
+		return current
+	}
+
+	result := []Media{{Image: image}}
+	for _, item := range current[1:] {
+		if item.Image != image {
+			result = append(result, item)
+		}
+	}
+
+	return result
+}
+
+// describeMedia leaves out the unknown images and videos, and completes the
+// type, the dimensions, the palette and the placeholder of the others. The
+// image of a video is always its poster.
+func describeMedia(media []Media) []Media {
+	result := []Media{}
+	for _, item := range media {
+		if len(result) == maxMediaCount {
+			break
+		}
+		item.Type = MediaTypeImage
+		if item.Video != "" {
+			video, err := GetImage(item.Video)
+			if err != nil || video.Type != MediaTypeVideo {
+				continue
+			}
+			item.Type, item.Image, item.Duration = MediaTypeVideo, video.Poster, video.Duration
+		} else {
+			item.Duration = 0
+		}
+		if !servedImagePattern.MatchString(item.Image) {
+			continue
+		}
+
+		metadata, err := GetImage(item.Image)
+		if err == nil && metadata.Width > 0 {
+			item.Width, item.Height = metadata.Width, metadata.Height
+			if metadata.Type == MediaTypeGIF && item.Type == MediaTypeImage {
+				item.Type = MediaTypeGIF
+			}
+		} else if item.Width == 0 || item.Height == 0 {
+			item.Width, item.Height = GetImageDimension(item.Image)
+			if item.Width == 0 || item.Height == 0 {
+				continue
+			}
+		}
+		// A missing palette is extracted in the background, and given to
+		// the contents using the image once known
+		if len(metadata.Palette) > 0 {
+			item.Palette = metadata.Palette
+		} else if err == nil {
+			ExtractImagePalette(item.Image)
+		}
+		item.Placeholder = GetImagePlaceholder(item.Image)
+
+		item.Alt = strings.TrimSpace(item.Alt)
+		for utf8.RuneCountInString(item.Alt) > maxMediaAltLength {
+			_, size := utf8.DecodeLastRuneInString(item.Alt)
+			item.Alt = item.Alt[:len(item.Alt)-size]
+		}
+
+		result = append(result, item)
+	}
+
+	return result
+}
+
+// mediaImages returns the images and the videos of the gallery
+func mediaImages(media []Media) []string {
+	result := make([]string, 0, len(media))
+	for _, item := range media {
+		result = append(result, item.Image)
+		if item.Video != "" {
+			result = append(result, item.Video)
+		}
+	}
+
+	return result
+}
+
+// imageSizeOf reads the dimensions sent by older clients with their image
+func imageSizeOf(size bson.M) (int, int) {
+	return intOf(size["width"]), intOf(size["height"])
+}
+
+func intOf(value interface{}) int {
+	switch number := value.(type) {
+	case int:
+		return number
+	case int64:
+		return int(number)
+	case float64:
+		return int(number)
+	}
+
+	return 0
+}
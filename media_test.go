@@ -0,0 +1,31 @@
+package insapp
+
+import "testing"
+
+func TestWithPostMediaWithoutMedia(t *testing.T) {
+	post := withPostMedia(Post{
+		Title:     "Assemblée générale",
+		MediaType: MediaTypeVideo,
+		Video:     "removed.mp4",
+		Palette:   [][]int{{255, 136, 0}},
+		FgColor:   "ffffff",
+	})
+
+	if len(post.Media) != 0 || post.Image != "" {
+		t.Errorf("got the media %v and the image %q for a text-only post", post.Media, post.Image)
+	}
+	if post.MediaType != "" || post.Video != "" {
+		t.Errorf("got the media type %q and the video %q, expected none", post.MediaType, post.Video)
+	}
+	if len(post.Palette) != 1 || post.BgColor != "ff8800" || post.FgColor != blackColor {
+		t.Errorf("got the palette %v with %q on %q, expected the colors derived from the palette sent", post.Palette, post.FgColor, post.BgColor)
+	}
+}
+
+func TestWithEventMediaWithoutMedia(t *testing.T) {
+	event := withEventMedia(Event{Name: "Gala"})
+
+	if len(event.Media) != 0 || event.Image != "" || len(event.Palette) != 0 {
+		t.Errorf("got the media %v, the image %q and the palette %v for an event without image", event.Media, event.Image, event.Palette)
+	}
+}
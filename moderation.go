@@ -0,0 +1,313 @@
+package insapp
+
+import (
+	"errors"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// ModerationAction defines how to model an action taken by a moderator
+type ModerationAction struct {
+	ID         bson.ObjectId `bson:"_id,omitempty"`
+	Moderator  bson.ObjectId `json:"moderator"`
+	Action     string        `json:"action"`
+	TargetType string        `json:"targettype"`
+	Target     bson.ObjectId `json:"target"`
+	Parent     bson.ObjectId `json:"parent,omitempty" bson:"parent,omitempty"`
+	Reason     string        `json:"reason"`
+	Until      time.Time     `json:"until,omitempty" bson:"until,omitempty"`
+	Date       time.Time     `json:"date"`
+}
+
+// ModerationActions is an array of ModerationAction
+type ModerationActions []ModerationAction
+
+// The actions a moderator can take
+const (
+	ModerationActionHide      = "hide"
+	ModerationActionUnhide    = "unhide"
+	ModerationActionSuspend   = "suspend"
+	ModerationActionUnsuspend = "unsuspend"
+)
+
+// addModerationAction records the given action in the moderation log
+func addModerationAction(action ModerationAction) ModerationAction {
+	session := GetMongoSession()
+	defer session.Close()
+	db := session.DB("insapp").C("moderation_action")
+
+	action.ID = bson.NewObjectId()
+	action.Date = time.Now()
+	_ = db.Insert(action)
+
+	return action
+}
+
+// GetModerationActions returns the moderation log, newest first.
+// If target is not empty, only the actions on this content are returned.
+func GetModerationActions(target bson.ObjectId) ModerationActions {
+	session := GetMongoSession()
+	defer session.Close()
+	db := session.DB("insapp").C("moderation_action")
+
+	query := bson.M{}
+	if target != "" {
+		query["target"] = target
+	}
+
+	var result ModerationActions
+	_ = db.Find(query).Sort("-date").All(&result)
+
+	return result
+}
+
+// SetPostHidden hides or shows again the post linked to the given id
+func SetPostHidden(id bson.ObjectId, hidden bool, moderator bson.ObjectId, reason string) (Post, error) {
+	session := GetMongoSession()
+	defer session.Close()
+	db := session.DB("insapp").C("post")
+
+	err := db.UpdateId(id, bson.M{"$set": bson.M{"hidden": hidden}})
+	if err != nil {
+		return Post{}, errors.New("no post found")
+	}
+
+	addModerationAction(ModerationAction{
+		Moderator:  moderator,
+		Action:     hideActionName(hidden),
+		TargetType: ReportTargetPost,
+		Target:     id,
+		Reason:     reason,
+	})
+
+	return GetPost(id), nil
+}
+
+// SetEventHidden hides or shows again the event linked to the given id
+func SetEventHidden(id bson.ObjectId, hidden bool, moderator bson.ObjectId, reason string) (Event, error) {
+	session := GetMongoSession()
+	defer session.Close()
+	db := session.DB("insapp").C("event")
+
+	err := db.UpdateId(id, bson.M{"$set": bson.M{"hidden": hidden}})
+	if err != nil {
+		return Event{}, errors.New("no event found")
+	}
+
+	addModerationAction(ModerationAction{
+		Moderator:  moderator,
+		Action:     hideActionName(hidden),
+		TargetType: ReportTargetEvent,
+		Target:     id,
+		Reason:     reason,
+	})
+
+	return GetEvent(id), nil
+}
+
+// SetPostCommentHidden hides or shows again the given comment of a post
+func SetPostCommentHidden(id bson.ObjectId, commentID bson.ObjectId, hidden bool, moderator bson.ObjectId, reason string) (Post, error) {
+	session := GetMongoSession()
+	defer session.Close()
+	db := session.DB("insapp").C("post")
+
+	selector := bson.M{"_id": id, "comments._id": commentID}
+	err := db.Update(selector, bson.M{"$set": bson.M{"comments.$.hidden": hidden}})
+	if err != nil {
+		return Post{}, errors.New("no comment found")
+	}
+
+	addModerationAction(ModerationAction{
+		Moderator:  moderator,
+		Action:     hideActionName(hidden),
+		TargetType: ReportTargetPostComment,
+		Target:     commentID,
+		Parent:     id,
+		Reason:     reason,
+	})
+
+	return GetPost(id), nil
+}
+
+// SetEventCommentHidden hides or shows again the given comment of an event
+func SetEventCommentHidden(id bson.ObjectId, commentID bson.ObjectId, hidden bool, moderator bson.ObjectId, reason string) (Event, error) {
+	session := GetMongoSession()
+	defer session.Close()
+	db := session.DB("insapp").C("event")
+
+	selector := bson.M{"_id": id, "comments._id": commentID}
+	err := db.Update(selector, bson.M{"$set": bson.M{"comments.$.hidden": hidden}})
+	if err != nil {
+		return Event{}, errors.New("no comment found")
+	}
+
+	addModerationAction(ModerationAction{
+		Moderator:  moderator,
+		Action:     hideActionName(hidden),
+		TargetType: ReportTargetEventComment,
+		Target:     commentID,
+		Parent:     id,
+		Reason:     reason,
+	})
+
+	return GetEvent(id), nil
+}
+
+// SuspendUser blocks the user linked to the given id for the given duration.
+// Every refresh token of the user is revoked.
+func SuspendUser(id bson.ObjectId, duration time.Duration, moderator bson.ObjectId, reason string) (User, error) {
+	session := GetMongoSession()
+	defer session.Close()
+	db := session.DB("insapp").C("user")
+
+	if duration <= 0 {
+		return User{}, errors.New("the suspension duration must be positive")
+	}
+
+	until := time.Now().Add(duration)
+	err := db.UpdateId(id, bson.M{"$set": bson.M{"suspendeduntil": until}})
+	if err != nil {
+		return User{}, errors.New("no user found")
+	}
+
+	RevokeRefreshTokensForUser(id)
+
+	addModerationAction(ModerationAction{
+		Moderator:  moderator,
+		Action:     ModerationActionSuspend,
+		TargetType: ReportTargetUser,
+		Target:     id,
+		Reason:     reason,
+		Until:      until,
+	})
+
+	return GetUser(id), nil
+}
+
+// UnsuspendUser lifts the suspension of the user linked to the given id
+func UnsuspendUser(id bson.ObjectId, moderator bson.ObjectId, reason string) (User, error) {
+	session := GetMongoSession()
+	defer session.Close()
+	db := session.DB("insapp").C("user")
+
+	err := db.UpdateId(id, bson.M{"$unset": bson.M{"suspendeduntil": ""}})
+	if err != nil {
+		return User{}, errors.New("no user found")
+	}
+
+	addModerationAction(ModerationAction{
+		Moderator:  moderator,
+		Action:     ModerationActionUnsuspend,
+		TargetType: ReportTargetUser,
+		Target:     id,
+		Reason:     reason,
+	})
+
+	return GetUser(id), nil
+}
+
+func hideActionName(hidden bool) string {
+	if hidden {
+		return ModerationActionHide
+	}
+	return ModerationActionUnhide
+}
+
+// viewer describes who is reading some content, to decide what can be shown
+type viewer struct {
+	id        bson.ObjectId
+	moderator bool
+	blocked   []bson.ObjectId
+}
+
+// hiddenFilter returns the condition leaving out the hidden posts or events
+// of a query, unless hidden is true
+func hiddenFilter(hidden bool) bson.M {
+	if hidden {
+		return nil
+	}
+
+	return bson.M{"hidden": bson.M{"$ne": true}}
+}
+
+// blockedFilter returns the condition leaving out the given blocked users
+// of a query on users
+func blockedFilter(blocked []bson.ObjectId) bson.M {
+	if len(blocked) == 0 {
+		return nil
+	}
+
+	return bson.M{"_id": bson.M{"$nin": blocked}}
+}
+
+// visibleComments removes the hidden comments, unless asked by a moderator,
+// and the comments of the users blocked by the viewer
+func visibleComments(comments Comments, v viewer) Comments {
+	result := Comments{}
+	for _, comment := range comments {
+		if comment.Hidden && !v.moderator {
+			continue
+		}
+		if containsObjectID(v.blocked, comment.User) {
+			continue
+		}
+		result = append(result, comment)
+	}
+
+	return result
+}
+
+// visiblePost returns the post without the comments the viewer should not
+// see, along with the reactions, and false if the post itself is hidden
+// from the viewer
+func visiblePost(post Post, v viewer) (Post, bool) {
+	post.Comments = visibleComments(post.Comments, v)
+	posts := Posts{post}
+	fillPostsReactions(posts, v.id)
+	return posts[0], v.moderator || !post.Hidden
+}
+
+// visiblePosts removes the posts and comments the viewer should not see,
+// and fills in the reactions
+func visiblePosts(posts Posts, v viewer) Posts {
+	result := Posts{}
+	for _, post := range posts {
+		if post.Hidden && !v.moderator {
+			continue
+		}
+		post.Comments = visibleComments(post.Comments, v)
+		result = append(result, post)
+	}
+
+	fillPostsReactions(result, v.id)
+
+	return result
+}
+
+// visibleEvent returns the event without the comments the viewer should not
+// see, along with the reactions on comments, and false if the event itself
+// is hidden from the viewer
+func visibleEvent(event Event, v viewer) (Event, bool) {
+	event.Comments = visibleComments(event.Comments, v)
+	events := Events{event}
+	fillEventsReactions(events, v.id)
+	return events[0], v.moderator || !event.Hidden
+}
+
+// visibleEvents removes the events and comments the viewer should not see,
+// and fills in the reactions on comments
+func visibleEvents(events Events, v viewer) Events {
+	result := Events{}
+	for _, event := range events {
+		if event.Hidden && !v.moderator {
+			continue
+		}
+		event.Comments = visibleComments(event.Comments, v)
+		result = append(result, event)
+	}
+
+	fillEventsReactions(result, v.id)
+
+	return result
+}
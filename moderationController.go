@@ -0,0 +1,226 @@
+package insapp
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// ModerationRequest is the body sent by a moderator along with an action.
+// If Report is set, the given report is marked as actioned.
+type ModerationRequest struct {
+	Reason string `json:"reason"`
+	Hours  int    `json:"hours"`
+	Report string `json:"report"`
+}
+
+// getViewer returns who made the request, to filter out the content
+// this user should not see
+func getViewer(r *http.Request) viewer {
+	role, err := GetRoleFromRequest(r)
+	if err != nil {
+		return viewer{}
+	}
+
+	userID, err := GetUserFromRequest(r)
+	if err != nil {
+		return viewer{}
+	}
+
+	if role != "user" {
+		return viewer{id: userID, moderator: role == "admin"}
+	}
+
+	return viewer{id: userID, blocked: GetUser(userID).Blocked}
+}
+
+// writeSuspendedError answers that the given user has been suspended
+func writeSuspendedError(w http.ResponseWriter, user User) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusForbidden)
+	_ = json.NewEncoder(w).Encode(bson.M{
+		"error": "account suspended",
+		"until": user.SuspendedUntil,
+	})
+}
+
+// decodeModerationRequest reads the moderation details from the request body
+// and returns the moderator ID.
+func decodeModerationRequest(w http.ResponseWriter, r *http.Request) (ModerationRequest, bson.ObjectId, bool) {
+	var request ModerationRequest
+	_ = json.NewDecoder(r.Body).Decode(&request)
+
+	moderatorID, err := GetUserFromRequest(r)
+	if err != nil {
+		w.WriteHeader(http.StatusNotAcceptable)
+		_ = json.NewEncoder(w).Encode(bson.M{"error": "could not get user ID"})
+		return request, moderatorID, false
+	}
+
+	if request.Report != "" && !bson.IsObjectIdHex(request.Report) {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(bson.M{"error": "wrong report ID"})
+		return request, moderatorID, false
+	}
+
+	return request, moderatorID, true
+}
+
+// answerModeration answers the moderated content, and closes the report
+// which led to this action if any
+func answerModeration(w http.ResponseWriter, request ModerationRequest, moderatorID bson.ObjectId, res interface{}, err error) {
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		_ = json.NewEncoder(w).Encode(bson.M{"error": err.Error()})
+		return
+	}
+
+	if request.Report != "" {
+		_, _ = ResolveReport(bson.ObjectIdHex(request.Report), ReportStatusActioned, moderatorID, request.Reason)
+	}
+
+	_ = json.NewEncoder(w).Encode(res)
+}
+
+// HidePostController will answer a JSON of the hidden post
+func HidePostController(w http.ResponseWriter, r *http.Request) {
+	setPostHiddenController(w, r, true)
+}
+
+// UnhidePostController will answer a JSON of the post visible again
+func UnhidePostController(w http.ResponseWriter, r *http.Request) {
+	setPostHiddenController(w, r, false)
+}
+
+func setPostHiddenController(w http.ResponseWriter, r *http.Request, hidden bool) {
+	request, moderatorID, ok := decodeModerationRequest(w, r)
+	if !ok {
+		return
+	}
+
+	vars := mux.Vars(r)
+	res, err := SetPostHidden(bson.ObjectIdHex(vars["id"]), hidden, moderatorID, request.Reason)
+	answerModeration(w, request, moderatorID, res, err)
+}
+
+// HideEventController will answer a JSON of the hidden event
+func HideEventController(w http.ResponseWriter, r *http.Request) {
+	setEventHiddenController(w, r, true)
+}
+
+// UnhideEventController will answer a JSON of the event visible again
+func UnhideEventController(w http.ResponseWriter, r *http.Request) {
+	setEventHiddenController(w, r, false)
+}
+
+func setEventHiddenController(w http.ResponseWriter, r *http.Request, hidden bool) {
+	request, moderatorID, ok := decodeModerationRequest(w, r)
+	if !ok {
+		return
+	}
+
+	vars := mux.Vars(r)
+	res, err := SetEventHidden(bson.ObjectIdHex(vars["id"]), hidden, moderatorID, request.Reason)
+	answerModeration(w, request, moderatorID, res, err)
+}
+
+// HidePostCommentController will answer a JSON of the post
+// with the given comment hidden
+func HidePostCommentController(w http.ResponseWriter, r *http.Request) {
+	setPostCommentHiddenController(w, r, true)
+}
+
+// UnhidePostCommentController will answer a JSON of the post
+// with the given comment visible again
+func UnhidePostCommentController(w http.ResponseWriter, r *http.Request) {
+	setPostCommentHiddenController(w, r, false)
+}
+
+func setPostCommentHiddenController(w http.ResponseWriter, r *http.Request, hidden bool) {
+	request, moderatorID, ok := decodeModerationRequest(w, r)
+	if !ok {
+		return
+	}
+
+	vars := mux.Vars(r)
+	res, err := SetPostCommentHidden(bson.ObjectIdHex(vars["id"]), bson.ObjectIdHex(vars["commentID"]), hidden, moderatorID, request.Reason)
+	answerModeration(w, request, moderatorID, res, err)
+}
+
+// HideEventCommentController will answer a JSON of the event
+// with the given comment hidden
+func HideEventCommentController(w http.ResponseWriter, r *http.Request) {
+	setEventCommentHiddenController(w, r, true)
+}
+
+// UnhideEventCommentController will answer a JSON of the event
+// with the given comment visible again
+func UnhideEventCommentController(w http.ResponseWriter, r *http.Request) {
+	setEventCommentHiddenController(w, r, false)
+}
+
+func setEventCommentHiddenController(w http.ResponseWriter, r *http.Request, hidden bool) {
+	request, moderatorID, ok := decodeModerationRequest(w, r)
+	if !ok {
+		return
+	}
+
+	vars := mux.Vars(r)
+	res, err := SetEventCommentHidden(bson.ObjectIdHex(vars["id"]), bson.ObjectIdHex(vars["commentID"]), hidden, moderatorID, request.Reason)
+	answerModeration(w, request, moderatorID, res, err)
+}
+
+// SuspendUserController will answer a JSON of the user
+// suspended for the given number of hours
+func SuspendUserController(w http.ResponseWriter, r *http.Request) {
+	request, moderatorID, ok := decodeModerationRequest(w, r)
+	if !ok {
+		return
+	}
+
+	if request.Hours <= 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(bson.M{"error": "the suspension duration must be positive"})
+		return
+	}
+
+	vars := mux.Vars(r)
+	duration := time.Duration(request.Hours) * time.Hour
+	res, err := SuspendUser(bson.ObjectIdHex(vars["id"]), duration, moderatorID, request.Reason)
+	answerModeration(w, request, moderatorID, res, err)
+}
+
+// UnsuspendUserController will answer a JSON of the user
+// whose suspension has been lifted
+func UnsuspendUserController(w http.ResponseWriter, r *http.Request) {
+	request, moderatorID, ok := decodeModerationRequest(w, r)
+	if !ok {
+		return
+	}
+
+	vars := mux.Vars(r)
+	res, err := UnsuspendUser(bson.ObjectIdHex(vars["id"]), moderatorID, request.Reason)
+	answerModeration(w, request, moderatorID, res, err)
+}
+
+// GetModerationActionsController will answer a JSON of the moderation log,
+// filtered by the optional ?target= parameter
+func GetModerationActionsController(w http.ResponseWriter, r *http.Request) {
+	target := r.URL.Query().Get("target")
+	if target != "" && !bson.IsObjectIdHex(target) {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(bson.M{"error": "wrong target ID"})
+		return
+	}
+
+	var targetID bson.ObjectId
+	if target != "" {
+		targetID = bson.ObjectIdHex(target)
+	}
+
+	res := GetModerationActions(targetID)
+	_ = json.NewEncoder(w).Encode(bson.M{"actions": res})
+}
@@ -1,17 +1,25 @@
 package insapp
 
 import (
+	"errors"
+	"log"
 	"time"
 
+	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 )
 
-// NotificationUser defines how to model a NotificationUser
+// NotificationUser defines how to model a device registered by a user
+// to receive push notifications. A user can register several devices.
 type NotificationUser struct {
-	ID     bson.ObjectId `bson:"_id,omitempty"`
-	UserId bson.ObjectId `json:"userid"`
-	Token  string        `json:"token" bson:",omitempty"`
-	Os     string        `json:"os"`
+	ID         bson.ObjectId `bson:"_id,omitempty"`
+	UserId     bson.ObjectId `json:"userid"`
+	Token      string        `json:"token" bson:",omitempty"`
+	Os         string        `json:"os"`
+	AppVersion string        `json:"appversion" bson:"appversion,omitempty"`
+	LastSeen   time.Time     `json:"lastseen" bson:"lastseen,omitempty"`
+	// WebPush holds the keys of a browser, whose endpoint is the token
+	WebPush *WebPushKeys `json:"-" bson:"webpush,omitempty"`
 }
 
 // Notification defines how to model a Notification
@@ -29,48 +37,212 @@ type Notification struct {
 
 type Notifications []Notification
 
+// GetNotificationUserForUser returns the mobile device the given user used last
 func GetNotificationUserForUser(userID bson.ObjectId) NotificationUser {
 	session := GetMongoSession()
 	defer session.Close()
 	db := session.DB("insapp").C("notification_user")
 
 	var result NotificationUser
-	db.Find(bson.M{"userid": userID}).One(&result)
+	db.Find(bson.M{"userid": userID, "os": bson.M{"$ne": webPushOs}}).Sort("-lastseen").One(&result)
 
 	return result
 }
 
-func CreateOrUpdateNotificationUser(user NotificationUser) {
+// GetNotificationUsersForUser returns every device of the given user,
+// the one used last first
+func GetNotificationUsersForUser(userID bson.ObjectId) []NotificationUser {
+	session := GetMongoSession()
+	defer session.Close()
+	db := session.DB("insapp").C("notification_user")
+
+	result := []NotificationUser{}
+	db.Find(bson.M{"userid": userID, "token": bson.M{"$ne": nil}}).Sort("-lastseen").All(&result)
+
+	return result
+}
+
+// ErrDeviceOwned is returned when registering a device whose token is
+// already registered by another user
+var ErrDeviceOwned = errors.New("the device is registered by another user")
+
+// CreateOrUpdateNotificationUser registers the device of the user, or
+// refreshes it if the token is already known. A token never moves to another
+// user: the device has to be removed by its owner first.
+func CreateOrUpdateNotificationUser(user NotificationUser) error {
 	if len(user.Token) == 0 {
-		return
+		return nil
 	}
 
 	session := GetMongoSession()
 	defer session.Close()
 	db := session.DB("insapp").C("notification_user")
 
-	res, _ := db.Find(bson.M{"token": user.Token}).Count()
-	if res > 0 {
-		db.Update(bson.M{"token": user.Token}, bson.M{"$set": bson.M{"token": nil}})
+	change := bson.M{
+		"userid":     user.UserId,
+		"os":         user.Os,
+		"appversion": user.AppVersion,
+		"lastseen":   time.Now(),
+	}
+	if user.WebPush != nil {
+		change["webpush"] = user.WebPush
+	}
+	// The unique index on the tokens refuses to insert the token again
+	// for another user
+	_, err := db.Upsert(bson.M{"token": user.Token, "userid": user.UserId}, bson.M{"$set": change})
+	if mgo.IsDup(err) {
+		return ErrDeviceOwned
 	}
-	res, _ = db.Find(bson.M{"userid": user.UserId}).Count()
-	if res > 0 {
-		db.Update(bson.M{"userid": user.UserId}, bson.M{"$set": bson.M{"token": user.Token, "os": user.Os}})
-	} else {
-		db.Insert(user)
+	if err != nil {
+		return err
 	}
+
+	// Devices registered before several devices were supported lost their
+	// token when the user logged in on another device
+	db.RemoveAll(bson.M{"userid": user.UserId, "token": nil})
+
+	return nil
+}
+
+// ensureNotificationUserIndexes makes every token belong to a single device.
+// Devices registered before several devices were supported may have no token.
+func ensureNotificationUserIndexes(session *mgo.Session) {
+	db := session.DB("insapp").C("notification_user")
+
+	index := mgo.Index{Key: []string{"token"}, Unique: true, Sparse: true}
+	err := db.EnsureIndex(index)
+	if err != nil {
+		// The index was created before the tokens were unique
+		err = removeDuplicateDevices(db)
+		if err != nil {
+			log.Printf("error removing the duplicate devices: %v\n", err)
+		}
+		err = db.DropIndex("token")
+		if err != nil {
+			log.Printf("error dropping the device token index: %v\n", err)
+		}
+		err = db.EnsureIndex(index)
+	}
+	if err != nil {
+		log.Printf("error creating the device token index: %v\n", err)
+	}
+	err = db.EnsureIndex(mgo.Index{Key: []string{"userid"}})
+	if err != nil {
+		log.Printf("error creating the device user index: %v\n", err)
+	}
+}
+
+// removeDuplicateDevices keeps only the most recently seen device of each
+// token
+func removeDuplicateDevices(db *mgo.Collection) error {
+	var duplicates []struct {
+		Devices []bson.ObjectId `bson:"devices"`
+	}
+	err := db.Pipe([]bson.M{
+		{"$match": bson.M{"token": bson.M{"$exists": true}}},
+		{"$sort": bson.D{{Name: "lastseen", Value: -1}, {Name: "_id", Value: -1}}},
+		{"$group": bson.M{
+			"_id":     "$token",
+			"devices": bson.M{"$push": "$_id"},
+			"count":   bson.M{"$sum": 1},
+		}},
+		{"$match": bson.M{"count": bson.M{"$gt": 1}}},
+	}).AllowDiskUse().All(&duplicates)
+	if err != nil {
+		return err
+	}
+
+	for _, duplicate := range duplicates {
+		_, err = db.RemoveAll(bson.M{"_id": bson.M{"$in": duplicate.Devices[1:]}})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// DeleteNotificationUser removes the device linked to the given id,
+// if it belongs to the given user
+func DeleteNotificationUser(userID bson.ObjectId, id bson.ObjectId) error {
+	session := GetMongoSession()
+	defer session.Close()
+	db := session.DB("insapp").C("notification_user")
+
+	err := db.Remove(bson.M{"_id": id, "userid": userID})
+	if err != nil {
+		return errors.New("no device found")
+	}
+
+	return nil
+}
+
+// DeleteNotificationUserWithToken removes the device of the given user
+// having the given token
+func DeleteNotificationUserWithToken(userID bson.ObjectId, token string) {
+	session := GetMongoSession()
+	defer session.Close()
+	db := session.DB("insapp").C("notification_user")
+
+	db.RemoveAll(bson.M{"userid": userID, "token": token})
 }
 
-func AddNotification(notification Notification) Notification {
+// InvalidateNotificationToken removes the device having the given token,
+// once the push provider reported it is not registered anymore
+func InvalidateNotificationToken(token string) {
+	session := GetMongoSession()
+	defer session.Close()
+	db := session.DB("insapp").C("notification_user")
+
+	db.RemoveAll(bson.M{"token": token})
+}
+
+// defaultNotificationTTL is how long notifications are kept,
+// unless notification_ttl_days is set in the configuration
+const defaultNotificationTTL = 90 * 24 * time.Hour
+
+// ensureNotificationIndexes makes MongoDB remove the old notifications
+func ensureNotificationIndexes(session *mgo.Session) {
+	db := session.DB("insapp").C("notification")
+
+	ttl := defaultNotificationTTL
+	if config.NotificationTTL > 0 {
+		ttl = time.Duration(config.NotificationTTL) * 24 * time.Hour
+	}
+
+	db.EnsureIndex(mgo.Index{Key: []string{"receiver", "seen"}})
+	err := db.EnsureIndex(mgo.Index{Key: []string{"date"}, ExpireAfter: ttl})
+	if err != nil {
+		// The TTL changed in the configuration: the index has to be rebuilt
+		db.DropIndex("date")
+		db.EnsureIndex(mgo.Index{Key: []string{"date"}, ExpireAfter: ttl})
+	}
+}
+
+// AddNotification adds the notification to the inbox of its receiver.
+// A notification already added is left as is, so that its delivery can be
+// retried.
+func AddNotification(notification Notification) error {
 	session := GetMongoSession()
 	defer session.Close()
 	db := session.DB("insapp").C("notification")
 
-	notification.ID = bson.NewObjectId()
+	if notification.ID == "" {
+		notification.ID = bson.NewObjectId()
+	}
 	notification.Date = time.Now()
 	notification.Seen = false
-	db.Insert(notification)
-	return notification
+	err := db.Insert(notification)
+	if mgo.IsDup(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	publishNotification(notification)
+
+	return nil
 }
 
 func GetNotificationsForUser(userID bson.ObjectId) Notifications {
@@ -94,16 +266,55 @@ func GetUnreadNotificationsForUser(userID bson.ObjectId) Notifications {
 	return result
 }
 
+// CountUnreadNotificationsForUser returns the number of notifications
+// the given user has not read yet
+func CountUnreadNotificationsForUser(userID bson.ObjectId) int {
+	session := GetMongoSession()
+	defer session.Close()
+	db := session.DB("insapp").C("notification")
+
+	count, _ := db.Find(bson.M{"receiver": userID, "seen": false}).Count()
+	return count
+}
+
 func ReadNotificationForUser(userID bson.ObjectId, notifID bson.ObjectId) Notifications {
 	session := GetMongoSession()
 	defer session.Close()
 	db := session.DB("insapp").C("notification")
 
-	db.Update(bson.M{"_id": notifID}, bson.M{"$set": bson.M{"seen": true}})
+	db.Update(bson.M{"_id": notifID, "receiver": userID}, bson.M{"$set": bson.M{"seen": true}})
+	publishUnreadCount(userID)
 
 	return GetNotificationsForUser(userID)
 }
 
+// ReadAllNotificationsForUser marks every notification of the given user as read
+func ReadAllNotificationsForUser(userID bson.ObjectId) {
+	session := GetMongoSession()
+	defer session.Close()
+	db := session.DB("insapp").C("notification")
+
+	db.UpdateAll(bson.M{"receiver": userID, "seen": false}, bson.M{"$set": bson.M{"seen": true}})
+	publishUnreadCount(userID)
+}
+
+// DeleteNotificationForUser removes the notification linked to the given id,
+// if it was sent to the given user
+func DeleteNotificationForUser(userID bson.ObjectId, notifID bson.ObjectId) error {
+	session := GetMongoSession()
+	defer session.Close()
+	db := session.DB("insapp").C("notification")
+
+	err := db.Remove(bson.M{"_id": notifID, "receiver": userID})
+	if err != nil {
+		return errors.New("no notification found")
+	}
+
+	publishUnreadCount(userID)
+
+	return nil
+}
+
 func DeleteNotificationsForUser(id bson.ObjectId) {
 	session := GetMongoSession()
 	defer session.Close()
@@ -13,26 +13,170 @@ func UpdateNotificationUserController(w http.ResponseWriter, r *http.Request) {
 	var user NotificationUser
 	decoder.Decode(&user)
 
-	CreateOrUpdateNotificationUser(user)
+	// The device always belongs to the authenticated user
+	userID, err := GetUserFromRequest(r)
+	if err != nil {
+		w.WriteHeader(http.StatusNotAcceptable)
+		json.NewEncoder(w).Encode(bson.M{"error": "could not get user ID"})
+		return
+	}
+	user.UserId = userID
+
+	err = CreateOrUpdateNotificationUser(user)
+	if err == ErrDeviceOwned {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(bson.M{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(bson.M{"error": "unable to register the device"})
+		return
+	}
 
 	json.NewEncoder(w).Encode(bson.M{"status": "ok"})
 }
 
+// GetNotificationController will answer a JSON of the latest notifications
+// of the current user. The user ID in the URL is ignored, as only the
+// authenticated user can read their notifications.
+// Only the unread ones are returned with ?unread=true.
 func GetNotificationController(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	userID := vars["userID"]
+	userID, err := GetUserFromRequest(r)
+	if err != nil {
+		w.WriteHeader(http.StatusNotAcceptable)
+		json.NewEncoder(w).Encode(bson.M{"error": "could not get user ID"})
+		return
+	}
 
-	res := GetNotificationsForUser(bson.ObjectIdHex(userID))
+	var res Notifications
+	if r.URL.Query().Get("unread") == "true" {
+		res = GetUnreadNotificationsForUser(userID)
+	} else {
+		res = GetNotificationsForUser(userID)
+	}
 
 	json.NewEncoder(w).Encode(bson.M{"notifications": res})
 }
 
-func DeleteNotificationController(w http.ResponseWriter, r *http.Request) {
+// GetUnreadNotificationsCountController will answer the number
+// of unread notifications of the current user
+func GetUnreadNotificationsCountController(w http.ResponseWriter, r *http.Request) {
+	userID, err := GetUserFromRequest(r)
+	if err != nil {
+		w.WriteHeader(http.StatusNotAcceptable)
+		json.NewEncoder(w).Encode(bson.M{"error": "could not get user ID"})
+		return
+	}
+
+	json.NewEncoder(w).Encode(bson.M{"count": CountUnreadNotificationsForUser(userID)})
+}
+
+// ReadNotificationController will answer a JSON of the notifications of the
+// current user, once the notification linked to the given id is marked as read
+func ReadNotificationController(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
-	userID := vars["userID"]
 	notificationID := vars["id"]
 
-	res := ReadNotificationForUser(bson.ObjectIdHex(userID), bson.ObjectIdHex(notificationID))
+	userID, err := GetUserFromRequest(r)
+	if err != nil {
+		w.WriteHeader(http.StatusNotAcceptable)
+		json.NewEncoder(w).Encode(bson.M{"error": "could not get user ID"})
+		return
+	}
+
+	if !bson.IsObjectIdHex(notificationID) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(bson.M{"error": "wrong notification ID"})
+		return
+	}
 
+	res := ReadNotificationForUser(userID, bson.ObjectIdHex(notificationID))
 	json.NewEncoder(w).Encode(bson.M{"notifications": res})
 }
+
+// ReadAllNotificationsController will answer a JSON of the notifications
+// of the current user, once they are all marked as read
+func ReadAllNotificationsController(w http.ResponseWriter, r *http.Request) {
+	userID, err := GetUserFromRequest(r)
+	if err != nil {
+		w.WriteHeader(http.StatusNotAcceptable)
+		json.NewEncoder(w).Encode(bson.M{"error": "could not get user ID"})
+		return
+	}
+
+	ReadAllNotificationsForUser(userID)
+	json.NewEncoder(w).Encode(bson.M{"notifications": GetNotificationsForUser(userID)})
+}
+
+// DeleteInboxNotificationController will answer a JSON of the notifications of
+// the current user, once the notification linked to the given id is deleted
+func DeleteInboxNotificationController(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	notificationID := vars["id"]
+
+	userID, err := GetUserFromRequest(r)
+	if err != nil {
+		w.WriteHeader(http.StatusNotAcceptable)
+		json.NewEncoder(w).Encode(bson.M{"error": "could not get user ID"})
+		return
+	}
+
+	if !bson.IsObjectIdHex(notificationID) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(bson.M{"error": "wrong notification ID"})
+		return
+	}
+
+	err = DeleteNotificationForUser(userID, bson.ObjectIdHex(notificationID))
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(bson.M{"error": err.Error()})
+		return
+	}
+
+	json.NewEncoder(w).Encode(bson.M{"notifications": GetNotificationsForUser(userID)})
+}
+
+// GetDevicesController will answer a JSON of the devices
+// registered by the current user
+func GetDevicesController(w http.ResponseWriter, r *http.Request) {
+	userID, err := GetUserFromRequest(r)
+	if err != nil {
+		w.WriteHeader(http.StatusNotAcceptable)
+		json.NewEncoder(w).Encode(bson.M{"error": "could not get user ID"})
+		return
+	}
+
+	res := GetNotificationUsersForUser(userID)
+	json.NewEncoder(w).Encode(bson.M{"devices": res})
+}
+
+// DeleteDeviceController will answer a JSON of the devices registered by
+// the current user, once the device linked to the given id in the URL is removed
+func DeleteDeviceController(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	userID, err := GetUserFromRequest(r)
+	if err != nil {
+		w.WriteHeader(http.StatusNotAcceptable)
+		json.NewEncoder(w).Encode(bson.M{"error": "could not get user ID"})
+		return
+	}
+
+	if !bson.IsObjectIdHex(id) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(bson.M{"error": "wrong device ID"})
+		return
+	}
+
+	err = DeleteNotificationUser(userID, bson.ObjectIdHex(id))
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(bson.M{"error": err.Error()})
+		return
+	}
+
+	json.NewEncoder(w).Encode(bson.M{"devices": GetNotificationUsersForUser(userID)})
+}
@@ -1,30 +1,12 @@
 package insapp
 
 import (
-	"fmt"
 	"log"
 	"strings"
 
-	"golang.org/x/net/context"
 	"gopkg.in/mgo.v2/bson"
-
-	firebase "firebase.google.com/go"
-	"firebase.google.com/go/messaging"
 )
 
-var firebaseApp = initializeFirebaseApp()
-
-// Please refer to https://firebase.google.com/docs/reference/fcm/rest/v1/projects.messages
-
-func initializeFirebaseApp() *firebase.App {
-	firebaseApp, err := firebase.NewApp(context.Background(), nil)
-	if err != nil {
-		log.Fatalf("error initializing Firebase app: %v\n", err)
-	}
-
-	return firebaseApp
-}
-
 func getAllUsers() []NotificationUser {
 	session := GetMongoSession()
 	defer session.Close()
@@ -66,212 +48,266 @@ func getAndroidUsers(user string) []NotificationUser {
 	return result
 }
 
-func getNotificationUserForUser(user bson.ObjectId) NotificationUser {
+func getWebUsers() []NotificationUser {
 	session := GetMongoSession()
 	defer session.Close()
 	db := session.DB("insapp").C("notification_user")
 
-	var result NotificationUser
-	db.Find(bson.M{"userid": user}).One(&result)
+	var result []NotificationUser
+	db.Find(bson.M{"os": webPushOs}).All(&result)
 
 	return result
 }
 
-func buildTopicsStringForPromotions(prefix string, promotions []string) string {
-	topics := ""
-
-	for _, promotion := range promotions {
-		topics += fmt.Sprintf(` || '%s-%s' in topics`, prefix, promotion)
+// getNotificationUsersForPlatforms returns the devices running on one of the
+// given platforms. Browsers get the content of every platform.
+func getNotificationUsersForPlatforms(platforms []string) []NotificationUser {
+	if contains("iOS", platforms) && contains("android", platforms) {
+		return getAllUsers()
+	} else if contains("iOS", platforms) {
+		return append(getiOSUsers(""), getWebUsers()...)
+	} else if contains("android", platforms) {
+		return append(getAndroidUsers(""), getWebUsers()...)
 	}
 
-	return topics
+	return nil
 }
 
-// TriggerNotificationForUserFromPost sends a notification and a push
-// notification to the given user.
-// Push notifications are not sent in a local environment.
-func TriggerNotificationForUserFromPost(sender bson.ObjectId, receiver bson.ObjectId, content bson.ObjectId, message string, comment Comment, tagType string) {
-	notification := Notification{Sender: sender, Content: content, Message: message, Comment: comment, Type: tagType}
-	user := getNotificationUserForUser(receiver)
+// recipient is a device along with the notification preferences and the
+// language of its owner. A user owning several devices appears once per device.
+type recipient struct {
+	device      NotificationUser
+	preferences NotificationPreferences
+	language    string
+}
 
-	sendNotificationToUsers(notification, []NotificationUser{user})
+// localizedMessage is a message of the catalog, rendered in the language
+// of each recipient
+type localizedMessage struct {
+	key    string
+	params []string
+}
 
-	if config.Environment != "local" {
-		sendPushNotificationToDevice(GetUser(sender).Username, message, content.Hex(), ".activities.PostActivity", user.Token)
-	}
+func (message localizedMessage) in(language string) string {
+	return localize(language, message.key, message.params...)
 }
 
-// TriggerNotificationForUserFromEvent sends a notification and a push
-// notification to the given user.
-// Push notifications are not sent in a local environment.
-func TriggerNotificationForUserFromEvent(sender bson.ObjectId, receiver bson.ObjectId, content bson.ObjectId, message string, comment Comment, tagType string) {
-	notification := Notification{Sender: sender, Content: content, Message: message, Comment: comment, Type: tagType}
-	user := getNotificationUserForUser(receiver)
+// TriggerNotificationForUserFromPost sends a notification and a push
+// notification to the user tagged on the post with the given title.
+func TriggerNotificationForUserFromPost(sender bson.ObjectId, receiver bson.ObjectId, content bson.ObjectId, title string, comment Comment, tagType string) {
+	triggerNotificationForUser(sender, receiver, content, title, comment, tagType, "notification.tag", ".activities.PostActivity")
+}
 
-	sendNotificationToUsers(notification, []NotificationUser{user})
+// TriggerNotificationForUserFromEvent sends a notification and a push
+// notification to the user tagged on the event with the given name.
+func TriggerNotificationForUserFromEvent(sender bson.ObjectId, receiver bson.ObjectId, content bson.ObjectId, name string, comment Comment, tagType string) {
+	triggerNotificationForUser(sender, receiver, content, name, comment, tagType, "notification.tag", ".activities.EventActivity")
+}
 
-	if config.Environment != "local" {
-		sendPushNotificationToDevice(GetUser(sender).Username, message, content.Hex(), ".activities.EventActivity", user.Token)
+// TriggerReplyNotificationsForPost sends a notification and a push
+// notification to the users who commented on the post before the comment.
+func TriggerReplyNotificationsForPost(post Post, comment Comment) {
+	for _, receiver := range replyReceivers(post.Comments, comment) {
+		triggerNotificationForUser(comment.User, receiver, post.ID, post.Title, comment, "reply", "notification.reply", ".activities.PostActivity")
 	}
 }
 
-// TriggerNotificationForEvent sends a notification and a push
-// notification to users targeted by the promotion.
-// Push notifications are not sent in a local environment.
-func TriggerNotificationForEvent(event Event, sender bson.ObjectId, content bson.ObjectId, message string) {
-	notification := Notification{Sender: sender, Content: content, Message: message, Type: "event"}
-
-	var users []NotificationUser
-	var filteredUsers []NotificationUser
-
-	var platforms string
-
-	if contains("iOS", event.Plateforms) && contains("android", event.Plateforms) {
-		filteredUsers = getAllUsers()
-		platforms = "('events-android' in topics || 'events-ios' in topics)"
-	} else if contains("iOS", event.Plateforms) {
-		filteredUsers = getiOSUsers("")
-		platforms = "'events-ios' in topics"
-	} else if contains("android", event.Plateforms) {
-		filteredUsers = getAndroidUsers("")
-		platforms = "'events-android' in topics"
+// TriggerReplyNotificationsForEvent sends a notification and a push
+// notification to the users who commented on the event before the comment.
+func TriggerReplyNotificationsForEvent(event Event, comment Comment) {
+	for _, receiver := range replyReceivers(event.Comments, comment) {
+		triggerNotificationForUser(comment.User, receiver, event.ID, event.Name, comment, "eventReply", "notification.reply", ".activities.EventActivity")
 	}
+}
 
-	for _, notificationUser := range filteredUsers {
-		var user = GetUser(notificationUser.UserId)
-		if contains(strings.ToUpper(user.Promotion), event.Promotions) {
-			users = append(users, notificationUser)
+// replyReceivers returns the authors of the visible comments, except the
+// author of the new comment and the users it tags, who get a tag instead
+func replyReceivers(comments Comments, comment Comment) []bson.ObjectId {
+	excluded := map[bson.ObjectId]bool{comment.User: true}
+	for _, tag := range comment.Tags {
+		if bson.IsObjectIdHex(tag.User) {
+			excluded[bson.ObjectIdHex(tag.User)] = true
 		}
 	}
 
-	sendNotificationToUsers(notification, users)
-
-	if config.Environment != "local" {
-		for _, promotion := range event.Promotions {
-			var topics = fmt.Sprintf(`%s && 'events-%s' in topics`, platforms, promotion)
-			sendPushNotificationToTopics(event.Name, message, content.Hex(), ".activities.EventActivity", topics)
+	var result []bson.ObjectId
+	for _, previous := range comments {
+		if previous.ID == comment.ID || previous.Hidden || excluded[previous.User] {
+			continue
 		}
-		sendPushNotificationToTopics(event.Name, message, content.Hex(), ".activities.EventActivity", fmt.Sprintf(`%s && 'events-unknown-class' in topics`, platforms))
+		excluded[previous.User] = true
+		result = append(result, previous.User)
 	}
+
+	return result
 }
 
-// TriggerNotificationForPost sends a notification and a push
-// notification to users targeted by the promotion.
-// Push notifications are not sent in a local environment.
-func TriggerNotificationForPost(post Post, sender bson.ObjectId, content bson.ObjectId, message string) {
-	notification := Notification{Sender: sender, Content: content, Message: message, Type: "post"}
-
-	var users []NotificationUser
-	var filteredUsers []NotificationUser
-
-	var platforms string
-
-	if contains("iOS", post.Plateforms) && contains("android", post.Plateforms) {
-		filteredUsers = getAllUsers()
-		platforms = "('posts-android' in topics || 'posts-ios' in topics)"
-	} else if contains("iOS", post.Plateforms) {
-		filteredUsers = getiOSUsers("")
-		platforms = "'posts-ios' in topics"
-	} else if contains("android", post.Plateforms) {
-		filteredUsers = getAndroidUsers("")
-		platforms = "'posts-android' in topics"
-	}
+func triggerNotificationForUser(sender bson.ObjectId, receiver bson.ObjectId, content bson.ObjectId, title string, comment Comment, notificationType string, messageKey string, clickAction string) {
+	user := GetUser(receiver)
 
-	for _, notificationUser := range filteredUsers {
-		var user = GetUser(notificationUser.UserId)
-		if contains(strings.ToUpper(user.Promotion), post.Promotions) {
-			users = append(users, notificationUser)
-		}
+	// Users are never notified by someone they blocked
+	if user.HasBlocked(sender) {
+		return
 	}
 
-	sendNotificationToUsers(notification, users)
+	username := GetUser(sender).Username
+	notification := Notification{Sender: sender, Content: content, Comment: comment, Type: notificationType}
+	message := localizedMessage{key: messageKey, params: []string{"user", username, "content", title}}
+	recipients := getRecipientsForUser(user)
 
-	if config.Environment != "local" {
-		for _, promotion := range post.Promotions {
-			var topics = fmt.Sprintf(`%s && 'posts-%s' in topics`, platforms, promotion)
-			sendPushNotificationToTopics(post.Title, message, content.Hex(), ".activities.PostActivity", topics)
-		}
-		sendPushNotificationToTopics(post.Title, message, content.Hex(), ".activities.PostActivity", fmt.Sprintf(`%s && 'posts-unknown-class' in topics`, platforms))
+	err := sendNotificationToUsers(notification, message, recipients)
+	if err == nil {
+		err = sendPushNotificationToUsers(notification, message, recipients, username, clickAction)
+	}
+	if err != nil {
+		log.Printf("error notifying the %s to %s: %v\n", notificationType, receiver.Hex(), err)
 	}
 }
 
-func sendNotificationToUsers(notification Notification, users []NotificationUser) {
-	for _, user := range users {
-		notification.Receiver = user.UserId
-		notification = AddNotification(notification)
+// getRecipientsForUser returns the devices of the user. A user without
+// device is returned alone, so that notifications still land in the inbox.
+func getRecipientsForUser(user User) []recipient {
+	var recipients []recipient
+	for _, device := range GetNotificationUsersForUser(user.ID) {
+		recipients = append(recipients, recipient{device: device, preferences: user.NotificationPreferences, language: user.Language})
 	}
+	if len(recipients) == 0 {
+		recipients = append(recipients, recipient{device: NotificationUser{UserId: user.ID}, preferences: user.NotificationPreferences, language: user.Language})
+	}
+
+	return recipients
 }
 
-func sendPushNotificationToDevice(title string, message string, objectID string, clickAction string, token string) {
-	ctx := context.Background()
-	client, err := firebaseApp.Messaging(ctx)
-	if err != nil {
-		log.Fatalf("error getting Messaging client: %v\n", err)
+// TriggerReminderForEvent sends a notification and a push notification to
+// the participants of the event, reminding them that it starts soon.
+// It can be called again without reminding anyone twice.
+func TriggerReminderForEvent(event Event) error {
+	notification := Notification{Sender: event.Association, Content: event.ID, Type: NotificationTypeReminder}
+	message := localizedMessage{key: "notification.reminder", params: []string{"event", event.Name, "time", event.DateStart.Local().Format(reminderTimeLayout)}}
+
+	var recipients []recipient
+	for _, participant := range event.Participants {
+		user := GetUser(participant)
+		if user.ID == "" {
+			continue
+		}
+		recipients = append(recipients, getRecipientsForUser(user)...)
 	}
 
-	pushNotification := &messaging.Message{
-		Token: token,
-		Notification: &messaging.Notification{
-			Title: title,
-			Body:  message,
-		},
-		Data: map[string]string{
-			"ID": objectID,
-		},
-		Android: &messaging.AndroidConfig{
-			Notification: &messaging.AndroidNotification{
-				Sound:       "default",
-				Color:       "#ec5d57",
-				ClickAction: clickAction,
-			},
-		},
+	err := sendNotificationToUsers(notification, message, recipients)
+	if err != nil {
+		return err
 	}
 
-	// Send a message to the device corresponding to the provided
-	// registration token
-	response, err := client.Send(ctx, pushNotification)
+	return sendPushNotificationToUsers(notification, message, recipients, event.Name, ".activities.EventActivity")
+}
+
+// TriggerNotificationForEvent sends a notification and a push notification
+// to users targeted by the promotion or following the association.
+// It can be called again after an error, without notifying anyone twice.
+func TriggerNotificationForEvent(event Event, sender bson.ObjectId, content bson.ObjectId) error {
+	notification := Notification{Sender: sender, Content: content, Type: "event"}
+	message := localizedMessage{key: "notification.event", params: []string{"association", strings.ToLower(GetAssociation(sender).Name), "event", event.Name}}
+	recipients := getRecipientsFromAssociation(sender, event.Plateforms, event.Promotions)
+
+	err := sendNotificationToUsers(notification, message, recipients)
 	if err != nil {
-		log.Fatalln(err)
+		return err
 	}
 
-	// Response is a message ID string
-	fmt.Println("Successfully sent message:", response)
-	fmt.Println("Token:", token)
+	return sendPushNotificationToUsers(notification, message, recipients, event.Name, ".activities.EventActivity")
 }
 
-func sendPushNotificationToTopics(title string, message string, objectID string, clickAction string, topics string) {
-	ctx := context.Background()
-	client, err := firebaseApp.Messaging(ctx)
+// TriggerNotificationForPost sends a notification and a push notification
+// to users targeted by the promotion or following the association.
+// It can be called again after an error, without notifying anyone twice.
+func TriggerNotificationForPost(post Post, sender bson.ObjectId, content bson.ObjectId) error {
+	notification := Notification{Sender: sender, Content: content, Type: "post"}
+	message := localizedMessage{key: "notification.post", params: []string{"association", strings.ToLower(GetAssociation(sender).Name)}}
+	recipients := getRecipientsFromAssociation(sender, post.Plateforms, post.Promotions)
+
+	err := sendNotificationToUsers(notification, message, recipients)
 	if err != nil {
-		log.Fatalf("error getting Messaging client: %v\n", err)
+		return err
 	}
 
-	pushNotification := &messaging.Message{
-		Condition: topics,
-		Notification: &messaging.Notification{
-			Title: title,
-			Body:  message,
-		},
-		Data: map[string]string{
-			"ID": objectID,
-		},
-		Android: &messaging.AndroidConfig{
-			Notification: &messaging.AndroidNotification{
-				Sound:       "default",
-				Color:       "#ec5d57",
-				ClickAction: clickAction,
-			},
-		},
+	return sendPushNotificationToUsers(notification, message, recipients, post.Title, ".activities.PostActivity")
+}
+
+// getRecipientsFromAssociation returns the devices running on the given
+// platforms whose owner wants to hear from the association. Users without
+// promotion are notified about everything, as they used to be with topics.
+func getRecipientsFromAssociation(association bson.ObjectId, platforms []string, promotions []string) []recipient {
+	var recipients []recipient
+	users := map[bson.ObjectId]User{}
+	for _, notificationUser := range getNotificationUsersForPlatforms(platforms) {
+		user, ok := users[notificationUser.UserId]
+		if !ok {
+			user = GetUser(notificationUser.UserId)
+			users[notificationUser.UserId] = user
+		}
+		if user.ID == "" {
+			continue
+		}
+		if user.NotificationPreferences.AllowsFrom(association, strings.ToUpper(user.Promotion), promotions) {
+			recipients = append(recipients, recipient{device: notificationUser, preferences: user.NotificationPreferences, language: user.Language})
+		}
 	}
 
-	// Send a message to devices subscribed to the combination of topics
-	// specified by the provided condition.
-	response, err := client.Send(ctx, pushNotification)
-	if err != nil {
-		log.Fatalln(err)
+	return recipients
+}
+
+// sendNotificationToUsers stores in the outbox the notification of the
+// recipients who did not disable in-app notifications of this type.
+// Users owning several devices get a single notification.
+func sendNotificationToUsers(notification Notification, message localizedMessage, recipients []recipient) error {
+	notified := map[bson.ObjectId]bool{}
+	for _, recipient := range recipients {
+		if recipient.device.UserId == "" || notified[recipient.device.UserId] || !recipient.preferences.Allows(notification.Type, NotificationChannelInApp) {
+			continue
+		}
+		notified[recipient.device.UserId] = true
+		notification.ID = bson.NewObjectId()
+		notification.Receiver = recipient.device.UserId
+		notification.Message = message.in(recipient.language)
+		inbox := notification
+		_, err := enqueueDelivery(Delivery{
+			Channel:      DeliveryChannelNotification,
+			Notification: &inbox,
+			Key:          notificationKey(notification, recipient.device.UserId, NotificationChannelInApp),
+		})
+		if err != nil {
+			return err
+		}
 	}
 
-	// Response is a message ID string.
-	fmt.Println("Successfully sent message:", response)
-	fmt.Println("Condition:", topics)
+	return nil
+}
+
+// sendPushNotificationToUsers stores in the outbox a push notification for
+// the devices of the recipients who did not disable push notifications of
+// this type
+func sendPushNotificationToUsers(notification Notification, message localizedMessage, recipients []recipient, title string, clickAction string) error {
+	for _, recipient := range recipients {
+		if recipient.device.Token == "" || !recipient.preferences.Allows(notification.Type, NotificationChannelPush) {
+			continue
+		}
+		pushMessage := PushMessage{Title: title, Body: message.in(recipient.language), ObjectID: notification.Content.Hex(), ClickAction: clickAction}
+		_, err := enqueueDelivery(Delivery{
+			Channel: DeliveryChannelPush,
+			Push:    &PushDelivery{Message: pushMessage, Token: recipient.device.Token, WebPush: recipient.device.WebPush},
+			Key:     notificationKey(notification, recipient.device.UserId, NotificationChannelPush) + "/" + recipient.device.Token,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// notificationKey identifies the notification of the given content sent to
+// the given user on the given channel
+func notificationKey(notification Notification, receiver bson.ObjectId, channel string) string {
+	return strings.Join([]string{notification.Type, notification.Content.Hex(), notification.Comment.ID.Hex(), receiver.Hex(), channel}, "/")
 }
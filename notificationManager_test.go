@@ -0,0 +1,41 @@
+package insapp
+
+import (
+	"reflect"
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestReplyReceivers(t *testing.T) {
+	author, first, second, tagged, hidden := bson.NewObjectId(), bson.NewObjectId(), bson.NewObjectId(), bson.NewObjectId(), bson.NewObjectId()
+	comment := Comment{ID: bson.NewObjectId(), User: author, Tags: Tags{{User: tagged.Hex()}}}
+	comments := Comments{
+		{ID: bson.NewObjectId(), User: first},
+		{ID: bson.NewObjectId(), User: author},
+		{ID: bson.NewObjectId(), User: second},
+		{ID: bson.NewObjectId(), User: first},
+		{ID: bson.NewObjectId(), User: tagged},
+		{ID: bson.NewObjectId(), User: hidden, Hidden: true},
+		comment,
+	}
+
+	receivers := replyReceivers(comments, comment)
+	if expected := []bson.ObjectId{first, second}; !reflect.DeepEqual(receivers, expected) {
+		t.Errorf("got %v, expected %v", receivers, expected)
+	}
+}
+
+func TestReplyAndReminderPreferences(t *testing.T) {
+	preferences := NotificationPreferences{Disabled: map[string][]string{
+		NotificationTypeReply:    {NotificationChannelPush},
+		NotificationTypeReminder: {NotificationChannelInApp},
+	}}
+
+	if preferences.Allows("eventReply", NotificationChannelPush) || !preferences.Allows("eventReply", NotificationChannelInApp) {
+		t.Error("the replies on events do not follow the reply preference")
+	}
+	if preferences.Allows("reminder", NotificationChannelInApp) || !preferences.Allows("reminder", NotificationChannelPush) {
+		t.Error("the reminders do not follow the reminder preference")
+	}
+}
@@ -0,0 +1,148 @@
+package insapp
+
+import (
+	"errors"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// NotificationPreferences defines which notifications a user receives.
+// Every notification is enabled unless the user disabled it.
+type NotificationPreferences struct {
+	// Muted associations never notify the user about their events and posts
+	Muted []bson.ObjectId `json:"muted" bson:"muted,omitempty"`
+	// Followed associations notify the user about their events and posts,
+	// even when they target other promotions
+	Followed []bson.ObjectId `json:"followed" bson:"followed,omitempty"`
+	// Disabled lists, for each type of notification, the channels
+	// the user does not want to be notified on
+	Disabled map[string][]string `json:"disabled" bson:"disabled,omitempty"`
+	// Digest is how often the user receives an email digest, if ever
+	Digest string `json:"digest" bson:"digest,omitempty"`
+}
+
+// The types of notification a user can choose to receive
+const (
+	NotificationTypeEvent    = "event"
+	NotificationTypePost     = "post"
+	NotificationTypeTag      = "tag"
+	NotificationTypeReply    = "reply"
+	NotificationTypeReminder = "reminder"
+)
+
+// The channels a notification can be delivered on
+const (
+	NotificationChannelPush  = "push"
+	NotificationChannelInApp = "inapp"
+	NotificationChannelEmail = "email"
+)
+
+// notificationChannels lists the channels each type of notification is
+// delivered on. Events and posts are sent by email in the digest.
+var notificationChannels = map[string][]string{
+	NotificationTypeEvent:    {NotificationChannelPush, NotificationChannelInApp, NotificationChannelEmail},
+	NotificationTypePost:     {NotificationChannelPush, NotificationChannelInApp, NotificationChannelEmail},
+	NotificationTypeTag:      {NotificationChannelPush, NotificationChannelInApp},
+	NotificationTypeReply:    {NotificationChannelPush, NotificationChannelInApp},
+	NotificationTypeReminder: {NotificationChannelPush, NotificationChannelInApp},
+}
+
+// notificationTypeOf returns the preference type matching the type of
+// a Notification. Tags and replies on posts and events share the same
+// preference.
+func notificationTypeOf(notificationType string) string {
+	switch notificationType {
+	case "eventTag":
+		return NotificationTypeTag
+	case "eventReply":
+		return NotificationTypeReply
+	}
+
+	return notificationType
+}
+
+// Allows returns true if the user wants to receive the given type
+// of notification on the given channel
+func (preferences NotificationPreferences) Allows(notificationType string, channel string) bool {
+	return !ContainsString(preferences.Disabled[notificationTypeOf(notificationType)], channel)
+}
+
+// AllowsFrom returns true if the user wants to be notified about the events
+// and posts of the given association, which target the given promotions
+func (preferences NotificationPreferences) AllowsFrom(association bson.ObjectId, promotion string, promotions []string) bool {
+	if containsObjectID(preferences.Muted, association) {
+		return false
+	}
+
+	if containsObjectID(preferences.Followed, association) {
+		return true
+	}
+
+	return promotion == "" || contains(promotion, promotions)
+}
+
+// GetNotificationPreferences returns the notification preferences
+// of the user linked to the given id
+func GetNotificationPreferences(id bson.ObjectId) NotificationPreferences {
+	return normalizePreferences(GetUser(id).NotificationPreferences)
+}
+
+// UpdateNotificationPreferences replaces the notification preferences
+// of the user linked to the given id
+func UpdateNotificationPreferences(id bson.ObjectId, preferences NotificationPreferences) (NotificationPreferences, error) {
+	session := GetMongoSession()
+	defer session.Close()
+	db := session.DB("insapp").C("user")
+
+	for notificationType, channels := range preferences.Disabled {
+		supported, ok := notificationChannels[notificationType]
+		if !ok {
+			return NotificationPreferences{}, errors.New("unknown notification type " + notificationType)
+		}
+		for _, channel := range channels {
+			if !ContainsString(supported, channel) {
+				return NotificationPreferences{}, errors.New("notifications of type " + notificationType + " are not sent on channel " + channel)
+			}
+		}
+	}
+
+	for _, association := range preferences.Followed {
+		if containsObjectID(preferences.Muted, association) {
+			return NotificationPreferences{}, errors.New("an association can't be both muted and followed")
+		}
+	}
+
+	if !ContainsString(digestFrequencies, preferences.Digest) {
+		return NotificationPreferences{}, errors.New("unknown digest frequency " + preferences.Digest)
+	}
+
+	err := db.UpdateId(id, bson.M{"$set": bson.M{"notificationpreferences": preferences}})
+	if err != nil {
+		return NotificationPreferences{}, errors.New("no user found")
+	}
+
+	if preferences.Digest != DigestNever {
+		err = ensureDigestToken(id)
+		if err != nil {
+			return NotificationPreferences{}, err
+		}
+	}
+
+	return GetNotificationPreferences(id), nil
+}
+
+// normalizePreferences replaces the missing fields with empty values,
+// so that clients always get the same JSON structure
+func normalizePreferences(preferences NotificationPreferences) NotificationPreferences {
+	if preferences.Muted == nil {
+		preferences.Muted = []bson.ObjectId{}
+	}
+	if preferences.Followed == nil {
+		preferences.Followed = []bson.ObjectId{}
+	}
+	if preferences.Disabled == nil {
+		preferences.Disabled = map[string][]string{}
+	}
+
+	return preferences
+}
@@ -0,0 +1,99 @@
+package insapp
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// GetNotificationPreferencesController will answer a JSON of the
+// notification preferences of the current user
+func GetNotificationPreferencesController(w http.ResponseWriter, r *http.Request) {
+	userID, err := GetUserFromRequest(r)
+	if err != nil {
+		w.WriteHeader(http.StatusNotAcceptable)
+		_ = json.NewEncoder(w).Encode(bson.M{"error": "could not get user ID"})
+		return
+	}
+
+	res := GetNotificationPreferences(userID)
+	_ = json.NewEncoder(w).Encode(res)
+}
+
+// UpdateNotificationPreferencesController will answer a JSON of the
+// notification preferences of the current user, replaced by the JSON body
+func UpdateNotificationPreferencesController(w http.ResponseWriter, r *http.Request) {
+	userID, err := GetUserFromRequest(r)
+	if err != nil {
+		w.WriteHeader(http.StatusNotAcceptable)
+		_ = json.NewEncoder(w).Encode(bson.M{"error": "could not get user ID"})
+		return
+	}
+
+	var preferences NotificationPreferences
+	err = json.NewDecoder(r.Body).Decode(&preferences)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(bson.M{"error": "wrong preferences"})
+		return
+	}
+
+	res, err := UpdateNotificationPreferences(userID, preferences)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(bson.M{"error": err.Error()})
+		return
+	}
+
+	_ = json.NewEncoder(w).Encode(res)
+}
+
+// UnsubscribeDigestController shows the user owning the ?token= a page to
+// confirm they want to stop receiving the email digest. Nothing changes until
+// the page is submitted, as links are sometimes opened by mail scanners.
+func UnsubscribeDigestController(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	user, err := GetUserWithDigestToken(token)
+	if err != nil {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = fmt.Fprintln(w, localize(defaultLanguage(), "digest.unsubscribe.error"))
+		return
+	}
+
+	data := struct {
+		Email  string
+		Token  string
+		Action string
+	}{
+		Email:  user.Email,
+		Token:  token,
+		Action: config.GetAPI() + "digest/unsubscribe",
+	}
+	page, err := parseTemplate(localizedTemplate(user.Language, "templates/digest_unsubscribe_page.html"), data)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, _ = fmt.Fprint(w, page)
+}
+
+// ConfirmUnsubscribeDigestController stops sending the email digest to the user
+// owning the ?token= given in the link of the digest. No login is needed.
+// The token is sent by the confirmation page, or in the URL by the mail
+// clients unsubscribing in one click. Please refer to RFC 8058.
+func ConfirmUnsubscribeDigestController(w http.ResponseWriter, r *http.Request) {
+	user, err := UnsubscribeDigest(r.FormValue("token"))
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = fmt.Fprintln(w, localize(defaultLanguage(), "digest.unsubscribe.error"))
+		return
+	}
+
+	_, _ = fmt.Fprintln(w, localize(user.Language, "digest.unsubscribed"))
+}
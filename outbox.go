@@ -0,0 +1,420 @@
+package insapp
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Delivery defines how to model an outgoing push notification, email,
+// in-app notification or notification fan-out, stored until it is sent
+type Delivery struct {
+	ID           bson.ObjectId   `bson:"_id,omitempty"`
+	Channel      string          `json:"channel"`
+	Push         *PushDelivery   `json:"push,omitempty" bson:"push,omitempty"`
+	Email        *Email          `json:"email,omitempty" bson:"email,omitempty"`
+	Notification *Notification   `json:"notification,omitempty" bson:"notification,omitempty"`
+	Fanout       *FanoutDelivery `json:"fanout,omitempty" bson:"fanout,omitempty"`
+	// Key identifies what is delivered to whom, so that a fan-out retried
+	// after a failure does not deliver the same thing twice
+	Key         string    `json:"key,omitempty" bson:"key,omitempty"`
+	Status      string    `json:"status"`
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"nextattempt"`
+	LockedUntil time.Time `json:"-" bson:"lockeduntil,omitempty"`
+	LastError   string    `json:"lasterror"`
+	Date        time.Time `json:"date"`
+	SentDate    time.Time `json:"sentdate,omitempty" bson:"sentdate,omitempty"`
+}
+
+// Deliveries is an array of Delivery
+type Deliveries []Delivery
+
+// PushDelivery is a push notification sent either to a device or to a
+// combination of topics
+type PushDelivery struct {
+	Message   PushMessage `json:"message"`
+	Token     string      `json:"token,omitempty" bson:"token,omitempty"`
+	Condition string      `json:"condition,omitempty" bson:"condition,omitempty"`
+	// WebPush is set when the token is the endpoint of a browser
+	WebPush *WebPushKeys `json:"-" bson:"webpush,omitempty"`
+}
+
+// FanoutDelivery notifies every user targeted by a new post or event.
+// The message is rendered in the language of each user.
+type FanoutDelivery struct {
+	Kind    string        `json:"kind"`
+	Content bson.ObjectId `json:"content"`
+	Sender  bson.ObjectId `json:"sender"`
+}
+
+// The channels of a Delivery
+const (
+	DeliveryChannelPush         = "push"
+	DeliveryChannelEmail        = "email"
+	DeliveryChannelNotification = "notification"
+	DeliveryChannelFanout       = "fanout"
+)
+
+// The states a Delivery goes through. A failed delivery has been
+// attempted too many times and waits for an admin to replay it.
+const (
+	DeliveryStatusPending = "pending"
+	DeliveryStatusSending = "sending"
+	DeliveryStatusSent    = "sent"
+	DeliveryStatusFailed  = "failed"
+)
+
+const (
+	defaultOutboxWorkers     = 4
+	defaultOutboxMaxAttempts = 8
+	outboxBaseDelay          = 10 * time.Second
+	outboxMaxDelay           = time.Hour
+	outboxLockDuration       = 5 * time.Minute
+	outboxPollInterval       = 5 * time.Second
+	outboxSentRetention      = 7 * 24 * time.Hour
+)
+
+var (
+	outboxWakeup    = make(chan struct{}, 1)
+	outboxStartOnce sync.Once
+)
+
+// StartOutbox starts the workers sending the pending deliveries.
+// It can safely be called several times.
+func StartOutbox() {
+	outboxStartOnce.Do(func() {
+		workers := config.OutboxWorkers
+		if workers <= 0 {
+			workers = defaultOutboxWorkers
+		}
+		for i := 0; i < workers; i++ {
+			go runOutboxWorker()
+		}
+	})
+}
+
+// ensureOutboxIndexes creates the indexes of the outbox. The unique keys
+// keep a notification from being sent twice to the same user.
+func ensureOutboxIndexes(session *mgo.Session) {
+	db := session.DB("insapp").C("outbox")
+
+	indexes := []mgo.Index{
+		{Key: []string{"status", "nextattempt"}},
+		{Key: []string{"sentdate"}, ExpireAfter: outboxSentRetention},
+		{Key: []string{"key"}, Unique: true, Sparse: true},
+	}
+	for _, index := range indexes {
+		if err := db.EnsureIndex(index); err != nil {
+			log.Printf("error creating the outbox index on %v: %v\n", index.Key, err)
+		}
+	}
+}
+
+// enqueueDelivery stores the given delivery so that a worker sends it.
+// A delivery having the key of a stored one is not stored again.
+func enqueueDelivery(delivery Delivery) (Delivery, error) {
+	session := GetMongoSession()
+	defer session.Close()
+	db := session.DB("insapp").C("outbox")
+
+	delivery.ID = bson.NewObjectId()
+	delivery.Status = DeliveryStatusPending
+	delivery.Date = time.Now()
+	delivery.NextAttempt = delivery.Date
+	err := db.Insert(delivery)
+	if mgo.IsDup(err) && delivery.Key != "" {
+		var existing Delivery
+		err = db.Find(bson.M{"key": delivery.Key}).One(&existing)
+		return existing, err
+	}
+	if err != nil {
+		log.Printf("error storing %s delivery: %v\n", delivery.Channel, err)
+		return Delivery{}, err
+	}
+
+	wakeOutbox()
+
+	return delivery, nil
+}
+
+// EnqueuePushToDevice stores a push notification for the device with the given token
+func EnqueuePushToDevice(message PushMessage, token string) (Delivery, error) {
+	return enqueueDelivery(Delivery{
+		Channel: DeliveryChannelPush,
+		Push:    &PushDelivery{Message: message, Token: token},
+	})
+}
+
+// EnqueueWebPush stores a push notification for the browser with the given subscription
+func EnqueueWebPush(message PushMessage, subscription WebPushSubscription) (Delivery, error) {
+	keys := subscription.Keys
+	return enqueueDelivery(Delivery{
+		Channel: DeliveryChannelPush,
+		Push:    &PushDelivery{Message: message, Token: subscription.Endpoint, WebPush: &keys},
+	})
+}
+
+// EnqueuePushToCondition stores a push notification for the devices
+// subscribed to the given combination of topics
+func EnqueuePushToCondition(message PushMessage, condition string) (Delivery, error) {
+	return enqueueDelivery(Delivery{
+		Channel: DeliveryChannelPush,
+		Push:    &PushDelivery{Message: message, Condition: condition},
+	})
+}
+
+// EnqueueEmail stores an email for its recipient
+func EnqueueEmail(email Email) (Delivery, error) {
+	return enqueueDelivery(Delivery{
+		Channel: DeliveryChannelEmail,
+		Email:   &email,
+	})
+}
+
+// EnqueuePostNotification stores the notification of the users targeted by the post
+func EnqueuePostNotification(sender bson.ObjectId, content bson.ObjectId) (Delivery, error) {
+	return enqueueDelivery(Delivery{
+		Channel: DeliveryChannelFanout,
+		Fanout:  &FanoutDelivery{Kind: "post", Content: content, Sender: sender},
+	})
+}
+
+// EnqueueEventNotification stores the notification of the users targeted by the event
+func EnqueueEventNotification(sender bson.ObjectId, content bson.ObjectId) (Delivery, error) {
+	return enqueueDelivery(Delivery{
+		Channel: DeliveryChannelFanout,
+		Fanout:  &FanoutDelivery{Kind: "event", Content: content, Sender: sender},
+	})
+}
+
+// GetDeliveries returns the deliveries having the given status, newest first.
+// The content of the emails is left out.
+func GetDeliveries(status string) Deliveries {
+	session := GetMongoSession()
+	defer session.Close()
+	db := session.DB("insapp").C("outbox")
+
+	result := Deliveries{}
+	_ = db.Find(bson.M{"status": status}).
+		Select(bson.M{"email.body": 0, "email.text": 0, "email.headers": 0}).
+		Sort("-date").
+		Limit(200).
+		All(&result)
+
+	return result
+}
+
+// ReplayDelivery sends the failed delivery linked to the given id again
+func ReplayDelivery(id bson.ObjectId) (Delivery, error) {
+	session := GetMongoSession()
+	defer session.Close()
+	db := session.DB("insapp").C("outbox")
+
+	err := db.Update(bson.M{"_id": id, "status": DeliveryStatusFailed}, replayChange())
+	if err != nil {
+		return Delivery{}, errors.New("no failed delivery found")
+	}
+
+	wakeOutbox()
+
+	var result Delivery
+	_ = db.FindId(id).One(&result)
+
+	return result, nil
+}
+
+// ReplayFailedDeliveries sends every failed delivery again, and returns their number
+func ReplayFailedDeliveries() int {
+	session := GetMongoSession()
+	defer session.Close()
+	db := session.DB("insapp").C("outbox")
+
+	info, err := db.UpdateAll(bson.M{"status": DeliveryStatusFailed}, replayChange())
+	if err != nil {
+		return 0
+	}
+
+	wakeOutbox()
+
+	return info.Updated
+}
+
+func replayChange() bson.M {
+	return bson.M{"$set": bson.M{
+		"status":      DeliveryStatusPending,
+		"attempts":    0,
+		"nextattempt": time.Now(),
+	}}
+}
+
+func wakeOutbox() {
+	select {
+	case outboxWakeup <- struct{}{}:
+	default:
+	}
+}
+
+func runOutboxWorker() {
+	for {
+		delivery, ok := claimDelivery()
+		if !ok {
+			select {
+			case <-outboxWakeup:
+			case <-time.After(outboxPollInterval):
+			}
+			continue
+		}
+
+		completeDelivery(delivery, processDelivery(delivery))
+	}
+}
+
+// claimDelivery locks the next delivery due, so that no other worker sends it.
+// Deliveries locked by a worker which died are claimed again once the lock expires.
+func claimDelivery() (Delivery, bool) {
+	session := GetMongoSession()
+	defer session.Close()
+	db := session.DB("insapp").C("outbox")
+
+	now := time.Now()
+	query := bson.M{"$or": []bson.M{
+		{"status": DeliveryStatusPending, "nextattempt": bson.M{"$lte": now}},
+		{"status": DeliveryStatusSending, "lockeduntil": bson.M{"$lt": now}},
+	}}
+	change := mgo.Change{
+		Update: bson.M{
+			"$set": bson.M{"status": DeliveryStatusSending, "lockeduntil": now.Add(outboxLockDuration)},
+			"$inc": bson.M{"attempts": 1},
+		},
+		ReturnNew: true,
+	}
+
+	var delivery Delivery
+	_, err := db.Find(query).Sort("nextattempt").Apply(change, &delivery)
+	if err != nil {
+		if err != mgo.ErrNotFound {
+			log.Printf("error claiming a delivery: %v\n", err)
+		}
+		return Delivery{}, false
+	}
+
+	return delivery, true
+}
+
+func processDelivery(delivery Delivery) error {
+	switch {
+	case delivery.Channel == DeliveryChannelPush && delivery.Push != nil:
+		if delivery.Push.Condition != "" {
+			return getPushProvider().SendToCondition(delivery.Push.Message, delivery.Push.Condition)
+		}
+		err := sendPushDelivery(*delivery.Push)
+		if err == ErrUnregisteredDevice {
+			// Retrying is pointless, the device is forgotten instead
+			log.Printf("forgetting unregistered device %q\n", delivery.Push.Token)
+			InvalidateNotificationToken(delivery.Push.Token)
+			return nil
+		}
+		return err
+	case delivery.Channel == DeliveryChannelEmail && delivery.Email != nil:
+		return deliverEmail(*delivery.Email)
+	case delivery.Channel == DeliveryChannelNotification && delivery.Notification != nil:
+		return AddNotification(*delivery.Notification)
+	case delivery.Channel == DeliveryChannelFanout && delivery.Fanout != nil:
+		return processFanout(*delivery.Fanout)
+	}
+
+	return errors.New("malformed delivery")
+}
+
+// sendPushDelivery sends the push notification to a browser with Web Push,
+// or to a mobile device with the push provider
+func sendPushDelivery(push PushDelivery) error {
+	if push.WebPush == nil {
+		return getPushProvider().SendToDevice(push.Message, push.Token)
+	}
+
+	sender, err := getWebPushSender()
+	if err != nil {
+		return err
+	}
+
+	return sender.Send(push.Message, WebPushSubscription{Endpoint: push.Token, Keys: *push.WebPush})
+}
+
+// processFanout stores a delivery for every user targeted by the content.
+// Deleted contents notify nobody. The fan-out can be retried, the
+// deliveries already stored are kept as they are.
+func processFanout(fanout FanoutDelivery) error {
+	switch fanout.Kind {
+	case "post":
+		post := GetPost(fanout.Content)
+		if post.ID == "" {
+			return nil
+		}
+		return TriggerNotificationForPost(post, fanout.Sender, fanout.Content)
+	case "event":
+		event := GetEvent(fanout.Content)
+		if event.ID == "" {
+			return nil
+		}
+		return TriggerNotificationForEvent(event, fanout.Sender, fanout.Content)
+	}
+
+	return errors.New("unknown fan-out kind")
+}
+
+// completeDelivery records the outcome of a delivery attempt. Failed
+// deliveries are retried with an exponential backoff, until they are
+// declared dead. The content of the emails sent is not kept.
+func completeDelivery(delivery Delivery, err error) {
+	session := GetMongoSession()
+	defer session.Close()
+	db := session.DB("insapp").C("outbox")
+
+	if err == nil {
+		_ = db.UpdateId(delivery.ID, bson.M{
+			"$set":   bson.M{"status": DeliveryStatusSent, "sentdate": time.Now(), "lasterror": ""},
+			"$unset": bson.M{"lockeduntil": "", "email.body": "", "email.text": "", "email.headers": ""},
+		})
+		return
+	}
+
+	log.Printf("error sending %s delivery %s (attempt %d): %v\n", delivery.Channel, delivery.ID.Hex(), delivery.Attempts, err)
+
+	maxAttempts := config.OutboxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = defaultOutboxMaxAttempts
+	}
+
+	status := DeliveryStatusPending
+	if delivery.Attempts >= maxAttempts {
+		status = DeliveryStatusFailed
+	}
+
+	_ = db.UpdateId(delivery.ID, bson.M{
+		"$set": bson.M{
+			"status":      status,
+			"nextattempt": time.Now().Add(backoffDelay(delivery.Attempts)),
+			"lasterror":   err.Error(),
+		},
+		"$unset": bson.M{"lockeduntil": ""},
+	})
+}
+
+// backoffDelay returns the time to wait before the next attempt
+func backoffDelay(attempts int) time.Duration {
+	delay := outboxBaseDelay
+	for i := 1; i < attempts && delay < outboxMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > outboxMaxDelay {
+		delay = outboxMaxDelay
+	}
+
+	return delay
+}
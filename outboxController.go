@@ -0,0 +1,48 @@
+package insapp
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// GetDeliveriesController will answer a JSON of the failed deliveries,
+// or of the deliveries having the optional ?status= parameter
+func GetDeliveriesController(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	if status == "" {
+		status = DeliveryStatusFailed
+	}
+
+	res := GetDeliveries(status)
+	_ = json.NewEncoder(w).Encode(bson.M{"deliveries": res})
+}
+
+// ReplayDeliveryController will answer a JSON of the failed delivery
+// linked to the given id in the URL, scheduled to be sent again
+func ReplayDeliveryController(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if !bson.IsObjectIdHex(vars["id"]) {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(bson.M{"error": "wrong delivery ID"})
+		return
+	}
+
+	res, err := ReplayDelivery(bson.ObjectIdHex(vars["id"]))
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		_ = json.NewEncoder(w).Encode(bson.M{"error": err.Error()})
+		return
+	}
+
+	_ = json.NewEncoder(w).Encode(res)
+}
+
+// ReplayFailedDeliveriesController will answer the number of failed
+// deliveries scheduled to be sent again
+func ReplayFailedDeliveriesController(w http.ResponseWriter, r *http.Request) {
+	count := ReplayFailedDeliveries()
+	_ = json.NewEncoder(w).Encode(bson.M{"replayed": count})
+}
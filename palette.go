@@ -0,0 +1,316 @@
+package insapp
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	// Images are scaled down to fit in this box before extracting their palette
+	imagePaletteSize   = 256
+	imagePaletteColors = 6
+	// imageTaskWorkers bounds the number of images processed at once in
+	// the background
+	imageTaskWorkers = 2
+	// minimumContrast is the contrast ratio recommended by WCAG 2.0 for text.
+	// Please refer to https://www.w3.org/TR/WCAG20/#visual-audio-contrast-contrast
+	minimumContrast = 4.5
+	blackColor      = "000000"
+	whiteColor      = "ffffff"
+)
+
+var (
+	imageTaskSlots = make(chan struct{}, imageTaskWorkers)
+	// imageTasksPending lists the tasks running in the background, so that
+	// each one only runs once at a time
+	imageTasksPending      = map[string]bool{}
+	imageTasksPendingMutex sync.Mutex
+)
+
+// imagePaletteOf returns the palette of the image with the given file name
+// in place of the given palette, when it is missing or only holds the color
+// of the placeholder answered before the palette was extracted. A missing
+// palette is extracted in the background, and the given palette is returned
+// until it is known.
+func imagePaletteOf(fileName string, palette [][]int) [][]int {
+	if fileName == "" || len(palette) > 1 {
+		return palette
+	}
+
+	metadata, err := GetImage(fileName)
+	if err != nil {
+		return palette
+	}
+	if len(palette) == 1 && !samePalette(palette, placeholderPalette(metadata.Placeholder)) {
+		return palette
+	}
+	if len(metadata.Palette) == 0 {
+		ExtractImagePalette(fileName)
+		return palette
+	}
+
+	return metadata.Palette
+}
+
+// placeholderPalette is the palette answered for an image until its palette
+// is extracted: the average color of its placeholder
+func placeholderPalette(placeholder ImagePlaceholder) [][]int {
+	color, ok := parseHexColor(placeholder.Color)
+	if !ok {
+		return nil
+	}
+
+	return [][]int{{color[0], color[1], color[2]}}
+}
+
+func samePalette(first [][]int, second [][]int) bool {
+	if len(first) != len(second) {
+		return false
+	}
+	for i := range first {
+		if len(first[i]) != len(second[i]) {
+			return false
+		}
+		for j := range first[i] {
+			if first[i][j] != second[i][j] {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// extractImagePalette extracts the palette of the image with the given file
+// name, saves it with the image and gives it to the contents using the image
+func extractImagePalette(fileName string) [][]int {
+	palette := GetImageColors(fileName)
+	if len(palette) == 0 {
+		return nil
+	}
+
+	session := GetMongoSession()
+	defer session.Close()
+	db := session.DB("insapp").C("image")
+
+	var image Image
+	_, err := db.FindId(fileName).Apply(mgo.Change{
+		Update:    bson.M{"$set": bson.M{"palette": palette}},
+		ReturnNew: true,
+	}, &image)
+	if err == nil {
+		applyImagePalette(session, image)
+	}
+
+	return palette
+}
+
+// contentColors holds the fields of an association, an event or a post
+// whose colors are derived from an image
+type contentColors struct {
+	Image           string
+	Cover           string
+	ProfileUploaded string
+	SelectedColor   int
+	BgColor         string
+	FgColor         string
+}
+
+// applyImagePalette gives the palette of the image to the contents using it
+// which were saved before it was known, with an empty palette or the
+// palette of its placeholder
+func applyImagePalette(session *mgo.Session, image Image) {
+	temporary := placeholderPalette(image.Placeholder)
+	unknown := []bson.M{{"palette.0": bson.M{"$exists": false}}, {"palette": temporary}}
+
+	for _, reference := range image.References {
+		var db *mgo.Collection
+		switch reference.Kind {
+		case ImageReferencePostImage, ImageReferencePostMedia:
+			db = session.DB("insapp").C("post")
+		case ImageReferenceEventImage, ImageReferenceEventMedia:
+			db = session.DB("insapp").C("event")
+		case ImageReferenceAssociationCover, ImageReferenceAssociationProfileUploaded:
+			db = session.DB("insapp").C("association")
+		default:
+			continue
+		}
+
+		if reference.Kind == ImageReferencePostMedia || reference.Kind == ImageReferenceEventMedia {
+			// Each update gives the palette to a single item of the gallery
+			for i := 0; i < maxMediaCount; i++ {
+				err := db.Update(
+					bson.M{"_id": reference.ID, "media": bson.M{"$elemMatch": bson.M{"image": image.Name, "$or": unknown}}},
+					bson.M{"$set": bson.M{"media.$.palette": image.Palette}},
+				)
+				if err != nil {
+					break
+				}
+			}
+			continue
+		}
+
+		var content contentColors
+		if db.FindId(reference.ID).One(&content) != nil {
+			continue
+		}
+		// Associations use their profile picture when they have no cover
+		source := content.Image
+		if source == "" {
+			source = content.Cover
+		}
+		if source == "" {
+			source = content.ProfileUploaded
+		}
+		if source != image.Name {
+			continue
+		}
+
+		palette, selected, bgColor, fgColor := deriveColors(source, image.Palette, content.SelectedColor, content.BgColor, content.FgColor)
+		_ = db.Update(
+			bson.M{"_id": reference.ID, "$or": unknown},
+			bson.M{"$set": bson.M{"palette": palette, "selectedcolor": selected, "bgcolor": bgColor, "fgcolor": fgColor}},
+		)
+	}
+}
+
+// ExtractImagePalette extracts the palette of the image with the given file
+// name in the background, so that it is known when the image is used
+func ExtractImagePalette(fileName string) {
+	runImageTask("palette "+fileName, func() {
+		if len(extractImagePalette(fileName)) == 0 {
+			log.Printf("no palette extracted from %s\n", fileName)
+		}
+	})
+}
+
+// runImageTask runs the task in the background, unless a task with the same
+// key is already running
+func runImageTask(key string, task func()) {
+	imageTasksPendingMutex.Lock()
+	defer imageTasksPendingMutex.Unlock()
+	if imageTasksPending[key] {
+		return
+	}
+	imageTasksPending[key] = true
+
+	go func() {
+		imageTaskSlots <- struct{}{}
+		defer func() {
+			<-imageTaskSlots
+			imageTasksPendingMutex.Lock()
+			delete(imageTasksPending, key)
+			imageTasksPendingMutex.Unlock()
+		}()
+
+		task()
+	}()
+}
+
+// deriveColors completes the colors of a content from the palette of its
+// image: the palette if the client sent none, or only the color of the
+// placeholder, and it is already known, the background color if missing or
+// invalid, and a foreground color readable on the background.
+// A foreground color contrasting too little with the background is replaced
+// by black or white, whichever is the most readable.
+func deriveColors(image string, palette [][]int, selected int, bgColor string, fgColor string) ([][]int, int, string, string) {
+	palette = imagePaletteOf(image, palette)
+	if selected < 0 || selected >= len(palette) {
+		selected = 0
+	}
+
+	background, ok := parseHexColor(bgColor)
+	if !ok && len(palette) > 0 {
+		bgColor = hexColor(palette[selected])
+		background, ok = parseHexColor(bgColor)
+	}
+	if !ok {
+		return palette, selected, bgColor, fgColor
+	}
+
+	if foreground, ok := parseHexColor(fgColor); ok && contrastRatio(foreground, background) >= minimumContrast {
+		return palette, selected, bgColor, fgColor
+	}
+
+	black, _ := parseHexColor(blackColor)
+	white, _ := parseHexColor(whiteColor)
+	fgColor = blackColor
+	if contrastRatio(white, background) > contrastRatio(black, background) {
+		fgColor = whiteColor
+	}
+	// The foreground is written like the background, as clients expect
+	if strings.HasPrefix(bgColor, "#") {
+		fgColor = "#" + fgColor
+	}
+
+	return palette, selected, bgColor, fgColor
+}
+
+// hexColor writes the given [red, green, blue] color like "ff8800"
+func hexColor(rgb []int) string {
+	if len(rgb) < 3 {
+		return ""
+	}
+
+	return fmt.Sprintf("%02x%02x%02x", clampColor(rgb[0]), clampColor(rgb[1]), clampColor(rgb[2]))
+}
+
+func clampColor(value int) int {
+	if value < 0 {
+		return 0
+	}
+	if value > 255 {
+		return 255
+	}
+
+	return value
+}
+
+// parseHexColor reads a color written like "ff8800" or "#ff8800"
+func parseHexColor(value string) ([3]int, bool) {
+	value = strings.TrimPrefix(value, "#")
+	if len(value) != 6 {
+		return [3]int{}, false
+	}
+
+	number, err := strconv.ParseUint(value, 16, 32)
+	if err != nil {
+		return [3]int{}, false
+	}
+
+	return [3]int{int(number >> 16 & 0xff), int(number >> 8 & 0xff), int(number & 0xff)}, true
+}
+
+// contrastRatio returns the contrast ratio of two colors, from 1 to 21.
+// Please refer to https://www.w3.org/TR/WCAG20/#contrast-ratiodef
+func contrastRatio(first [3]int, second [3]int) float64 {
+	lighter, darker := relativeLuminance(first), relativeLuminance(second)
+	if darker > lighter {
+		lighter, darker = darker, lighter
+	}
+
+	return (lighter + 0.05) / (darker + 0.05)
+}
+
+// relativeLuminance returns the luminance of the color, from 0 to 1.
+// Please refer to https://www.w3.org/TR/WCAG20/#relativeluminancedef
+func relativeLuminance(rgb [3]int) float64 {
+	var channels [3]float64
+	for i, value := range rgb {
+		channel := float64(value) / 255
+		if channel <= 0.03928 {
+			channels[i] = channel / 12.92
+		} else {
+			channels[i] = math.Pow((channel+0.055)/1.055, 2.4)
+		}
+	}
+
+	return 0.2126*channels[0] + 0.7152*channels[1] + 0.0722*channels[2]
+}
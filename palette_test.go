@@ -0,0 +1,85 @@
+package insapp
+
+import (
+	"math"
+	"testing"
+)
+
+func TestHexColor(t *testing.T) {
+	cases := []struct {
+		rgb      []int
+		expected string
+	}{
+		{[]int{255, 136, 0}, "ff8800"},
+		{[]int{300, -5, 16}, "ff0010"},
+		{[]int{0, 0, 0, 255}, "000000"},
+		{[]int{1, 2}, ""},
+	}
+	for _, c := range cases {
+		if got := hexColor(c.rgb); got != c.expected {
+			t.Errorf("got %q for %v, expected %q", got, c.rgb, c.expected)
+		}
+	}
+}
+
+func TestContrastRatio(t *testing.T) {
+	black, white := [3]int{0, 0, 0}, [3]int{255, 255, 255}
+	cases := []struct {
+		first    [3]int
+		second   [3]int
+		expected float64
+	}{
+		{black, white, 21},
+		{white, black, 21},
+		{white, white, 1},
+		// The examples of the WCAG contrast checkers
+		{[3]int{119, 119, 119}, white, 4.48},
+		{[3]int{255, 0, 0}, white, 4},
+	}
+	for _, c := range cases {
+		if got := contrastRatio(c.first, c.second); math.Abs(got-c.expected) > 0.01 {
+			t.Errorf("got %.2f for %v on %v, expected %.2f", got, c.first, c.second, c.expected)
+		}
+	}
+}
+
+func TestDeriveColors(t *testing.T) {
+	palette := [][]int{{255, 255, 255}, {0, 0, 0}, {255, 136, 0}}
+	cases := []struct {
+		name     string
+		palette  [][]int
+		selected int
+		bgColor  string
+		fgColor  string
+		// The expected selected color, background and foreground
+		selectedColor int
+		background    string
+		foreground    string
+	}{
+		{"background from the selected color", palette, 1, "", "", 1, "000000", whiteColor},
+		{"selected color out of the palette", palette, 5, "invalid", "", 0, "ffffff", blackColor},
+		{"readable foreground kept", palette, 2, "", "000000", 2, "ff8800", "000000"},
+		{"unreadable foreground replaced", palette, 0, "888888", "777777", 0, "888888", blackColor},
+		{"foreground written like the background", palette, 0, "#1a1a1a", "#222222", 0, "#1a1a1a", "#" + whiteColor},
+		{"no palette nor background", nil, 0, "", "ff8800", 0, "", "ff8800"},
+	}
+	for _, c := range cases {
+		result, selected, bgColor, fgColor := deriveColors("", c.palette, c.selected, c.bgColor, c.fgColor)
+		if len(result) != len(c.palette) {
+			t.Errorf("%s: got the palette %v, expected %v", c.name, result, c.palette)
+		}
+		if selected != c.selectedColor || bgColor != c.background || fgColor != c.foreground {
+			t.Errorf("%s: got %d with %q on %q, expected %d with %q on %q", c.name, selected, fgColor, bgColor, c.selectedColor, c.foreground, c.background)
+		}
+	}
+}
+
+func TestPlaceholderPalette(t *testing.T) {
+	palette := placeholderPalette(ImagePlaceholder{Color: "ff8800"})
+	if !samePalette(palette, [][]int{{255, 136, 0}}) {
+		t.Errorf("got %v, expected the color of the placeholder", palette)
+	}
+	if palette = placeholderPalette(ImagePlaceholder{}); palette != nil {
+		t.Errorf("got %v for a placeholder without color", palette)
+	}
+}
@@ -1,6 +1,7 @@
 package insapp
 
 import (
+	"errors"
 	"time"
 
 	"gopkg.in/mgo.v2/bson"
@@ -8,18 +9,30 @@ import (
 
 // Post defines how to model a Post
 type Post struct {
-	ID             bson.ObjectId   `bson:"_id,omitempty"`
-	Title          string          `json:"title"`
-	Association    bson.ObjectId   `json:"association"`
-	Description    string          `json:"description"`
-	Date           time.Time       `json:"date"`
-	Likes          []bson.ObjectId `json:"likes"`
-	Comments       Comments        `json:"comments"`
-	Promotions     []string        `json:"promotions"`
-	Plateforms     []string        `json:"plateforms"`
-	Image          string          `json:"image"`
-	ImageSize      bson.M          `json:"imageSize"`
-	NoNotification bool            `json:"nonotification"`
+	ID          bson.ObjectId    `bson:"_id,omitempty"`
+	Title       string           `json:"title"`
+	Association bson.ObjectId    `json:"association"`
+	Description string           `json:"description"`
+	Date        time.Time        `json:"date"`
+	Likes       []bson.ObjectId  `json:"likes" bson:"-"`
+	Reactions   map[string]int   `json:"reactions" bson:"-"`
+	MyReaction  string           `json:"myreaction" bson:"-"`
+	Comments    Comments         `json:"comments"`
+	Promotions  []string         `json:"promotions"`
+	Plateforms  []string         `json:"plateforms"`
+	Image       string           `json:"image"`
+	ImageSize   bson.M           `json:"imageSize"`
+	Media       []Media          `json:"media"`
+	Placeholder ImagePlaceholder `json:"placeholder"`
+	// MediaType is the type of the first media, which may be a video
+	MediaType      string  `json:"mediatype"`
+	Video          string  `json:"video"`
+	Palette        [][]int `json:"palette"`
+	SelectedColor  int     `json:"selectedcolor"`
+	BgColor        string  `json:"bgColor"`
+	FgColor        string  `json:"fgColor"`
+	NoNotification bool    `json:"nonotification"`
+	Hidden         bool    `json:"hidden"`
 }
 
 // Posts is an array of Post
@@ -31,10 +44,12 @@ func AddPost(post Post) Post {
 	defer session.Close()
 	db := session.DB("insapp").C("post")
 
+	post = withPostMedia(post)
 	_ = db.Insert(post)
 	var result Post
 	_ = db.Find(bson.M{"title": post.Title, "date": post.Date}).One(&result)
 	AddPostToAssociation(result.Association, result.ID)
+	setPostImageReferences(result)
 
 	return result
 }
@@ -46,6 +61,10 @@ func UpdatePost(id bson.ObjectId, post Post) Post {
 	defer session.Close()
 	db := session.DB("insapp").C("post")
 
+	if len(post.Media) == 0 {
+		post.Media = keepMedia(GetPost(id).Media, post.Image)
+	}
+	post = withPostMedia(post)
 	postID := bson.M{"_id": id}
 	change := bson.M{"$set": bson.M{
 		"title":          post.Title,
@@ -54,12 +73,21 @@ func UpdatePost(id bson.ObjectId, post Post) Post {
 		"plateforms":     post.Plateforms,
 		"promotions":     post.Promotions,
 		"imageSize":      post.ImageSize,
+		"media":          post.Media,
+		"placeholder":    post.Placeholder,
+		"mediatype":      post.MediaType,
+		"video":          post.Video,
+		"palette":        post.Palette,
+		"selectedcolor":  post.SelectedColor,
+		"bgcolor":        post.BgColor,
+		"fgcolor":        post.FgColor,
 		"nonotification": post.NoNotification,
 	}}
 	_ = db.Update(postID, change)
 
 	var result Post
 	_ = db.Find(bson.M{"_id": id}).One(&result)
+	setPostImageReferences(result)
 
 	return result
 }
@@ -74,10 +102,10 @@ func DeletePost(post Post) Post {
 	var result Post
 	_ = db.FindId(post.ID).One(result)
 	DeleteNotificationsForPost(post.ID)
+	MarkReportsTargetDeleted(post.ID)
 	RemovePostFromAssociation(post.Association, post.ID)
-	for _, userID := range post.Likes {
-		DislikePost(userID, post.ID)
-	}
+	DeleteReactionsForContent(post.ID)
+	RemoveImageReferences(post.ID)
 
 	return result
 }
@@ -130,54 +158,70 @@ func GetPostsForAssociation(id bson.ObjectId) Posts {
 	return result
 }
 
-func SearchPost(name string) Posts {
+// SearchPost returns the posts whose title or description match the
+// search, the most relevant first, and whether more posts follow. Hidden
+// posts are only found if hidden is true.
+func SearchPost(search Search, hidden bool) (Posts, bool) {
+	ids, more := searchIDs("post", search, hiddenFilter(hidden))
+	if len(ids) == 0 {
+		return Posts{}, false
+	}
+
 	session := GetMongoSession()
 	defer session.Close()
 	db := session.DB("insapp").C("post")
 
-	var result Posts
-	_ = db.Find(bson.M{"$or": []interface{}{
-		bson.M{"title": bson.M{"$regex": bson.RegEx{Pattern: `^.*` + name + `.*`, Options: "i"}}}, bson.M{"description": bson.M{"$regex": bson.RegEx{Pattern: `^.*` + name + `.*`, Options: "i"}}}}}).All(&result)
+	var found Posts
+	_ = db.Find(bson.M{"_id": bson.M{"$in": ids}}).All(&found)
 
-	return result
+	byID := map[bson.ObjectId]Post{}
+	for _, post := range found {
+		byID[post.ID] = post
+	}
+	result := Posts{}
+	for _, id := range ids {
+		if post, ok := byID[id]; ok {
+			result = append(result, post)
+		}
+	}
+
+	return result, more
 }
 
-// LikePostWithUser will add the user to the list of
-// user that liked the post (cf. Likes field)
+// LikePostWithUser will set the default reaction
+// of the user on the post
 func LikePostWithUser(id bson.ObjectId, userID bson.ObjectId) (Post, User) {
-	session := GetMongoSession()
-	defer session.Close()
-	db := session.DB("insapp").C("post")
+	_ = SetReaction(userID, ReactionTargetPost, id, "", DefaultReaction())
 
-	postID := bson.M{"_id": id}
-	change := bson.M{"$addToSet": bson.M{
-		"likes": userID,
-	}}
-	_ = db.Update(postID, change)
-
-	var post Post
-	_ = db.Find(bson.M{"_id": id}).One(&post)
-	user := LikePost(userID, post.ID)
-
-	return post, user
+	return GetPost(id), GetUser(userID)
 }
 
-// DislikePostWithUser will remove the user to the list of
-// users that liked the post (cf. Likes field)
+// DislikePostWithUser will remove the reaction
+// of the user on the post
 func DislikePostWithUser(id bson.ObjectId, userID bson.ObjectId) (Post, User) {
-	session := GetMongoSession()
-	defer session.Close()
-	db := session.DB("insapp").C("post")
+	RemoveReaction(userID, id)
 
-	postID := bson.M{"_id": id}
-	change := bson.M{"$pull": bson.M{
-		"likes": userID,
-	}}
-	_ = db.Update(postID, change)
+	return GetPost(id), GetUser(userID)
+}
 
-	var post Post
-	_ = db.Find(bson.M{"_id": id}).One(&post)
-	user := DislikePost(userID, post.ID)
+// ReportPost records a report made by the given reporter on the post linked
+// to the given id
+func ReportPost(id bson.ObjectId, reporterID bson.ObjectId, category string, reason string) (Report, error) {
+	post := GetPost(id)
+	if post.ID == "" {
+		return Report{}, errors.New("no post found")
+	}
+
+	report, duplicate := AddReport(Report{
+		Reporter:   reporterID,
+		TargetType: ReportTargetPost,
+		Target:     post.ID,
+		Category:   category,
+		Reason:     reason,
+	})
+	if !duplicate {
+		sendReportEmail(report, post.Title+"\n"+post.Description)
+	}
 
-	return post, user
+	return report, nil
 }
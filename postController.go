@@ -18,7 +18,12 @@ import (
 func GetPostController(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	postID := vars["id"]
-	var res = GetPost(bson.ObjectIdHex(postID))
+	res, ok := visiblePost(GetPost(bson.ObjectIdHex(postID)), getViewer(r))
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(bson.M{"error": "no post found"})
+		return
+	}
 	json.NewEncoder(w).Encode(res)
 }
 
@@ -34,7 +39,7 @@ func GetAllPostsController(w http.ResponseWriter, r *http.Request) {
 
 	user := GetUser(id)
 	os := GetNotificationUserForUser(id).Os
-	posts := GetLatestPosts(10)
+	posts := visiblePosts(GetLatestPosts(10), getViewer(r))
 	filteredPosts := Posts{}
 	if user.ID != "" {
 		for _, post := range posts {
@@ -84,7 +89,7 @@ func GetPostsForAssociationController(w http.ResponseWriter, r *http.Request) {
 
 	user := GetUser(userID)
 	os := GetNotificationUserForUser(userID).Os
-	posts := GetPostsForAssociation(bson.ObjectIdHex(associationID))
+	posts := visiblePosts(GetPostsForAssociation(bson.ObjectIdHex(associationID)), getViewer(r))
 
 	filteredPosts := Posts{}
 	if user.ID != "" {
@@ -112,7 +117,7 @@ func AddPostController(w http.ResponseWriter, r *http.Request) {
 	res := AddPost(post)
 	association := GetAssociation(post.Association)
 	_ = json.NewEncoder(w).Encode(res)
-	go TriggerNotificationForPost(post, association.ID, res.ID, "@"+strings.ToLower(association.Name)+" a posté une news 📰")
+	EnqueuePostNotification(association.ID, res.ID)
 }
 
 // UpdatePostController will answer the JSON of the
@@ -141,13 +146,16 @@ func DeletePostController(w http.ResponseWriter, r *http.Request) {
 }
 
 // LikePostController will answer a JSON of the
-// post and the user that liked the post
+// post and the user that liked the post.
+// A like is the default reaction.
 func LikePostController(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	postID := vars["id"]
 	userID := vars["userID"]
 
 	post, user := LikePostWithUser(bson.ObjectIdHex(postID), bson.ObjectIdHex(userID))
+	post, _ = visiblePost(post, getViewer(r))
+	fillPostsLiked(&user)
 
 	_ = json.NewEncoder(w).Encode(bson.M{"post": post, "user": user})
 }
@@ -160,6 +168,8 @@ func DislikePostController(w http.ResponseWriter, r *http.Request) {
 	userID := vars["userID"]
 
 	post, user := DislikePostWithUser(bson.ObjectIdHex(postID), bson.ObjectIdHex(userID))
+	post, _ = visiblePost(post, getViewer(r))
+	fillPostsLiked(&user)
 
 	_ = json.NewEncoder(w).Encode(bson.M{"post": post, "user": user})
 }
@@ -170,6 +180,7 @@ func CommentPostController(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		_ = json.NewEncoder(w).Encode(bson.M{"error": "unable to read the request body"})
+		return
 	}
 	var comment Comment
 	if err := json.Unmarshal([]byte(string(body)), &comment); err != nil {
@@ -178,8 +189,14 @@ func CommentPostController(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	verdict, ok := filterCommentFromRequest(w, r, &comment)
+	if !ok {
+		return
+	}
+
 	comment.ID = bson.NewObjectId()
 	comment.Date = time.Now()
+	comment.Tags = removeBlockedTags(comment.User, comment.Tags)
 
 	vars := mux.Vars(r)
 	postID := vars["id"]
@@ -188,15 +205,26 @@ func CommentPostController(w http.ResponseWriter, r *http.Request) {
 	association := GetAssociation(post.Association)
 	user := GetUser(comment.User)
 
-	_ = json.NewEncoder(w).Encode(post)
+	res, _ := visiblePost(post, getViewer(r))
+	if comment.Hidden {
+		w.WriteHeader(http.StatusAccepted)
+	}
+	_ = json.NewEncoder(w).Encode(res)
+
+	// Held comments wait for a moderator before anyone is notified
+	if comment.Hidden {
+		reportHeldComment(verdict, ReportTargetPostComment, comment, post.ID)
+		return
+	}
 
 	if !post.NoNotification {
-		_ = SendAssociationEmailForCommentOnPost(association.Email, post, comment, user)
+		_ = SendAssociationEmailForCommentOnPost(association, post, comment, user)
 	}
 
 	for _, tag := range comment.Tags {
-		go TriggerNotificationForUserFromPost(comment.User, bson.ObjectIdHex(tag.User), post.ID, "@"+GetUser(comment.User).Username+" t'a taggé sur '"+post.Title+"'", comment, "tag")
+		go TriggerNotificationForUserFromPost(comment.User, bson.ObjectIdHex(tag.User), post.ID, post.Title, comment, "tag")
 	}
+	go TriggerReplyNotificationsForPost(post, comment)
 }
 
 // UncommentPostController will answer a JSON of the post
@@ -206,11 +234,13 @@ func UncommentPostController(w http.ResponseWriter, r *http.Request) {
 	postID := vars["id"]
 	commentID := vars["commentID"]
 
-	res := UncommentPost(bson.ObjectIdHex(postID), bson.ObjectIdHex(commentID))
+	res, _ := visiblePost(UncommentPost(bson.ObjectIdHex(postID), bson.ObjectIdHex(commentID)), getViewer(r))
 
 	_ = json.NewEncoder(w).Encode(res)
 }
 
+// ReportCommentController will answer a JSON of the report
+// made on the given comment of the post
 func ReportCommentController(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	postID := vars["id"]
@@ -223,6 +253,37 @@ func ReportCommentController(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	ReportComment(bson.ObjectIdHex(postID), bson.ObjectIdHex(commentID), userID)
-	json.NewEncoder(w).Encode(bson.M{})
+	request := decodeReportRequest(r)
+	res, err := ReportComment(bson.ObjectIdHex(postID), bson.ObjectIdHex(commentID), userID, request.Category, request.Reason)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(bson.M{"error": err.Error()})
+		return
+	}
+
+	json.NewEncoder(w).Encode(res)
+}
+
+// ReportPostController will answer a JSON of the report
+// made on the post linked to the given id in the URL
+func ReportPostController(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	postID := vars["id"]
+
+	userID, err := GetUserFromRequest(r)
+	if err != nil {
+		w.WriteHeader(http.StatusNotAcceptable)
+		_ = json.NewEncoder(w).Encode(bson.M{"error": "could not get user ID"})
+		return
+	}
+
+	request := decodeReportRequest(r)
+	res, err := ReportPost(bson.ObjectIdHex(postID), userID, request.Category, request.Reason)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		_ = json.NewEncoder(w).Encode(bson.M{"error": err.Error()})
+		return
+	}
+
+	_ = json.NewEncoder(w).Encode(res)
 }
@@ -0,0 +1,262 @@
+package insapp
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+
+	"golang.org/x/net/context"
+
+	firebase "firebase.google.com/go"
+	"firebase.google.com/go/messaging"
+)
+
+// PushMessage defines the content of a push notification
+type PushMessage struct {
+	Title       string
+	Body        string
+	ObjectID    string
+	ClickAction string
+}
+
+// PushProvider sends push notifications to devices
+type PushProvider interface {
+	// SendToDevice sends the message to the device with the given token
+	SendToDevice(message PushMessage, token string) error
+	// SendToCondition sends the message to the devices subscribed to the
+	// combination of topics given by the condition
+	SendToCondition(message PushMessage, condition string) error
+}
+
+// ErrUnregisteredDevice is returned by a PushProvider when the device
+// token is not valid anymore, typically after the app was uninstalled
+var ErrUnregisteredDevice = errors.New("device token not registered")
+
+var (
+	pushProvider      PushProvider
+	pushProviderMutex sync.RWMutex
+)
+
+// SetPushProvider replaces the provider used to send push notifications.
+// It can be called while notifications are being sent.
+func SetPushProvider(provider PushProvider) {
+	pushProviderMutex.Lock()
+	defer pushProviderMutex.Unlock()
+
+	pushProvider = provider
+}
+
+// getPushProvider returns the provider chosen in the configuration.
+// The "fcm" provider is used by default, except in a local environment.
+func getPushProvider() PushProvider {
+	pushProviderMutex.RLock()
+	provider := pushProvider
+	pushProviderMutex.RUnlock()
+	if provider != nil {
+		return provider
+	}
+
+	pushProviderMutex.Lock()
+	defer pushProviderMutex.Unlock()
+
+	if pushProvider == nil {
+		pushProvider = newPushProvider(config.PushProvider)
+	}
+
+	return pushProvider
+}
+
+func newPushProvider(name string) PushProvider {
+	if name == "" {
+		if config.Environment == "local" {
+			name = "log"
+		} else {
+			name = "fcm"
+		}
+	}
+
+	switch name {
+	case "fcm":
+		provider, err := NewFCMPushProvider()
+		if err != nil {
+			return unavailablePushProvider(fmt.Errorf("error initializing Firebase app: %v", err))
+		}
+		return provider
+	case "log":
+		return LogPushProvider{}
+	}
+
+	return unavailablePushProvider(fmt.Errorf("unknown push provider %q", name))
+}
+
+// unavailablePushProvider is used when the configured provider cannot be
+// started. Notifications are only logged in a local environment. Elsewhere,
+// sending them fails with the given error, so that the outbox retries them
+// and finally marks them as failed.
+func unavailablePushProvider(err error) PushProvider {
+	if config != nil && config.Environment == "local" {
+		log.Printf("%v, push notifications will only be logged\n", err)
+		return LogPushProvider{}
+	}
+
+	log.Printf("%v, push notifications cannot be sent\n", err)
+	return FailingPushProvider{Err: err}
+}
+
+// FailingPushProvider fails to send every push notification with Err
+type FailingPushProvider struct {
+	Err error
+}
+
+// SendToDevice returns the error of the provider
+func (provider FailingPushProvider) SendToDevice(message PushMessage, token string) error {
+	return provider.Err
+}
+
+// SendToCondition returns the error of the provider
+func (provider FailingPushProvider) SendToCondition(message PushMessage, condition string) error {
+	return provider.Err
+}
+
+// FCMPushProvider sends push notifications with Firebase Cloud Messaging.
+// Please refer to https://firebase.google.com/docs/reference/fcm/rest/v1/projects.messages
+type FCMPushProvider struct {
+	app *firebase.App
+}
+
+// NewFCMPushProvider creates a FCMPushProvider using the credentials
+// found in GOOGLE_APPLICATION_CREDENTIALS
+func NewFCMPushProvider() (*FCMPushProvider, error) {
+	app, err := firebase.NewApp(context.Background(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FCMPushProvider{app: app}, nil
+}
+
+// SendToDevice sends the message to the device with the given token
+func (provider *FCMPushProvider) SendToDevice(message PushMessage, token string) error {
+	if token == "" {
+		return errors.New("no device token")
+	}
+
+	pushNotification := buildFCMMessage(message)
+	pushNotification.Token = token
+
+	return provider.send(pushNotification)
+}
+
+// SendToCondition sends the message to the devices subscribed to the
+// combination of topics given by the condition
+func (provider *FCMPushProvider) SendToCondition(message PushMessage, condition string) error {
+	pushNotification := buildFCMMessage(message)
+	pushNotification.Condition = condition
+
+	return provider.send(pushNotification)
+}
+
+func (provider *FCMPushProvider) send(pushNotification *messaging.Message) error {
+	ctx := context.Background()
+	client, err := provider.app.Messaging(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Response is a message ID string
+	response, err := client.Send(ctx, pushNotification)
+	if messaging.IsRegistrationTokenNotRegistered(err) {
+		return ErrUnregisteredDevice
+	}
+	if err != nil {
+		return err
+	}
+
+	log.Println("Successfully sent message:", response)
+	return nil
+}
+
+func buildFCMMessage(message PushMessage) *messaging.Message {
+	return &messaging.Message{
+		Notification: &messaging.Notification{
+			Title: message.Title,
+			Body:  message.Body,
+		},
+		Data: map[string]string{
+			"ID": message.ObjectID,
+		},
+		Android: &messaging.AndroidConfig{
+			Notification: &messaging.AndroidNotification{
+				Sound:       "default",
+				Color:       "#ec5d57",
+				ClickAction: message.ClickAction,
+			},
+		},
+	}
+}
+
+// LogPushProvider only logs the push notifications, without sending them
+type LogPushProvider struct{}
+
+// SendToDevice logs the message
+func (LogPushProvider) SendToDevice(message PushMessage, token string) error {
+	log.Printf("push notification to device %q: %s - %s\n", token, message.Title, message.Body)
+	return nil
+}
+
+// SendToCondition logs the message
+func (LogPushProvider) SendToCondition(message PushMessage, condition string) error {
+	log.Printf("push notification to condition %q: %s - %s\n", condition, message.Title, message.Body)
+	return nil
+}
+
+// RecordedPush is a push notification kept by a RecordingPushProvider
+type RecordedPush struct {
+	Message   PushMessage
+	Token     string
+	Condition string
+}
+
+// RecordingPushProvider keeps the push notifications in memory instead of
+// sending them. It is meant to be used in tests.
+type RecordingPushProvider struct {
+	mutex  sync.Mutex
+	pushes []RecordedPush
+	// Err is returned by every send, if not nil
+	Err error
+}
+
+// SendToDevice records the message
+func (provider *RecordingPushProvider) SendToDevice(message PushMessage, token string) error {
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+
+	provider.pushes = append(provider.pushes, RecordedPush{Message: message, Token: token})
+	return provider.Err
+}
+
+// SendToCondition records the message
+func (provider *RecordingPushProvider) SendToCondition(message PushMessage, condition string) error {
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+
+	provider.pushes = append(provider.pushes, RecordedPush{Message: message, Condition: condition})
+	return provider.Err
+}
+
+// Pushes returns the recorded push notifications
+func (provider *RecordingPushProvider) Pushes() []RecordedPush {
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+
+	return append([]RecordedPush{}, provider.pushes...)
+}
+
+// Reset forgets the recorded push notifications
+func (provider *RecordingPushProvider) Reset() {
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+
+	provider.pushes = nil
+}
@@ -0,0 +1,69 @@
+package insapp
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestProcessDeliveryUsesPushProvider(t *testing.T) {
+	provider := &RecordingPushProvider{}
+	SetPushProvider(provider)
+
+	message := PushMessage{Title: "Title", Body: "Body", ObjectID: "id", ClickAction: "action"}
+	err := processDelivery(Delivery{Channel: DeliveryChannelPush, Push: &PushDelivery{Message: message, Token: "token"}})
+	if err != nil {
+		t.Fatalf("sending to a device: %v", err)
+	}
+	err = processDelivery(Delivery{Channel: DeliveryChannelPush, Push: &PushDelivery{Message: message, Condition: "'news' in topics"}})
+	if err != nil {
+		t.Fatalf("sending to a condition: %v", err)
+	}
+
+	pushes := provider.Pushes()
+	if len(pushes) != 2 {
+		t.Fatalf("got %d pushes, want 2", len(pushes))
+	}
+	if pushes[0].Token != "token" || pushes[0].Condition != "" || pushes[0].Message != message {
+		t.Errorf("unexpected push to a device: %+v", pushes[0])
+	}
+	if pushes[1].Condition != "'news' in topics" || pushes[1].Token != "" || pushes[1].Message != message {
+		t.Errorf("unexpected push to a condition: %+v", pushes[1])
+	}
+
+	provider.Reset()
+	if len(provider.Pushes()) != 0 {
+		t.Error("pushes kept after a reset")
+	}
+}
+
+func TestProcessDeliveryReturnsPushErrors(t *testing.T) {
+	failure := errors.New("unavailable")
+	SetPushProvider(&RecordingPushProvider{Err: failure})
+
+	err := processDelivery(Delivery{Channel: DeliveryChannelPush, Push: &PushDelivery{Token: "token"}})
+	if err != failure {
+		t.Errorf("got error %v, want %v", err, failure)
+	}
+}
+
+func TestNewPushProviderUnavailable(t *testing.T) {
+	previous := config
+	defer func() { config = previous }()
+
+	config = &Config{Environment: "prod"}
+	if _, ok := newPushProvider("log").(LogPushProvider); !ok {
+		t.Error("the log provider is not logging the notifications")
+	}
+	provider, ok := newPushProvider("unknown").(FailingPushProvider)
+	if !ok {
+		t.Fatal("an unknown provider does not fail in production")
+	}
+	if err := provider.SendToDevice(PushMessage{}, "token"); err == nil {
+		t.Error("sending with an unavailable provider does not fail")
+	}
+
+	config = &Config{Environment: "local"}
+	if _, ok := newPushProvider("unknown").(LogPushProvider); !ok {
+		t.Error("an unknown provider is not logging the notifications in a local environment")
+	}
+}
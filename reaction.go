@@ -0,0 +1,295 @@
+package insapp
+
+import (
+	"errors"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Reaction defines how to model the Reaction of a user on a post or a comment.
+// A user has at most one reaction on a given content.
+type Reaction struct {
+	ID          bson.ObjectId `bson:"_id,omitempty"`
+	User        bson.ObjectId `json:"user"`
+	Content     bson.ObjectId `json:"content"`
+	ContentType string        `json:"contenttype"`
+	Parent      bson.ObjectId `json:"parent,omitempty" bson:"parent,omitempty"`
+	Reaction    string        `json:"reaction"`
+	Date        time.Time     `json:"date"`
+}
+
+// Reactions is an array of Reaction
+type Reactions []Reaction
+
+// The kinds of content a user can react to
+const (
+	ReactionTargetPost         = "post"
+	ReactionTargetPostComment  = "postcomment"
+	ReactionTargetEventComment = "eventcomment"
+)
+
+var defaultReactions = []string{"❤️", "😂", "😮", "😢", "😡", "👍"}
+
+// GetAvailableReactions returns the reactions users can choose from.
+// The first one is the default reaction, used by the former likes.
+func GetAvailableReactions() []string {
+	if config != nil && len(config.Reactions) > 0 {
+		return config.Reactions
+	}
+
+	return defaultReactions
+}
+
+// DefaultReaction returns the reaction used when liking a post
+func DefaultReaction() string {
+	return GetAvailableReactions()[0]
+}
+
+// SetReaction adds or replaces the reaction of the user on the given content
+func SetReaction(userID bson.ObjectId, contentType string, content bson.ObjectId, parent bson.ObjectId, reaction string) error {
+	session := GetMongoSession()
+	defer session.Close()
+	db := session.DB("insapp").C("reaction")
+
+	if !ContainsString(GetAvailableReactions(), reaction) {
+		return errors.New("unknown reaction")
+	}
+
+	change := bson.M{
+		"user":        userID,
+		"content":     content,
+		"contenttype": contentType,
+		"reaction":    reaction,
+		"date":        time.Now(),
+	}
+	if parent != "" {
+		change["parent"] = parent
+	}
+
+	_, err := db.Upsert(bson.M{"content": content, "user": userID}, bson.M{"$set": change})
+
+	return err
+}
+
+// RemoveReaction removes the reaction of the user on the given content
+func RemoveReaction(userID bson.ObjectId, content bson.ObjectId) {
+	session := GetMongoSession()
+	defer session.Close()
+	db := session.DB("insapp").C("reaction")
+
+	_ = db.Remove(bson.M{"content": content, "user": userID})
+}
+
+// DeleteReactionsForContent removes the reactions on the given content, and
+// on the comments of this content
+func DeleteReactionsForContent(id bson.ObjectId) {
+	session := GetMongoSession()
+	defer session.Close()
+	db := session.DB("insapp").C("reaction")
+
+	_, _ = db.RemoveAll(bson.M{"$or": []bson.M{{"content": id}, {"parent": id}}})
+}
+
+// DeleteReactionsForUser removes every reaction of the given user
+func DeleteReactionsForUser(userID bson.ObjectId) {
+	session := GetMongoSession()
+	defer session.Close()
+	db := session.DB("insapp").C("reaction")
+
+	_, _ = db.RemoveAll(bson.M{"user": userID})
+}
+
+// GetPostsLikedByUser returns the posts on which the given user
+// used the default reaction
+func GetPostsLikedByUser(userID bson.ObjectId) []bson.ObjectId {
+	session := GetMongoSession()
+	defer session.Close()
+	db := session.DB("insapp").C("reaction")
+
+	var reactions Reactions
+	_ = db.Find(bson.M{
+		"user":        userID,
+		"contenttype": ReactionTargetPost,
+		"reaction":    DefaultReaction(),
+	}).All(&reactions)
+
+	result := []bson.ObjectId{}
+	for _, reaction := range reactions {
+		result = append(result, reaction.Content)
+	}
+
+	return result
+}
+
+// fillPostsLiked sets the former PostsLiked field of the user,
+// still used by older clients
+func fillPostsLiked(user *User) {
+	if user.ID != "" {
+		user.PostsLiked = GetPostsLikedByUser(user.ID)
+	}
+}
+
+type reactionCount struct {
+	ID struct {
+		Content  bson.ObjectId `bson:"content"`
+		Reaction string        `bson:"reaction"`
+	} `bson:"_id"`
+	Count int `bson:"count"`
+}
+
+// reactionsSummary holds the reactions on a set of contents
+type reactionsSummary struct {
+	counts map[bson.ObjectId]map[string]int
+	mine   map[bson.ObjectId]string
+	likes  map[bson.ObjectId][]bson.ObjectId
+}
+
+// getReactionsSummary counts the reactions on the given contents, and
+// finds the reactions of the given viewer on these contents
+func getReactionsSummary(ids []bson.ObjectId, viewerID bson.ObjectId) reactionsSummary {
+	session := GetMongoSession()
+	defer session.Close()
+	db := session.DB("insapp").C("reaction")
+
+	summary := reactionsSummary{
+		counts: map[bson.ObjectId]map[string]int{},
+		mine:   map[bson.ObjectId]string{},
+		likes:  map[bson.ObjectId][]bson.ObjectId{},
+	}
+	if len(ids) == 0 {
+		return summary
+	}
+
+	var counts []reactionCount
+	_ = db.Pipe([]bson.M{
+		{"$match": bson.M{"content": bson.M{"$in": ids}}},
+		{"$group": bson.M{
+			"_id":   bson.M{"content": "$content", "reaction": "$reaction"},
+			"count": bson.M{"$sum": 1},
+		}},
+	}).All(&counts)
+	for _, count := range counts {
+		if summary.counts[count.ID.Content] == nil {
+			summary.counts[count.ID.Content] = map[string]int{}
+		}
+		summary.counts[count.ID.Content][count.ID.Reaction] = count.Count
+	}
+
+	if viewerID != "" {
+		var mine Reactions
+		_ = db.Find(bson.M{"content": bson.M{"$in": ids}, "user": viewerID}).All(&mine)
+		for _, reaction := range mine {
+			summary.mine[reaction.Content] = reaction.Reaction
+		}
+	}
+
+	var likes Reactions
+	_ = db.Find(bson.M{
+		"content":     bson.M{"$in": ids},
+		"contenttype": ReactionTargetPost,
+		"reaction":    DefaultReaction(),
+	}).All(&likes)
+	for _, like := range likes {
+		summary.likes[like.Content] = append(summary.likes[like.Content], like.User)
+	}
+
+	return summary
+}
+
+func (summary reactionsSummary) fillComments(comments Comments) {
+	for i := range comments {
+		comments[i].Reactions = summary.countsFor(comments[i].ID)
+		comments[i].MyReaction = summary.mine[comments[i].ID]
+	}
+}
+
+func (summary reactionsSummary) countsFor(id bson.ObjectId) map[string]int {
+	if counts, ok := summary.counts[id]; ok {
+		return counts
+	}
+
+	return map[string]int{}
+}
+
+// fillPostsReactions sets the reactions of the given posts and their comments
+func fillPostsReactions(posts Posts, viewerID bson.ObjectId) {
+	var ids []bson.ObjectId
+	for _, post := range posts {
+		ids = append(ids, post.ID)
+		for _, comment := range post.Comments {
+			ids = append(ids, comment.ID)
+		}
+	}
+
+	summary := getReactionsSummary(ids, viewerID)
+	for i := range posts {
+		posts[i].Reactions = summary.countsFor(posts[i].ID)
+		posts[i].MyReaction = summary.mine[posts[i].ID]
+		posts[i].Likes = summary.likes[posts[i].ID]
+		if posts[i].Likes == nil {
+			posts[i].Likes = []bson.ObjectId{}
+		}
+		summary.fillComments(posts[i].Comments)
+	}
+}
+
+// fillEventsReactions sets the reactions of the comments of the given events
+func fillEventsReactions(events Events, viewerID bson.ObjectId) {
+	var ids []bson.ObjectId
+	for _, event := range events {
+		for _, comment := range event.Comments {
+			ids = append(ids, comment.ID)
+		}
+	}
+
+	summary := getReactionsSummary(ids, viewerID)
+	for i := range events {
+		summary.fillComments(events[i].Comments)
+	}
+}
+
+// ensureReactionIndexes allows a single reaction by user on each content
+func ensureReactionIndexes(session *mgo.Session) {
+	db := session.DB("insapp").C("reaction")
+	_ = db.EnsureIndex(mgo.Index{Key: []string{"content", "user"}, Unique: true})
+}
+
+// MigrateLikesToReactions turns the likes stored on posts and users into
+// default reactions. It returns the number of migrated likes. It runs when
+// the API starts, and does nothing once the likes have been migrated.
+func MigrateLikesToReactions() (int, error) {
+	session := GetMongoSession()
+	defer session.Close()
+	posts := session.DB("insapp").C("post")
+	users := session.DB("insapp").C("user")
+
+	var documents []struct {
+		ID    bson.ObjectId   `bson:"_id"`
+		Likes []bson.ObjectId `bson:"likes"`
+	}
+	err := posts.Find(bson.M{"likes": bson.M{"$exists": true}}).All(&documents)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, document := range documents {
+		for _, userID := range document.Likes {
+			err = SetReaction(userID, ReactionTargetPost, document.ID, "", DefaultReaction())
+			if err != nil {
+				return count, err
+			}
+			count++
+		}
+	}
+
+	_, err = posts.UpdateAll(bson.M{"likes": bson.M{"$exists": true}}, bson.M{"$unset": bson.M{"likes": ""}})
+	if err != nil {
+		return count, err
+	}
+	_, err = users.UpdateAll(bson.M{"postsliked": bson.M{"$exists": true}}, bson.M{"$unset": bson.M{"postsliked": ""}})
+
+	return count, err
+}
@@ -0,0 +1,163 @@
+package insapp
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// ReactionRequest is the body sent to react to some content
+type ReactionRequest struct {
+	Reaction string `json:"reaction"`
+}
+
+// GetReactionsController will answer a JSON of the reactions users can
+// choose from. The first one is the default reaction.
+func GetReactionsController(w http.ResponseWriter, r *http.Request) {
+	_ = json.NewEncoder(w).Encode(bson.M{"reactions": GetAvailableReactions(), "default": DefaultReaction()})
+}
+
+// ReactPostController will answer a JSON of the post
+// once the reaction of the current user is set
+func ReactPostController(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	postID := bson.ObjectIdHex(vars["id"])
+
+	if GetPost(postID).ID == "" {
+		w.WriteHeader(http.StatusNotFound)
+		_ = json.NewEncoder(w).Encode(bson.M{"error": "no post found"})
+		return
+	}
+
+	if !setReactionFromRequest(w, r, ReactionTargetPost, postID, "") {
+		return
+	}
+
+	res, _ := visiblePost(GetPost(postID), getViewer(r))
+	_ = json.NewEncoder(w).Encode(res)
+}
+
+// UnreactPostController will answer a JSON of the post
+// once the reaction of the current user is removed
+func UnreactPostController(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	postID := bson.ObjectIdHex(vars["id"])
+
+	if !removeReactionFromRequest(w, r, postID) {
+		return
+	}
+
+	res, _ := visiblePost(GetPost(postID), getViewer(r))
+	_ = json.NewEncoder(w).Encode(res)
+}
+
+// ReactPostCommentController will answer a JSON of the post once
+// the reaction of the current user on the given comment is set
+func ReactPostCommentController(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	postID := bson.ObjectIdHex(vars["id"])
+	commentID := bson.ObjectIdHex(vars["commentID"])
+
+	if _, err := GetComment(postID, commentID); err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		_ = json.NewEncoder(w).Encode(bson.M{"error": err.Error()})
+		return
+	}
+
+	if !setReactionFromRequest(w, r, ReactionTargetPostComment, commentID, postID) {
+		return
+	}
+
+	res, _ := visiblePost(GetPost(postID), getViewer(r))
+	_ = json.NewEncoder(w).Encode(res)
+}
+
+// UnreactPostCommentController will answer a JSON of the post once
+// the reaction of the current user on the given comment is removed
+func UnreactPostCommentController(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	postID := bson.ObjectIdHex(vars["id"])
+	commentID := bson.ObjectIdHex(vars["commentID"])
+
+	if !removeReactionFromRequest(w, r, commentID) {
+		return
+	}
+
+	res, _ := visiblePost(GetPost(postID), getViewer(r))
+	_ = json.NewEncoder(w).Encode(res)
+}
+
+// ReactEventCommentController will answer a JSON of the event once
+// the reaction of the current user on the given comment is set
+func ReactEventCommentController(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	eventID := bson.ObjectIdHex(vars["id"])
+	commentID := bson.ObjectIdHex(vars["commentID"])
+
+	if _, err := GetCommentForEvent(eventID, commentID); err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		_ = json.NewEncoder(w).Encode(bson.M{"error": err.Error()})
+		return
+	}
+
+	if !setReactionFromRequest(w, r, ReactionTargetEventComment, commentID, eventID) {
+		return
+	}
+
+	res, _ := visibleEvent(GetEvent(eventID), getViewer(r))
+	_ = json.NewEncoder(w).Encode(res)
+}
+
+// UnreactEventCommentController will answer a JSON of the event once
+// the reaction of the current user on the given comment is removed
+func UnreactEventCommentController(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	eventID := bson.ObjectIdHex(vars["id"])
+	commentID := bson.ObjectIdHex(vars["commentID"])
+
+	if !removeReactionFromRequest(w, r, commentID) {
+		return
+	}
+
+	res, _ := visibleEvent(GetEvent(eventID), getViewer(r))
+	_ = json.NewEncoder(w).Encode(res)
+}
+
+func setReactionFromRequest(w http.ResponseWriter, r *http.Request, contentType string, content bson.ObjectId, parent bson.ObjectId) bool {
+	userID, err := GetUserFromRequest(r)
+	if err != nil {
+		w.WriteHeader(http.StatusNotAcceptable)
+		_ = json.NewEncoder(w).Encode(bson.M{"error": "could not get user ID"})
+		return false
+	}
+
+	var request ReactionRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(bson.M{"error": "wrong format"})
+		return false
+	}
+
+	if err := SetReaction(userID, contentType, content, parent, request.Reaction); err != nil {
+		w.WriteHeader(http.StatusNotAcceptable)
+		_ = json.NewEncoder(w).Encode(bson.M{"error": err.Error()})
+		return false
+	}
+
+	return true
+}
+
+func removeReactionFromRequest(w http.ResponseWriter, r *http.Request, content bson.ObjectId) bool {
+	userID, err := GetUserFromRequest(r)
+	if err != nil {
+		w.WriteHeader(http.StatusNotAcceptable)
+		_ = json.NewEncoder(w).Encode(bson.M{"error": "could not get user ID"})
+		return false
+	}
+
+	RemoveReaction(userID, content)
+
+	return true
+}
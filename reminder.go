@@ -0,0 +1,65 @@
+package insapp
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	reminderInterval = 10 * time.Minute
+	// reminderAdvance is how long before the start of an event its
+	// participants are reminded of it
+	reminderAdvance    = time.Hour
+	reminderTimeLayout = "15:04"
+)
+
+var reminderStartOnce sync.Once
+
+// StartReminders starts the job reminding the participants of the events
+// starting soon. It can safely be called several times.
+func StartReminders() {
+	reminderStartOnce.Do(func() {
+		go func() {
+			for {
+				SendDueReminders()
+				time.Sleep(reminderInterval)
+			}
+		}()
+	})
+}
+
+// SendDueReminders reminds the participants of the visible events starting
+// within reminderAdvance. Reminders are keyed in the outbox, so that each
+// participant is only reminded once of an event. It returns the number of
+// events whose participants were reminded.
+func SendDueReminders() int {
+	session := GetMongoSession()
+	defer session.Close()
+	db := session.DB("insapp").C("event")
+
+	now := time.Now()
+	var events Events
+	err := db.Find(bson.M{
+		"datestart":    bson.M{"$gt": now, "$lte": now.Add(reminderAdvance)},
+		"hidden":       bson.M{"$ne": true},
+		"participants": bson.M{"$exists": true, "$ne": []bson.ObjectId{}},
+	}).All(&events)
+	if err != nil {
+		log.Printf("error finding the events to remind: %v\n", err)
+		return 0
+	}
+
+	count := 0
+	for _, event := range events {
+		if err = TriggerReminderForEvent(event); err != nil {
+			log.Printf("error reminding the participants of %s: %v\n", event.ID.Hex(), err)
+			continue
+		}
+		count++
+	}
+
+	return count
+}
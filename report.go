@@ -0,0 +1,207 @@
+package insapp
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Report defines how to model a Report made by a user on some content
+type Report struct {
+	ID             bson.ObjectId `bson:"_id,omitempty"`
+	Reporter       bson.ObjectId `json:"reporter,omitempty" bson:"reporter,omitempty"`
+	TargetType     string        `json:"targettype"`
+	Target         bson.ObjectId `json:"target"`
+	Parent         bson.ObjectId `json:"parent,omitempty" bson:"parent,omitempty"`
+	Category       string        `json:"category"`
+	Reason         string        `json:"reason"`
+	Status         string        `json:"status"`
+	Count          int           `json:"count"`
+	Date           time.Time     `json:"date"`
+	ResolvedBy     bson.ObjectId `json:"resolvedby,omitempty" bson:"resolvedby,omitempty"`
+	ResolvedDate   time.Time     `json:"resolveddate,omitempty" bson:"resolveddate,omitempty"`
+	ResolutionNote string        `json:"resolutionnote,omitempty" bson:"resolutionnote,omitempty"`
+	// TargetDeleted is true once the reported content has been deleted
+	TargetDeleted bool `json:"targetdeleted" bson:"targetdeleted,omitempty"`
+}
+
+// Reports is an array of Report
+type Reports []Report
+
+// The kinds of content that can be reported
+const (
+	ReportTargetUser         = "user"
+	ReportTargetPost         = "post"
+	ReportTargetEvent        = "event"
+	ReportTargetPostComment  = "postcomment"
+	ReportTargetEventComment = "eventcomment"
+)
+
+// The states a Report goes through
+const (
+	ReportStatusOpen      = "open"
+	ReportStatusDismissed = "dismissed"
+	ReportStatusActioned  = "actioned"
+)
+
+var reportCategories = []string{"spam", "harassment", "inappropriate", "impersonation", "other"}
+
+// AddReport will add the given Report to the database.
+// If the reporter already has an open report on the same target, this report
+// is updated instead of creating a new one. The boolean is true in that case.
+func AddReport(report Report) (Report, bool) {
+	session := GetMongoSession()
+	defer session.Close()
+	db := session.DB("insapp").C("report")
+
+	if !ContainsString(reportCategories, report.Category) {
+		report.Category = "other"
+	}
+
+	selector := bson.M{
+		"targettype": report.TargetType,
+		"target":     report.Target,
+		"status":     ReportStatusOpen,
+	}
+	// Reports made automatically have no reporter
+	if report.Reporter != "" {
+		selector["reporter"] = report.Reporter
+	} else {
+		selector["reporter"] = bson.M{"$exists": false}
+	}
+
+	report.ID = bson.NewObjectId()
+	report.Status = ReportStatusOpen
+	report.Count = 1
+	report.Date = time.Now()
+	err := db.Insert(report)
+	if !mgo.IsDup(err) {
+		return report, false
+	}
+
+	// The unique index refused a second open report from the same reporter
+	change := mgo.Change{
+		Update: bson.M{
+			"$set": bson.M{
+				"category": report.Category,
+				"reason":   report.Reason,
+				"date":     time.Now(),
+			},
+			"$inc": bson.M{"count": 1},
+		},
+		ReturnNew: true,
+	}
+	var result Report
+	_, _ = db.Find(selector).Apply(change, &result)
+
+	return result, true
+}
+
+// GetReport returns the Report object with the given ID
+func GetReport(id bson.ObjectId) Report {
+	session := GetMongoSession()
+	defer session.Close()
+	db := session.DB("insapp").C("report")
+
+	var result Report
+	_ = db.FindId(id).One(&result)
+
+	return result
+}
+
+// GetReports returns the reports having the given status, newest first.
+// An empty status returns every report.
+func GetReports(status string) Reports {
+	session := GetMongoSession()
+	defer session.Close()
+	db := session.DB("insapp").C("report")
+
+	query := bson.M{}
+	if status != "" {
+		query["status"] = status
+	}
+
+	var result Reports
+	_ = db.Find(query).Sort("-date").All(&result)
+
+	return result
+}
+
+// ResolveReport closes the given open Report with the given status
+func ResolveReport(id bson.ObjectId, status string, moderator bson.ObjectId, note string) (Report, error) {
+	session := GetMongoSession()
+	defer session.Close()
+	db := session.DB("insapp").C("report")
+
+	if status != ReportStatusDismissed && status != ReportStatusActioned {
+		return Report{}, errors.New("unknown status")
+	}
+
+	change := bson.M{"$set": bson.M{
+		"status":         status,
+		"resolvedby":     moderator,
+		"resolveddate":   time.Now(),
+		"resolutionnote": note,
+	}}
+	err := db.Update(bson.M{"_id": id, "status": ReportStatusOpen}, change)
+	if err != nil {
+		return Report{}, errors.New("no open report found")
+	}
+
+	var result Report
+	_ = db.FindId(id).One(&result)
+
+	return result, nil
+}
+
+// MarkReportsTargetDeleted flags every report made on the given content as
+// made on deleted content. The reports are kept as the moderation history.
+func MarkReportsTargetDeleted(id bson.ObjectId) {
+	session := GetMongoSession()
+	defer session.Close()
+	db := session.DB("insapp").C("report")
+
+	_, _ = db.UpdateAll(bson.M{"target": id}, bson.M{"$set": bson.M{"targetdeleted": true}})
+}
+
+// ensureReportIndexes prevents a reporter from having two open reports on
+// the same content. Reports made automatically share the empty reporter.
+// The index only covers the open reports, as the resolved ones are kept.
+func ensureReportIndexes(session *mgo.Session) {
+	err := session.DB("insapp").Run(bson.D{
+		{Name: "createIndexes", Value: "report"},
+		{Name: "indexes", Value: []bson.M{{
+			"name":                    "reporter_target_open",
+			"key":                     bson.D{{Name: "reporter", Value: 1}, {Name: "target", Value: 1}},
+			"unique":                  true,
+			"partialFilterExpression": bson.M{"status": ReportStatusOpen},
+		}}},
+	}, nil)
+	if err != nil {
+		log.Printf("error creating the report index: %v\n", err)
+	}
+}
+
+// sendReportEmail warns the moderation team that a new report has been made.
+// Nothing is sent if no moderation email is configured.
+func sendReportEmail(report Report, summary string) {
+	if config.ModerationEmail == "" {
+		return
+	}
+
+	reporter := User{Username: "insapp"}
+	if report.Reporter != "" {
+		reporter = GetUser(report.Reporter)
+	}
+	language := defaultLanguage()
+	_ = SendTextEmail(config.ModerationEmail, localize(language, "email.report"), localize(language, "email.report.body",
+		"date", report.Date.String(),
+		"reporter", reporter.ID.Hex()+"\n"+reporter.Username,
+		"type", report.TargetType+" ("+report.Target.Hex()+")",
+		"category", report.Category,
+		"reason", report.Reason,
+		"content", summary))
+}
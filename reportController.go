@@ -0,0 +1,81 @@
+package insapp
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// ReportRequest is the optional body sent along with a report
+type ReportRequest struct {
+	Category string `json:"category"`
+	Reason   string `json:"reason"`
+}
+
+// ReportResolution is the body sent by a moderator to close a report
+type ReportResolution struct {
+	Status string `json:"status"`
+	Note   string `json:"note"`
+}
+
+// decodeReportRequest reads the report details from the request body.
+// Older clients send no body at all, which results in an "other" report.
+func decodeReportRequest(r *http.Request) ReportRequest {
+	var request ReportRequest
+	_ = json.NewDecoder(r.Body).Decode(&request)
+	return request
+}
+
+// GetReportsController will answer a JSON of the reports,
+// filtered by the optional ?status= parameter
+func GetReportsController(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	res := GetReports(status)
+	_ = json.NewEncoder(w).Encode(bson.M{"reports": res})
+}
+
+// GetReportController will answer a JSON of the report
+// linked to the given id in the URL
+func GetReportController(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	res := GetReport(bson.ObjectIdHex(vars["id"]))
+	if res.ID == "" {
+		w.WriteHeader(http.StatusNotFound)
+		_ = json.NewEncoder(w).Encode(bson.M{"error": "no report found"})
+		return
+	}
+
+	_ = json.NewEncoder(w).Encode(res)
+}
+
+// ResolveReportController will answer a JSON of the report
+// once dismissed or actioned by the moderator
+func ResolveReportController(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	reportID := vars["id"]
+
+	moderatorID, err := GetUserFromRequest(r)
+	if err != nil {
+		w.WriteHeader(http.StatusNotAcceptable)
+		_ = json.NewEncoder(w).Encode(bson.M{"error": "could not get user ID"})
+		return
+	}
+
+	var resolution ReportResolution
+	if err := json.NewDecoder(r.Body).Decode(&resolution); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(bson.M{"error": "wrong format"})
+		return
+	}
+
+	res, err := ResolveReport(bson.ObjectIdHex(reportID), resolution.Status, moderatorID, resolution.Note)
+	if err != nil {
+		w.WriteHeader(http.StatusNotAcceptable)
+		_ = json.NewEncoder(w).Encode(bson.M{"error": err.Error()})
+		return
+	}
+
+	_ = json.NewEncoder(w).Encode(res)
+}
@@ -62,6 +62,11 @@ var publicRoutes = Routes{
 	Route{"GET", "/how-to-post", HowToPost},
 	Route{"GET", "/credit", Credit},
 	Route{"GET", "/legal", Legal},
+	Route{"GET", "/digest/unsubscribe", UnsubscribeDigestController},
+	Route{"POST", "/digest/unsubscribe", ConfirmUnsubscribeDigestController},
+	Route{"GET", "/webpush/key", GetVAPIDPublicKeyController},
+	Route{"GET", "/images/{name}", ServeImageController},
+	Route{"HEAD", "/images/{name}", ServeImageController},
 
 	// Login
 	Route{"POST", "/login/user/{ticket}", LoginUserController},
@@ -82,8 +87,11 @@ var userRoutes = Routes{
 	Route{"POST", "/events/{id}/attend/{userID}/status/{status}", ChangeAttendeeStatusController},
 	Route{"POST", "/events/{id}/comment", CommentEventController},
 
+	Route{"PUT", "/events/{id}/comment/{commentID}/reaction", ReactEventCommentController},
+
 	Route{"DELETE", "/events/{id}/attend/{userID}", RemoveAttendeeController},
 	Route{"DELETE", "/events/{id}/comment/{commentID}", UncommentEventController},
+	Route{"DELETE", "/events/{id}/comment/{commentID}/reaction", UnreactEventCommentController},
 
 	// Posts
 	Route{"GET", "/posts", GetAllPostsController},
@@ -92,26 +100,54 @@ var userRoutes = Routes{
 	Route{"POST", "/posts/{id}/like/{userID}", LikePostController},
 	Route{"POST", "/posts/{id}/comment", CommentPostController},
 
+	Route{"PUT", "/posts/{id}/reaction", ReactPostController},
+	Route{"PUT", "/posts/{id}/comment/{commentID}/reaction", ReactPostCommentController},
+
 	Route{"DELETE", "/posts/{id}/like/{userID}", DislikePostController},
 	Route{"DELETE", "/posts/{id}/comment/{commentID}", UncommentPostController},
+	Route{"DELETE", "/posts/{id}/reaction", UnreactPostController},
+	Route{"DELETE", "/posts/{id}/comment/{commentID}/reaction", UnreactPostCommentController},
+
+	// Reactions
+	Route{"GET", "/reactions", GetReactionsController},
 
 	// Users
 	Route{"GET", "/users/{id}", GetUserController},
+	Route{"GET", "/blocked", GetBlockedUsersController},
+
+	Route{"POST", "/users/{id}/block", BlockUserController},
 
 	Route{"PUT", "/users/{id}", UpdateUserController},
 
 	Route{"DELETE", "/users/{id}", DeleteUserController},
+	Route{"DELETE", "/users/{id}/block", UnblockUserController},
 
 	// Notifications
 	Route{"GET", "/notifications/{userID}", GetNotificationController},
+	Route{"GET", "/inbox", GetNotificationController},
+	Route{"GET", "/inbox/unread", GetUnreadNotificationsCountController},
+	Route{"GET", "/preferences/notifications", GetNotificationPreferencesController},
+	Route{"GET", "/devices", GetDevicesController},
+	Route{"GET", "/stream", StreamController},
 
 	Route{"POST", "/notifications", UpdateNotificationUserController},
 
-	Route{"DELETE", "/notifications/{userID}/{id}", DeleteNotificationController},
+	Route{"PUT", "/preferences/notifications", UpdateNotificationPreferencesController},
+	Route{"PUT", "/inbox/read", ReadAllNotificationsController},
+	Route{"PUT", "/inbox/{id}/read", ReadNotificationController},
+	Route{"PUT", "/webpush/subscription", SubscribeWebPushController},
+
+	Route{"DELETE", "/notifications/{userID}/{id}", DeleteInboxNotificationController},
+	Route{"DELETE", "/inbox/{id}", DeleteInboxNotificationController},
+	Route{"DELETE", "/webpush/subscription", UnsubscribeWebPushController},
+	Route{"DELETE", "/devices/{id}", DeleteDeviceController},
 
 	// Report
 	Route{"PUT", "/report/user/{id}", ReportUserController},
 	Route{"PUT", "/report/{id}/comment/{commentID}", ReportCommentController},
+	Route{"PUT", "/report/post/{id}", ReportPostController},
+	Route{"PUT", "/report/event/{id}", ReportEventController},
+	Route{"PUT", "/report/event/{id}/comment/{commentID}", ReportEventCommentController},
 
 	// Search
 	Route{"POST", "/search/users", SearchUserController},
@@ -146,6 +182,7 @@ var associationRoutes = Routes{
 
 	// Image
 	Route{"POST", "/images", UploadNewImageController},
+	Route{"POST", "/videos", UploadVideoController},
 
 	// Logout
 	Route{"POST", "/logout/association", LogoutAssociationController},
@@ -161,4 +198,34 @@ var superRoutes = Routes{
 	Route{"POST", "/associations", AddAssociationController},
 
 	Route{"DELETE", "/associations/{id}", DeleteAssociationController},
+
+	// Moderation
+	Route{"GET", "/moderation/actions", GetModerationActionsController},
+	Route{"GET", "/moderation/filter", GetContentFilterController},
+
+	Route{"PUT", "/moderation/filter", UpdateContentFilterController},
+
+	Route{"POST", "/posts/{id}/hide", HidePostController},
+	Route{"POST", "/posts/{id}/comment/{commentID}/hide", HidePostCommentController},
+	Route{"POST", "/events/{id}/hide", HideEventController},
+	Route{"POST", "/events/{id}/comment/{commentID}/hide", HideEventCommentController},
+	Route{"POST", "/users/{id}/suspend", SuspendUserController},
+
+	Route{"DELETE", "/posts/{id}/hide", UnhidePostController},
+	Route{"DELETE", "/posts/{id}/comment/{commentID}/hide", UnhidePostCommentController},
+	Route{"DELETE", "/events/{id}/hide", UnhideEventController},
+	Route{"DELETE", "/events/{id}/comment/{commentID}/hide", UnhideEventCommentController},
+	Route{"DELETE", "/users/{id}/suspend", UnsuspendUserController},
+
+	// Reports
+	Route{"GET", "/reports", GetReportsController},
+	Route{"GET", "/reports/{id}", GetReportController},
+
+	Route{"PUT", "/reports/{id}", ResolveReportController},
+
+	// Outbox
+	Route{"GET", "/outbox", GetDeliveriesController},
+
+	Route{"POST", "/outbox/replay", ReplayFailedDeliveriesController},
+	Route{"POST", "/outbox/{id}/replay", ReplayDeliveryController},
 }
@@ -0,0 +1,404 @@
+package insapp
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// S3Config defines how to reach an S3-compatible bucket
+type S3Config struct {
+	// Endpoint is the address of the S3 API, like https://s3.eu-west-3.amazonaws.com
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	// PathStyle puts the bucket in the path of the URLs instead of the
+	// host name, as expected by most self-hosted implementations
+	PathStyle bool
+	// BaseURL overrides the public address of the bucket, like a CDN
+	BaseURL string
+}
+
+// S3BlobStore stores the files in a bucket of an S3-compatible storage.
+// Requests are signed with AWS Signature Version 4.
+// Please refer to https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-authenticating-requests.html
+type S3BlobStore struct {
+	config   S3Config
+	endpoint *url.URL
+	client   *http.Client
+	now      func() time.Time
+}
+
+const (
+	s3Service          = "s3"
+	s3Algorithm        = "AWS4-HMAC-SHA256"
+	s3DateLayout       = "20060102T150405Z"
+	s3DayLayout        = "20060102"
+	defaultS3Region    = "us-east-1"
+	s3ArchivePrefix    = storageArchive + "/"
+	s3RequestTimeout   = time.Minute
+	s3ListMaxKeys      = "1000"
+	s3ErrorBodyMaxSize = 1 << 10
+)
+
+// NewS3BlobStore creates a S3BlobStore for the given bucket
+func NewS3BlobStore(s3Config S3Config) (*S3BlobStore, error) {
+	if s3Config.Endpoint == "" || s3Config.Bucket == "" {
+		return nil, errors.New("the S3 endpoint and bucket are not configured")
+	}
+
+	endpoint, err := url.Parse(strings.TrimSuffix(s3Config.Endpoint, "/"))
+	if err != nil || endpoint.Host == "" || (endpoint.Scheme != "http" && endpoint.Scheme != "https") {
+		return nil, errors.New("wrong S3 endpoint " + s3Config.Endpoint)
+	}
+
+	if s3Config.Region == "" {
+		s3Config.Region = defaultS3Region
+	}
+
+	return &S3BlobStore{
+		config:   s3Config,
+		endpoint: endpoint,
+		client:   &http.Client{Timeout: s3RequestTimeout},
+		now:      time.Now,
+	}, nil
+}
+
+// objectURL returns the address of the given object in the bucket
+func (store *S3BlobStore) objectURL(key string) *url.URL {
+	result := *store.endpoint
+	if store.config.PathStyle {
+		result.Path = "/" + store.config.Bucket + "/" + key
+	} else {
+		result.Host = store.config.Bucket + "." + store.endpoint.Host
+		result.Path = "/" + key
+	}
+
+	return &result
+}
+
+// Put uploads the content as the object with the given name
+func (store *S3BlobStore) Put(name string, content io.Reader, contentType string) error {
+	data, err := ioutil.ReadAll(content)
+	if err != nil {
+		return err
+	}
+
+	if contentType == "" {
+		contentType = contentTypeOf(name)
+	}
+
+	request, err := http.NewRequest("PUT", store.objectURL(name).String(), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", contentType)
+
+	response, err := store.do(request, data)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+
+	return nil
+}
+
+// Get downloads the object with the given name
+func (store *S3BlobStore) Get(name string) (io.ReadCloser, BlobInfo, error) {
+	request, err := http.NewRequest("GET", store.objectURL(name).String(), nil)
+	if err != nil {
+		return nil, BlobInfo{}, err
+	}
+
+	response, err := store.do(request, nil)
+	if err != nil {
+		return nil, BlobInfo{}, err
+	}
+
+	return response.Body, s3BlobInfo(name, response), nil
+}
+
+// Stat describes the object with the given name
+func (store *S3BlobStore) Stat(name string) (BlobInfo, error) {
+	request, err := http.NewRequest("HEAD", store.objectURL(name).String(), nil)
+	if err != nil {
+		return BlobInfo{}, err
+	}
+
+	response, err := store.do(request, nil)
+	if err != nil {
+		return BlobInfo{}, err
+	}
+	response.Body.Close()
+
+	return s3BlobInfo(name, response), nil
+}
+
+func s3BlobInfo(name string, response *http.Response) BlobInfo {
+	modTime, _ := http.ParseTime(response.Header.Get("Last-Modified"))
+	size, _ := strconv.ParseInt(response.Header.Get("Content-Length"), 10, 64)
+
+	return BlobInfo{
+		Name:        name,
+		Size:        size,
+		ModTime:     modTime,
+		ContentType: response.Header.Get("Content-Type"),
+	}
+}
+
+// s3ListResult is the answer of ListObjectsV2
+type s3ListResult struct {
+	Contents []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// List returns the names of the objects of the bucket, except the archived ones
+func (store *S3BlobStore) List() ([]string, error) {
+	var result []string
+	token := ""
+	for {
+		listURL := store.objectURL("")
+		query := url.Values{"list-type": {"2"}, "max-keys": {s3ListMaxKeys}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		listURL.RawQuery = query.Encode()
+
+		request, err := http.NewRequest("GET", listURL.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+
+		response, err := store.do(request, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		var list s3ListResult
+		err = xml.NewDecoder(response.Body).Decode(&list)
+		response.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, object := range list.Contents {
+			if !strings.Contains(object.Key, "/") {
+				result = append(result, object.Key)
+			}
+		}
+
+		if !list.IsTruncated || list.NextContinuationToken == "" {
+			return result, nil
+		}
+		token = list.NextContinuationToken
+	}
+}
+
+// Delete deletes the object with the given name
+func (store *S3BlobStore) Delete(name string) error {
+	if _, err := store.Stat(name); err != nil {
+		return err
+	}
+
+	request, err := http.NewRequest("DELETE", store.objectURL(name).String(), nil)
+	if err != nil {
+		return err
+	}
+
+	response, err := store.do(request, nil)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+
+	return nil
+}
+
+// Archive copies the object with the given name under the "archive/"
+// prefix, then deletes it
+func (store *S3BlobStore) Archive(name string) error {
+	request, err := http.NewRequest("PUT", store.objectURL(s3ArchivePrefix+name).String(), nil)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("X-Amz-Copy-Source", "/"+store.config.Bucket+"/"+s3EscapePath(name))
+
+	response, err := store.do(request, nil)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+
+	return store.Delete(name)
+}
+
+// URL returns the public address of the bucket
+func (store *S3BlobStore) URL() string {
+	if store.config.BaseURL != "" {
+		return strings.TrimSuffix(store.config.BaseURL, "/") + "/"
+	}
+
+	return store.objectURL("").String()
+}
+
+// do signs and sends the request. ErrBlobNotFound is returned if the
+// object does not exist, and an error if the storage refused the request.
+func (store *S3BlobStore) do(request *http.Request, payload []byte) (*http.Response, error) {
+	store.sign(request, payload)
+
+	response, err := store.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode == http.StatusNotFound {
+		response.Body.Close()
+		return nil, ErrBlobNotFound
+	}
+	if response.StatusCode >= 300 {
+		defer response.Body.Close()
+		body, _ := ioutil.ReadAll(io.LimitReader(response.Body, s3ErrorBodyMaxSize))
+		return nil, fmt.Errorf("S3 answered %s: %s", response.Status, strings.TrimSpace(string(body)))
+	}
+
+	return response, nil
+}
+
+// sign adds the AWS Signature Version 4 of the request to its headers.
+// Requests without payload are signed with the hash of an empty payload.
+func (store *S3BlobStore) sign(request *http.Request, payload []byte) {
+	now := store.now().UTC()
+	payloadHash := sha256Hex(payload)
+
+	request.Header.Set("X-Amz-Date", now.Format(s3DateLayout))
+	request.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	// The host is always signed, along with the headers S3 cares about
+	headers := map[string]string{"host": request.URL.Host}
+	for name, values := range request.Header {
+		name = strings.ToLower(name)
+		if strings.HasPrefix(name, "x-amz-") || name == "content-type" || name == "content-md5" || name == "range" {
+			headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		request.Method,
+		s3EscapePath(request.URL.EscapedPath()),
+		s3CanonicalQuery(request.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := now.Format(s3DayLayout) + "/" + store.config.Region + "/" + s3Service + "/aws4_request"
+	stringToSign := strings.Join([]string{
+		s3Algorithm,
+		now.Format(s3DateLayout),
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+store.config.SecretKey), now.Format(s3DayLayout))
+	key = hmacSHA256(key, store.config.Region)
+	key = hmacSHA256(key, s3Service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	request.Header.Set("Authorization", s3Algorithm+
+		" Credential="+store.config.AccessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+
+		", Signature="+signature)
+}
+
+// s3EscapePath encodes a path as expected by S3, every character except
+// the unreserved ones and the slashes being percent-encoded
+func s3EscapePath(path string) string {
+	unescaped, err := url.PathUnescape(path)
+	if err == nil {
+		path = unescaped
+	}
+
+	var result strings.Builder
+	for _, b := range []byte(path) {
+		if b == '/' || s3Unreserved(b) {
+			result.WriteByte(b)
+		} else {
+			result.WriteString(fmt.Sprintf("%%%02X", b))
+		}
+	}
+
+	return result.String()
+}
+
+// s3CanonicalQuery returns the query sorted by key, with keys and values
+// encoded as expected by S3
+func s3CanonicalQuery(query url.Values) string {
+	var parameters []string
+	for key, values := range query {
+		for _, value := range values {
+			parameters = append(parameters, s3EscapeQuery(key)+"="+s3EscapeQuery(value))
+		}
+	}
+	sort.Strings(parameters)
+
+	return strings.Join(parameters, "&")
+}
+
+func s3EscapeQuery(value string) string {
+	var result strings.Builder
+	for _, b := range []byte(value) {
+		if s3Unreserved(b) {
+			result.WriteByte(b)
+		} else {
+			result.WriteString(fmt.Sprintf("%%%02X", b))
+		}
+	}
+
+	return result.String()
+}
+
+func s3Unreserved(b byte) bool {
+	return 'A' <= b && b <= 'Z' || 'a' <= b && b <= 'z' || '0' <= b && b <= '9' ||
+		b == '-' || b == '_' || b == '.' || b == '~'
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
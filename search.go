@@ -0,0 +1,357 @@
+package insapp
+
+import (
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Search defines a search request
+type Search struct {
+	Terms string `json:"terms"`
+	// Page is the page of results to return, starting from 0
+	Page int `json:"page"`
+	// Limit is the number of results by page
+	Limit int `json:"limit"`
+}
+
+// SnippetFragment is a part of the text of a search result. The fragments
+// matching the search are highlighted by clients.
+type SnippetFragment struct {
+	Text  string `json:"text"`
+	Match bool   `json:"match"`
+}
+
+const (
+	searchDefaultLimit = 20
+	searchMaxLimit     = 50
+	// searchMaxCandidates is the number of results ranked for the first
+	// pages, the following pages rank as many results as they need
+	searchMaxCandidates = 200
+	searchMaxTerms      = 10
+	searchMaxTermLength = 50
+	// Names starting with the terms rank before the other text matches
+	searchPrefixScore = 20
+	searchNameWeight  = 10
+	// The snippets show the text around the first match
+	snippetContext  = 60
+	snippetLength   = 200
+	snippetEllipsis = "…"
+)
+
+// searchPrefixFields lists the fields whose words are matched by their
+// beginning, by collection
+var searchPrefixFields = map[string][]string{
+	"user":        {"username", "name"},
+	"association": {"name"},
+}
+
+// ensureSearchIndexes creates the indexes the search relies on. Text
+// indexes ignore accents and, for French, reduce words to their stem.
+// The language of the documents is not read from their "language" field,
+// which holds the language of their notifications. The words of the names
+// are also indexed without accents, to find the names starting with the
+// terms, and filled for the documents saved before.
+func ensureSearchIndexes(session *mgo.Session) {
+	indexes := map[string]mgo.Index{
+		"user": {
+			Key:             []string{"$text:username", "$text:name", "$text:description"},
+			Weights:         map[string]int{"username": searchNameWeight, "name": searchNameWeight, "description": 1},
+			DefaultLanguage: "none",
+		},
+		"association": {
+			Key:             []string{"$text:name", "$text:description"},
+			Weights:         map[string]int{"name": searchNameWeight, "description": 1},
+			DefaultLanguage: "french",
+		},
+		"event": {
+			Key:             []string{"$text:name", "$text:description"},
+			Weights:         map[string]int{"name": searchNameWeight, "description": 1},
+			DefaultLanguage: "french",
+		},
+		"post": {
+			Key:             []string{"$text:title", "$text:description"},
+			Weights:         map[string]int{"title": searchNameWeight, "description": 1},
+			DefaultLanguage: "french",
+		},
+	}
+
+	for collection, index := range indexes {
+		index.Name = "search"
+		index.LanguageOverride = "searchlanguage"
+		index.Background = true
+		err := session.DB("insapp").C(collection).EnsureIndex(index)
+		if err != nil {
+			log.Printf("error creating the search index of %s: %v\n", collection, err)
+		}
+	}
+
+	for collection, fields := range searchPrefixFields {
+		db := session.DB("insapp").C(collection)
+		err := db.EnsureIndex(mgo.Index{Key: []string{"searchprefixes"}, Background: true})
+		if err != nil {
+			log.Printf("error creating the search prefix index of %s: %v\n", collection, err)
+		}
+
+		selection := bson.M{"_id": 1}
+		for _, field := range fields {
+			selection[field] = 1
+		}
+
+		var document bson.M
+		iter := db.Find(bson.M{"searchprefixes": bson.M{"$exists": false}}).Select(selection).Iter()
+		for iter.Next(&document) {
+			var names []string
+			for _, field := range fields {
+				name, _ := document[field].(string)
+				names = append(names, name)
+			}
+			_ = db.UpdateId(document["_id"], bson.M{"$set": bson.M{"searchprefixes": searchPrefixesOf(names...)}})
+			document = nil
+		}
+		if err = iter.Close(); err != nil {
+			log.Printf("error filling the search prefixes of %s: %v\n", collection, err)
+		}
+	}
+}
+
+// searchPrefixesOf returns the words of the names in lower case and without
+// accents, saved in the "searchprefixes" field of the documents
+func searchPrefixesOf(names ...string) []string {
+	result := []string{}
+	seen := map[string]bool{}
+	for _, name := range names {
+		words := strings.FieldsFunc(foldAccents(name), func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		})
+		for _, word := range words {
+			if !seen[word] {
+				seen[word] = true
+				result = append(result, word)
+			}
+		}
+	}
+
+	return result
+}
+
+// searchWords splits the terms in words, leaving out the punctuation and
+// the operators of the text search
+func searchWords(terms string) []string {
+	words := strings.FieldsFunc(terms, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+
+	var result []string
+	for _, word := range words {
+		if len(result) == searchMaxTerms {
+			break
+		}
+		runes := []rune(word)
+		if len(runes) > searchMaxTermLength {
+			runes = runes[:searchMaxTermLength]
+		}
+		result = append(result, string(runes))
+	}
+
+	return result
+}
+
+// searchPage returns the page and the number of results by page of the search
+func searchPage(search Search) (int, int) {
+	page, limit := search.Page, search.Limit
+	if page < 0 {
+		page = 0
+	}
+	if limit <= 0 {
+		limit = searchDefaultLimit
+	}
+	if limit > searchMaxLimit {
+		limit = searchMaxLimit
+	}
+
+	return page, limit
+}
+
+// searchIDs returns the ids of the page of documents of the collection
+// matching the search and the filter, the most relevant first, and whether
+// more documents follow. The documents are found with the text index, and
+// for the collections of searchPrefixFields, with a word of their names
+// starting with each term.
+func searchIDs(collection string, search Search, filter bson.M) ([]bson.ObjectId, bool) {
+	words := searchWords(search.Terms)
+	if len(words) == 0 {
+		return nil, false
+	}
+
+	page, limit := searchPage(search)
+	candidates := searchMaxCandidates
+	if needed := (page+1)*limit + 1; needed > candidates {
+		candidates = needed
+	}
+
+	session := GetMongoSession()
+	defer session.Close()
+	db := session.DB("insapp").C(collection)
+
+	var ids []bson.ObjectId
+	scores := map[bson.ObjectId]float64{}
+	add := func(id bson.ObjectId, score float64) {
+		if _, ok := scores[id]; !ok {
+			ids = append(ids, id)
+		}
+		scores[id] += score
+	}
+
+	var matches []struct {
+		ID    bson.ObjectId `bson:"_id"`
+		Score float64       `bson:"score"`
+	}
+	query := bson.M{"$text": bson.M{"$search": strings.Join(words, " ")}}
+	for key, value := range filter {
+		query[key] = value
+	}
+	_ = db.Find(query).
+		Select(bson.M{"_id": 1, "score": bson.M{"$meta": "textScore"}}).
+		Sort("$textScore:score").
+		Limit(candidates).
+		All(&matches)
+	for _, match := range matches {
+		add(match.ID, match.Score)
+	}
+
+	if _, ok := searchPrefixFields[collection]; ok {
+		// The regular expressions are anchored, so that they use the index
+		var conditions []bson.M
+		for _, word := range words {
+			pattern := bson.RegEx{Pattern: "^" + regexp.QuoteMeta(foldAccents(word))}
+			conditions = append(conditions, bson.M{"searchprefixes": pattern})
+		}
+		if len(filter) > 0 {
+			conditions = append(conditions, filter)
+		}
+
+		var prefixMatches []struct {
+			ID bson.ObjectId `bson:"_id"`
+		}
+		_ = db.Find(bson.M{"$and": conditions}).Select(bson.M{"_id": 1}).Limit(candidates).All(&prefixMatches)
+		for _, match := range prefixMatches {
+			add(match.ID, searchPrefixScore)
+		}
+	}
+
+	sort.SliceStable(ids, func(i, j int) bool {
+		return scores[ids[i]] > scores[ids[j]]
+	})
+
+	return pageOf(ids, page, limit)
+}
+
+// pageOf returns the given page of the ids, and whether more ids follow
+func pageOf(ids []bson.ObjectId, page int, limit int) ([]bson.ObjectId, bool) {
+	if page*limit >= len(ids) {
+		return nil, false
+	}
+	ids = ids[page*limit:]
+	if len(ids) > limit {
+		return ids[:limit], true
+	}
+
+	return ids, false
+}
+
+// foldAccents returns the text in lower case, without accents
+func foldAccents(text string) string {
+	var builder strings.Builder
+	for _, r := range norm.NFD.String(strings.ToLower(text)) {
+		if !unicode.Is(unicode.Mn, r) {
+			builder.WriteRune(r)
+		}
+	}
+
+	return builder.String()
+}
+
+// searchSnippet returns the part of the text around the first word starting
+// with one of the terms, split in fragments matching the terms or not.
+// Nothing is returned if no word matches.
+func searchSnippet(text string, terms string) []SnippetFragment {
+	original := []rune(text)
+
+	// Every folded character points to the character it comes from
+	var folded []rune
+	var origins []int
+	for i, r := range original {
+		for _, f := range foldAccents(string(r)) {
+			folded = append(folded, f)
+			origins = append(origins, i)
+		}
+	}
+
+	isWord := func(r rune) bool { return unicode.IsLetter(r) || unicode.IsDigit(r) }
+	matched := make([]bool, len(original))
+	first := -1
+	for _, word := range searchWords(terms) {
+		pattern := []rune(foldAccents(word))
+		for start := 0; start+len(pattern) <= len(folded); start++ {
+			if start > 0 && isWord(folded[start-1]) || string(folded[start:start+len(pattern)]) != string(pattern) {
+				continue
+			}
+			// The whole word is highlighted, like "concerts" for "concert"
+			end := start + len(pattern)
+			for end < len(folded) && isWord(folded[end]) {
+				end++
+			}
+			for i := start; i < end; i++ {
+				matched[origins[i]] = true
+			}
+			if first == -1 || origins[start] < first {
+				first = origins[start]
+			}
+		}
+	}
+	if first == -1 {
+		return nil
+	}
+
+	start := first - snippetContext
+	if start < 0 {
+		start = 0
+	}
+	// The snippet starts and ends between two words
+	for start > 0 && isWord(original[start-1]) && start < first {
+		start++
+	}
+	end := start + snippetLength
+	if end > len(original) {
+		end = len(original)
+	}
+	for end < len(original) && isWord(original[end]) && end > first {
+		end--
+	}
+
+	var result []SnippetFragment
+	for i := start; i < end; {
+		j := i
+		for j < end && matched[j] == matched[i] {
+			j++
+		}
+		result = append(result, SnippetFragment{Text: string(original[i:j]), Match: matched[i]})
+		i = j
+	}
+
+	if start > 0 {
+		result = append([]SnippetFragment{{Text: snippetEllipsis}}, result...)
+	}
+	if end < len(original) {
+		result = append(result, SnippetFragment{Text: snippetEllipsis})
+	}
+
+	return result
+}
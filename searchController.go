@@ -2,54 +2,110 @@ package insapp
 
 import (
 	"encoding/json"
-	"gopkg.in/mgo.v2/bson"
 	"net/http"
-)
 
-type Search struct {
-	Terms string `json:"terms"`
-}
+	"gopkg.in/mgo.v2/bson"
+)
 
+// SearchUserController will answer a JSON of the users matching the search
 func SearchUserController(w http.ResponseWriter, r *http.Request) {
 	decoder := json.NewDecoder(r.Body)
 	var search Search
-	decoder.Decode(&search)
-	users := SearchUser(search.Terms)
-	json.NewEncoder(w).Encode(bson.M{"users": users})
+	_ = decoder.Decode(&search)
+	v := getViewer(r)
+	users, more := SearchUser(search, v.blocked)
+	page, _ := searchPage(search)
+	_ = json.NewEncoder(w).Encode(bson.M{"users": users, "page": page, "more": more})
 }
 
+// SearchPostController will answer a JSON of the posts matching the search,
+// along with the snippets of their description
 func SearchPostController(w http.ResponseWriter, r *http.Request) {
 	decoder := json.NewDecoder(r.Body)
 	var search Search
-	decoder.Decode(&search)
-	posts := SearchPost(search.Terms)
-	json.NewEncoder(w).Encode(bson.M{"posts": posts})
+	_ = decoder.Decode(&search)
+	v := getViewer(r)
+	posts, more := SearchPost(search, v.moderator)
+	posts = visiblePosts(posts, v)
+	snippets := map[bson.ObjectId][]SnippetFragment{}
+	addPostSnippets(snippets, posts, search.Terms)
+	page, _ := searchPage(search)
+	_ = json.NewEncoder(w).Encode(bson.M{"posts": posts, "snippets": snippets, "page": page, "more": more})
 }
 
+// SearchEventController will answer a JSON of the events matching the
+// search, along with the snippets of their description
 func SearchEventController(w http.ResponseWriter, r *http.Request) {
 	decoder := json.NewDecoder(r.Body)
 	var search Search
-	decoder.Decode(&search)
-	events := SearchEvent(search.Terms)
-	json.NewEncoder(w).Encode(bson.M{"events": events})
+	_ = decoder.Decode(&search)
+	v := getViewer(r)
+	events, more := SearchEvent(search, v.moderator)
+	events = visibleEvents(events, v)
+	snippets := map[bson.ObjectId][]SnippetFragment{}
+	addEventSnippets(snippets, events, search.Terms)
+	page, _ := searchPage(search)
+	_ = json.NewEncoder(w).Encode(bson.M{"events": events, "snippets": snippets, "page": page, "more": more})
 }
 
+// SearchAssociationController will answer a JSON of the associations
+// matching the search, along with the snippets of their description
 func SearchAssociationController(w http.ResponseWriter, r *http.Request) {
 	decoder := json.NewDecoder(r.Body)
 	var search Search
-	decoder.Decode(&search)
-	associations := SearchAssociation(search.Terms)
-	json.NewEncoder(w).Encode(bson.M{"associations": associations})
+	_ = decoder.Decode(&search)
+	associations, more := SearchAssociation(search)
+	snippets := map[bson.ObjectId][]SnippetFragment{}
+	addAssociationSnippets(snippets, associations, search.Terms)
+	page, _ := searchPage(search)
+	_ = json.NewEncoder(w).Encode(bson.M{"associations": associations, "snippets": snippets, "page": page, "more": more})
 }
 
+// SearchUniversalController will answer a JSON of the users, associations,
+// events and posts matching the search, each the most relevant first.
+// More results follow if any of them has another page.
 func SearchUniversalController(w http.ResponseWriter, r *http.Request) {
 	decoder := json.NewDecoder(r.Body)
 	var search Search
-	decoder.Decode(&search)
+	_ = decoder.Decode(&search)
+
+	v := getViewer(r)
+	users, moreUsers := SearchUser(search, v.blocked)
+	posts, morePosts := SearchPost(search, v.moderator)
+	posts = visiblePosts(posts, v)
+	events, moreEvents := SearchEvent(search, v.moderator)
+	events = visibleEvents(events, v)
+	associations, moreAssociations := SearchAssociation(search)
+
+	snippets := map[bson.ObjectId][]SnippetFragment{}
+	addPostSnippets(snippets, posts, search.Terms)
+	addEventSnippets(snippets, events, search.Terms)
+	addAssociationSnippets(snippets, associations, search.Terms)
+	page, _ := searchPage(search)
+	more := moreUsers || morePosts || moreEvents || moreAssociations
+	_ = json.NewEncoder(w).Encode(bson.M{"associations": associations, "users": users, "posts": posts, "events": events, "snippets": snippets, "page": page, "more": more})
+}
+
+func addPostSnippets(snippets map[bson.ObjectId][]SnippetFragment, posts Posts, terms string) {
+	for _, post := range posts {
+		if snippet := searchSnippet(post.Description, terms); snippet != nil {
+			snippets[post.ID] = snippet
+		}
+	}
+}
+
+func addEventSnippets(snippets map[bson.ObjectId][]SnippetFragment, events Events, terms string) {
+	for _, event := range events {
+		if snippet := searchSnippet(event.Description, terms); snippet != nil {
+			snippets[event.ID] = snippet
+		}
+	}
+}
 
-	users := SearchUser(search.Terms)
-	posts := SearchPost(search.Terms)
-	events := SearchEvent(search.Terms)
-	associations := SearchAssociation(search.Terms)
-	json.NewEncoder(w).Encode(bson.M{"associations": associations, "users": users, "posts": posts, "events": events})
+func addAssociationSnippets(snippets map[bson.ObjectId][]SnippetFragment, associations Associations, terms string) {
+	for _, association := range associations {
+		if snippet := searchSnippet(association.Description, terms); snippet != nil {
+			snippets[association.ID] = snippet
+		}
+	}
 }
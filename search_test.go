@@ -0,0 +1,42 @@
+package insapp
+
+import (
+	"reflect"
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestSearchPrefixesOf(t *testing.T) {
+	prefixes := searchPrefixesOf("jdupont", "Jérôme Dupont-Éluard", "")
+	expected := []string{"jdupont", "jerome", "dupont", "eluard"}
+	if !reflect.DeepEqual(prefixes, expected) {
+		t.Errorf("got %q, expected %q", prefixes, expected)
+	}
+
+	if prefixes := searchPrefixesOf(""); prefixes == nil || len(prefixes) != 0 {
+		t.Errorf("got %#v for an empty name, expected an empty list", prefixes)
+	}
+}
+
+func TestPageOf(t *testing.T) {
+	ids := []bson.ObjectId{bson.NewObjectId(), bson.NewObjectId(), bson.NewObjectId(), bson.NewObjectId(), bson.NewObjectId()}
+	cases := []struct {
+		page     int
+		limit    int
+		expected []bson.ObjectId
+		more     bool
+	}{
+		{0, 2, ids[:2], true},
+		{1, 2, ids[2:4], true},
+		{2, 2, ids[4:], false},
+		{0, 5, ids, false},
+		{3, 2, nil, false},
+	}
+	for _, c := range cases {
+		page, more := pageOf(ids, c.page, c.limit)
+		if !reflect.DeepEqual(page, c.expected) || more != c.more {
+			t.Errorf("got %v and %v for the page %d of %d, expected %v and %v", page, more, c.page, c.limit, c.expected, c.more)
+		}
+	}
+}
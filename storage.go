@@ -0,0 +1,293 @@
+package insapp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BlobInfo describes a file of a BlobStore
+type BlobInfo struct {
+	Name        string
+	Size        int64
+	ModTime     time.Time
+	ContentType string
+}
+
+// BlobStore stores the files of the CDN, like the uploaded images
+type BlobStore interface {
+	// Put stores the content under the given name, replacing any previous file
+	Put(name string, content io.Reader, contentType string) error
+	// Get opens the file with the given name. The caller closes it.
+	Get(name string) (io.ReadCloser, BlobInfo, error)
+	// Stat describes the file with the given name
+	Stat(name string) (BlobInfo, error)
+	// List returns the names of the files, archived files left out
+	List() ([]string, error)
+	// Delete permanently deletes the file with the given name
+	Delete(name string) error
+	// Archive moves the file with the given name to the archive
+	Archive(name string) error
+	// URL returns the public address files are served from
+	URL() string
+}
+
+// ErrBlobNotFound is returned by a BlobStore when the file does not exist
+var ErrBlobNotFound = errors.New("file not found")
+
+const (
+	defaultStorageDirectory = "./cdn/"
+	storageArchive          = "archive"
+)
+
+var (
+	blobStore      BlobStore
+	blobStoreMutex sync.RWMutex
+)
+
+// InitStorage builds the store chosen in the configuration. It is called
+// at startup, so that a wrong configuration stops the program right away.
+// Files are stored on the filesystem by default.
+func InitStorage() error {
+	store, err := newBlobStore(config.Storage)
+	if err != nil {
+		return err
+	}
+
+	SetBlobStore(store)
+	return nil
+}
+
+// SetBlobStore replaces the store used for the files of the CDN.
+// It can be called while files are being stored.
+func SetBlobStore(store BlobStore) {
+	blobStoreMutex.Lock()
+	defer blobStoreMutex.Unlock()
+
+	blobStore = store
+}
+
+// getBlobStore returns the store built by InitStorage
+func getBlobStore() BlobStore {
+	blobStoreMutex.RLock()
+	defer blobStoreMutex.RUnlock()
+
+	if blobStore == nil {
+		panic("the storage is not initialized")
+	}
+
+	return blobStore
+}
+
+func newBlobStore(name string) (BlobStore, error) {
+	switch name {
+	case "", "filesystem":
+		directory := config.StorageDirectory
+		if directory == "" {
+			directory = defaultStorageDirectory
+		}
+		return &FileBlobStore{Directory: directory, BaseURL: config.CDNURL}, nil
+	case "s3":
+		store, err := NewS3BlobStore(S3Config{
+			Endpoint:  config.S3Endpoint,
+			Region:    config.S3Region,
+			Bucket:    config.S3Bucket,
+			AccessKey: config.S3AccessKey,
+			SecretKey: config.S3SecretKey,
+			PathStyle: config.S3PathStyle,
+			BaseURL:   config.CDNURL,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error initializing the S3 storage: %v", err)
+		}
+		return store, nil
+	}
+
+	return nil, fmt.Errorf("unknown storage %q", name)
+}
+
+// contentTypeOf returns the content type matching the extension of the file
+func contentTypeOf(name string) string {
+	contentType := mime.TypeByExtension(filepath.Ext(name))
+	if contentType == "" {
+		return "application/octet-stream"
+	}
+
+	return contentType
+}
+
+// FileBlobStore stores the files in a directory of the filesystem,
+// served by a web server
+type FileBlobStore struct {
+	Directory string
+	// BaseURL overrides the address of the web server, deduced from
+	// the domain otherwise
+	BaseURL string
+}
+
+// path returns the path of the file with the given name, making
+// sure it does not escape the directory
+func (store *FileBlobStore) path(name string) (string, error) {
+	if name == "" || name != filepath.Base(name) || strings.HasPrefix(name, ".") {
+		return "", errors.New("wrong file name " + name)
+	}
+
+	return filepath.Join(store.Directory, name), nil
+}
+
+// Put writes the content in the file with the given name
+func (store *FileBlobStore) Put(name string, content io.Reader, contentType string) error {
+	path, err := store.path(name)
+	if err != nil {
+		return err
+	}
+
+	file, err := ioutil.TempFile(store.Directory, ".upload-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	_, err = io.Copy(file, content)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	if err = os.Chmod(file.Name(), 0644); err != nil {
+		return err
+	}
+
+	// Readers never see a partially written file
+	return os.Rename(file.Name(), path)
+}
+
+// Get opens the file with the given name
+func (store *FileBlobStore) Get(name string) (io.ReadCloser, BlobInfo, error) {
+	path, err := store.path(name)
+	if err != nil {
+		return nil, BlobInfo{}, err
+	}
+
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, BlobInfo{}, ErrBlobNotFound
+	}
+	if err != nil {
+		return nil, BlobInfo{}, err
+	}
+
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, BlobInfo{}, err
+	}
+
+	return file, store.info(stat), nil
+}
+
+// Stat describes the file with the given name
+func (store *FileBlobStore) Stat(name string) (BlobInfo, error) {
+	path, err := store.path(name)
+	if err != nil {
+		return BlobInfo{}, err
+	}
+
+	stat, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return BlobInfo{}, ErrBlobNotFound
+	}
+	if err != nil {
+		return BlobInfo{}, err
+	}
+
+	return store.info(stat), nil
+}
+
+func (store *FileBlobStore) info(stat os.FileInfo) BlobInfo {
+	return BlobInfo{
+		Name:        stat.Name(),
+		Size:        stat.Size(),
+		ModTime:     stat.ModTime(),
+		ContentType: contentTypeOf(stat.Name()),
+	}
+}
+
+// List returns the names of the files of the directory, except the
+// files of the web server
+func (store *FileBlobStore) List() ([]string, error) {
+	files, err := ioutil.ReadDir(store.Directory)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []string
+	for _, file := range files {
+		if file.IsDir() || strings.HasPrefix(file.Name(), ".") || file.Name() == "index.html" {
+			continue
+		}
+		result = append(result, file.Name())
+	}
+
+	return result, nil
+}
+
+// Delete removes the file with the given name
+func (store *FileBlobStore) Delete(name string) error {
+	path, err := store.path(name)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(path)
+	if os.IsNotExist(err) {
+		return ErrBlobNotFound
+	}
+
+	return err
+}
+
+// Archive moves the file with the given name in the "archive" sub-directory
+func (store *FileBlobStore) Archive(name string) error {
+	path, err := store.path(name)
+	if err != nil {
+		return err
+	}
+
+	archive := filepath.Join(store.Directory, storageArchive)
+	if err = os.MkdirAll(archive, 0755); err != nil {
+		return err
+	}
+
+	err = os.Rename(path, filepath.Join(archive, name))
+	if os.IsNotExist(err) {
+		return ErrBlobNotFound
+	}
+
+	return err
+}
+
+// URL returns the address of the web server serving the directory
+func (store *FileBlobStore) URL() string {
+	if store.BaseURL != "" {
+		return strings.TrimSuffix(store.BaseURL, "/") + "/"
+	}
+
+	switch config.Environment {
+	case "prod", "dev":
+		return "https://" + config.Domain + "/cdn/"
+	case "local":
+		return "http://" + config.Domain + "/cdn/"
+	}
+
+	return ""
+}
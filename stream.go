@@ -0,0 +1,265 @@
+package insapp
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// StreamEvent is a message pushed in real time to the clients listening
+// to its channel
+type StreamEvent struct {
+	ID      bson.ObjectId   `json:"-" bson:"_id,omitempty"`
+	Channel string          `json:"-"`
+	Type    string          `json:"type"`
+	Data    json.RawMessage `json:"data"`
+	// Sender is the user who caused the event, so that it is not pushed
+	// to the users who blocked them
+	Sender bson.ObjectId `json:"-" bson:"sender,omitempty"`
+}
+
+// The types of StreamEvent
+const (
+	StreamEventNotification = "notification"
+	StreamEventUnread       = "unread"
+	StreamEventComment      = "comment"
+)
+
+// Broker delivers the events published on a channel to its subscribers
+type Broker interface {
+	// Publish sends the event to the subscribers of its channel
+	Publish(event StreamEvent) error
+	// Subscribe returns the events published on the given channels, and a
+	// function to call once the subscriber is not interested anymore
+	Subscribe(channels []string) (<-chan StreamEvent, func())
+}
+
+var (
+	broker     Broker
+	brokerOnce sync.Once
+)
+
+// SetBroker replaces the broker used to stream events
+func SetBroker(newBroker Broker) {
+	brokerOnce.Do(func() {})
+	broker = newBroker
+}
+
+// getBroker returns the broker chosen in the configuration.
+// The "memory" broker is used by default.
+func getBroker() Broker {
+	brokerOnce.Do(func() {
+		switch config.StreamBroker {
+		case "", "memory":
+			broker = NewMemoryBroker()
+		case "mongo":
+			broker = NewMongoBroker()
+		default:
+			log.Printf("unknown stream broker %q, events are only streamed in this instance\n", config.StreamBroker)
+			broker = NewMemoryBroker()
+		}
+	})
+
+	return broker
+}
+
+func userChannel(id bson.ObjectId) string {
+	return "user:" + id.Hex()
+}
+
+func contentChannel(id bson.ObjectId) string {
+	return "content:" + id.Hex()
+}
+
+// publishStreamEvent encodes the data and publishes it on the given channel
+func publishStreamEvent(channel string, eventType string, data interface{}, sender bson.ObjectId) {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		log.Printf("error encoding %s stream event: %v\n", eventType, err)
+		return
+	}
+
+	err = getBroker().Publish(StreamEvent{Channel: channel, Type: eventType, Data: encoded, Sender: sender})
+	if err != nil {
+		log.Printf("error publishing %s stream event: %v\n", eventType, err)
+	}
+}
+
+// publishNotification pushes the new notification, and the new number
+// of unread notifications, to its receiver
+func publishNotification(notification Notification) {
+	publishStreamEvent(userChannel(notification.Receiver), StreamEventNotification, notification, notification.Sender)
+	publishUnreadCount(notification.Receiver)
+}
+
+// publishUnreadCount pushes the number of unread notifications to the given user
+func publishUnreadCount(userID bson.ObjectId) {
+	count := CountUnreadNotificationsForUser(userID)
+	publishStreamEvent(userChannel(userID), StreamEventUnread, bson.M{"count": count}, "")
+}
+
+// publishComment pushes the new comment to the users viewing the given post
+// or event. Hidden comments are not pushed.
+func publishComment(content bson.ObjectId, comment Comment) {
+	if comment.Hidden {
+		return
+	}
+	comment.Reactions = map[string]int{}
+
+	publishStreamEvent(contentChannel(content), StreamEventComment, bson.M{"content": content, "comment": comment}, comment.User)
+}
+
+// MemoryBroker delivers the events to the subscribers of this instance only
+type MemoryBroker struct {
+	mutex       sync.RWMutex
+	subscribers map[string]map[chan StreamEvent]struct{}
+}
+
+// NewMemoryBroker creates an empty MemoryBroker
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{subscribers: map[string]map[chan StreamEvent]struct{}{}}
+}
+
+// Publish sends the event to the subscribers of its channel. Events are
+// dropped for the subscribers too slow to read them.
+func (memoryBroker *MemoryBroker) Publish(event StreamEvent) error {
+	memoryBroker.mutex.RLock()
+	defer memoryBroker.mutex.RUnlock()
+
+	for subscriber := range memoryBroker.subscribers[event.Channel] {
+		select {
+		case subscriber <- event:
+		default:
+		}
+	}
+
+	return nil
+}
+
+// Subscribe returns the events published on the given channels
+func (memoryBroker *MemoryBroker) Subscribe(channels []string) (<-chan StreamEvent, func()) {
+	memoryBroker.mutex.Lock()
+	defer memoryBroker.mutex.Unlock()
+
+	subscriber := make(chan StreamEvent, 16)
+	for _, channel := range channels {
+		if memoryBroker.subscribers[channel] == nil {
+			memoryBroker.subscribers[channel] = map[chan StreamEvent]struct{}{}
+		}
+		memoryBroker.subscribers[channel][subscriber] = struct{}{}
+	}
+
+	unsubscribe := func() {
+		memoryBroker.mutex.Lock()
+		defer memoryBroker.mutex.Unlock()
+
+		for _, channel := range channels {
+			delete(memoryBroker.subscribers[channel], subscriber)
+			if len(memoryBroker.subscribers[channel]) == 0 {
+				delete(memoryBroker.subscribers, channel)
+			}
+		}
+	}
+
+	return subscriber, unsubscribe
+}
+
+// MongoBroker shares the events between several instances of the API
+// through a capped collection, which every instance tails
+type MongoBroker struct {
+	local *MemoryBroker
+}
+
+const streamCollectionSize = 4 * 1024 * 1024
+
+// NewMongoBroker creates a MongoBroker, and starts tailing the events
+func NewMongoBroker() *MongoBroker {
+	session := GetMongoSession()
+	defer session.Close()
+	db := session.DB("insapp").C("stream_event")
+
+	// Fails if the collection already exists, which is fine
+	_ = db.Create(&mgo.CollectionInfo{Capped: true, MaxBytes: streamCollectionSize})
+
+	mongoBroker := &MongoBroker{local: NewMemoryBroker()}
+	go mongoBroker.tail()
+
+	return mongoBroker
+}
+
+// Publish stores the event, so that every instance delivers it
+func (mongoBroker *MongoBroker) Publish(event StreamEvent) error {
+	session := GetMongoSession()
+	defer session.Close()
+	db := session.DB("insapp").C("stream_event")
+
+	event.ID = bson.NewObjectId()
+	return db.Insert(event)
+}
+
+// Subscribe returns the events published on the given channels
+func (mongoBroker *MongoBroker) Subscribe(channels []string) (<-chan StreamEvent, func()) {
+	return mongoBroker.local.Subscribe(channels)
+}
+
+// tail delivers the stored events to the subscribers of this instance.
+// The identifiers come from several instances, so they do not follow the
+// order of the collection: the cursor goes through the events in their
+// natural order, skipping those up to the last one delivered.
+func (mongoBroker *MongoBroker) tail() {
+	last := mongoBroker.newestEvent()
+	for {
+		session := GetMongoSession()
+		db := session.DB("insapp").C("stream_event")
+
+		skipping := last != ""
+		if skipping {
+			// The capped collection may have dropped the last event
+			count, err := db.FindId(last).Count()
+			skipping = err != nil || count > 0
+		}
+
+		iter := db.Find(nil).Sort("$natural").Tail(5 * time.Second)
+		for {
+			var event StreamEvent
+			for iter.Next(&event) {
+				if skipping {
+					skipping = event.ID != last
+				} else {
+					last = event.ID
+					_ = mongoBroker.local.Publish(event)
+				}
+				event = StreamEvent{}
+			}
+			if iter.Err() != nil || !iter.Timeout() {
+				break
+			}
+		}
+		if err := iter.Close(); err != nil {
+			log.Printf("error tailing stream events: %v\n", err)
+		}
+		session.Close()
+
+		time.Sleep(time.Second)
+	}
+}
+
+// newestEvent returns the id of the last event stored before this instance
+// started, so that only the following ones are delivered
+func (mongoBroker *MongoBroker) newestEvent() bson.ObjectId {
+	session := GetMongoSession()
+	defer session.Close()
+	db := session.DB("insapp").C("stream_event")
+
+	var event StreamEvent
+	err := db.Find(nil).Sort("-$natural").One(&event)
+	if err != nil {
+		return ""
+	}
+
+	return event.ID
+}
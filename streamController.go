@@ -0,0 +1,97 @@
+package insapp
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+const streamHeartbeat = 30 * time.Second
+
+// StreamController pushes Server-Sent Events to the current user: new
+// notifications, the number of unread notifications, and the new comments on
+// the posts and events given by the optional ?content= parameters, as long
+// as they are visible to the user.
+// The connection stays open until the client closes it.
+func StreamController(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		_ = json.NewEncoder(w).Encode(bson.M{"error": "streaming is not supported"})
+		return
+	}
+
+	userID, err := GetUserFromRequest(r)
+	if err != nil {
+		w.WriteHeader(http.StatusNotAcceptable)
+		_ = json.NewEncoder(w).Encode(bson.M{"error": "could not get user ID"})
+		return
+	}
+
+	v := getViewer(r)
+	channels := []string{userChannel(userID)}
+	for _, content := range r.URL.Query()["content"] {
+		if !bson.IsObjectIdHex(content) {
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(bson.M{"error": "wrong content ID"})
+			return
+		}
+		if !isContentVisible(bson.ObjectIdHex(content), v) {
+			w.WriteHeader(http.StatusNotFound)
+			_ = json.NewEncoder(w).Encode(bson.M{"error": "content not found"})
+			return
+		}
+		channels = append(channels, contentChannel(bson.ObjectIdHex(content)))
+	}
+
+	events, unsubscribe := getBroker().Subscribe(channels)
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	unread, _ := json.Marshal(bson.M{"count": CountUnreadNotificationsForUser(userID)})
+	writeStreamEvent(w, StreamEvent{Type: StreamEventUnread, Data: unread})
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			_, _ = fmt.Fprint(w, ": ping\n\n")
+		case event := <-events:
+			if event.Sender != "" && containsObjectID(v.blocked, event.Sender) {
+				continue
+			}
+			writeStreamEvent(w, event)
+		}
+		flusher.Flush()
+	}
+}
+
+// isContentVisible returns true if the post or event linked to the given id
+// exists and is not hidden from the viewer
+func isContentVisible(id bson.ObjectId, v viewer) bool {
+	if post := GetPost(id); post.ID != "" {
+		return v.moderator || !post.Hidden
+	}
+	if event := GetEvent(id); event.ID != "" {
+		return v.moderator || !event.Hidden
+	}
+
+	return false
+}
+
+func writeStreamEvent(w http.ResponseWriter, event StreamEvent) {
+	_, _ = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, event.Data)
+}
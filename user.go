@@ -1,6 +1,7 @@
 package insapp
 
 import (
+	"errors"
 	"time"
 
 	"gopkg.in/mgo.v2/bson"
@@ -16,16 +17,23 @@ var genders = []string{"", "female", "male"}
 
 // User defines how to model a User
 type User struct {
-	ID          bson.ObjectId   `bson:"_id,omitempty"`
-	Name        string          `json:"name"`
-	Username    string          `json:"username"`
-	Description string          `json:"description"`
-	Email       string          `json:"email"`
-	EmailPublic bool            `json:"emailpublic"`
-	Promotion   string          `json:"promotion"`
-	Gender      string          `json:"gender"`
-	Events      []bson.ObjectId `json:"events"`
-	PostsLiked  []bson.ObjectId `json:"postsliked"`
+	ID                      bson.ObjectId           `bson:"_id,omitempty"`
+	Name                    string                  `json:"name"`
+	Username                string                  `json:"username"`
+	Description             string                  `json:"description"`
+	Email                   string                  `json:"email"`
+	EmailPublic             bool                    `json:"emailpublic"`
+	Promotion               string                  `json:"promotion"`
+	Gender                  string                  `json:"gender"`
+	Language                string                  `json:"language" bson:"language,omitempty"`
+	Events                  []bson.ObjectId         `json:"events"`
+	PostsLiked              []bson.ObjectId         `json:"postsliked" bson:"-"`
+	SuspendedUntil          time.Time               `json:"suspendeduntil" bson:"suspendeduntil,omitempty"`
+	Blocked                 []bson.ObjectId         `json:"-" bson:"blocked,omitempty"`
+	NotificationPreferences NotificationPreferences `json:"-" bson:"notificationpreferences,omitempty"`
+	DigestToken             string                  `json:"-" bson:"digesttoken,omitempty"`
+	SearchPrefixes          []string                `json:"-" bson:"searchprefixes"`
+	LastDigest              time.Time               `json:"-" bson:"lastdigest,omitempty"`
 }
 
 // AssociationUser defines how to model an AssociationUser
@@ -61,6 +69,7 @@ func AddUser(user *User) User {
 	defer session.Close()
 	db := session.DB("insapp").C("user")
 
+	user.SearchPrefixes = searchPrefixesOf(user.Username, user.Name)
 	db.Insert(user)
 	var result User
 	db.Find(bson.M{"username": user.Username}).One(&result)
@@ -91,14 +100,19 @@ func UpdateUser(id bson.ObjectId, user User) User {
 		}
 	}
 
+	var current User
+	db.FindId(id).One(&current)
+
 	userID := bson.M{"_id": id}
 	change := bson.M{"$set": bson.M{
-		"name":        user.Name,
-		"description": user.Description,
-		"email":       user.Email,
-		"emailpublic": user.EmailPublic,
-		"promotion":   promotion,
-		"gender":      gender,
+		"name":           user.Name,
+		"searchprefixes": searchPrefixesOf(current.Username, user.Name),
+		"description":    user.Description,
+		"email":          user.Email,
+		"emailpublic":    user.EmailPublic,
+		"promotion":      promotion,
+		"gender":         gender,
+		"language":       supportedLanguage(user.Language),
 	}}
 	db.Update(userID, change)
 
@@ -116,6 +130,7 @@ func DeleteUser(user User) User {
 
 	DeleteNotificationsForUser(user.ID)
 	DeleteNotificationTokenForUser(user.ID)
+	MarkReportsTargetDeleted(user.ID)
 
 	for _, eventID := range user.Events {
 		RemoveAttendee(eventID, user.ID, "going")
@@ -123,10 +138,9 @@ func DeleteUser(user User) User {
 		RemoveAttendee(eventID, user.ID, "maybe")
 	}
 
-	for _, postID := range user.PostsLiked {
-		DislikePostWithUser(postID, user.ID)
-	}
+	DeleteReactionsForUser(user.ID)
 
+	db.UpdateAll(bson.M{"blocked": user.ID}, bson.M{"$pull": bson.M{"blocked": user.ID}})
 	DeleteTagsForUser(user.ID)
 	DeleteTagsForUserOnEvents(user.ID)
 	DeleteCommentsForUser(user.ID)
@@ -139,6 +153,17 @@ func DeleteUser(user User) User {
 	return result
 }
 
+// IsSuspended returns true if a moderator suspended the user
+// and the suspension is not over yet
+func (user User) IsSuspended() bool {
+	return user.SuspendedUntil.After(time.Now())
+}
+
+// HasBlocked returns true if the user blocked the user linked to the given id
+func (user User) HasBlocked(id bson.ObjectId) bool {
+	return containsObjectID(user.Blocked, id)
+}
+
 // GetAllUser will return an User object from the given ID
 func GetAllUser() Users {
 	session := GetMongoSession()
@@ -163,35 +188,43 @@ func GetUser(id bson.ObjectId) User {
 	return result
 }
 
-// LikePost will add the postID to the list of liked post
-// of the user linked to the given id
-func LikePost(id bson.ObjectId, postID bson.ObjectId) User {
+// BlockUser will add blockedID to the list of users
+// blocked by the user linked to the given id
+func BlockUser(id bson.ObjectId, blockedID bson.ObjectId) (User, error) {
 	session := GetMongoSession()
 	defer session.Close()
 	db := session.DB("insapp").C("user")
 
+	if id == blockedID {
+		return User{}, errors.New("you can't block yourself")
+	}
+
+	if GetUser(blockedID).ID == "" {
+		return User{}, errors.New("no user found")
+	}
+
 	userID := bson.M{"_id": id}
 	change := bson.M{"$addToSet": bson.M{
-		"postsliked": postID,
+		"blocked": blockedID,
 	}}
 	db.Update(userID, change)
 
 	var result User
 	db.Find(bson.M{"_id": id}).One(&result)
 
-	return result
+	return result, nil
 }
 
-// DislikePost will remove the postID from the list of liked
-// post of the user linked to the given id
-func DislikePost(id bson.ObjectId, postID bson.ObjectId) User {
+// UnblockUser will remove blockedID from the list of users
+// blocked by the user linked to the given id
+func UnblockUser(id bson.ObjectId, blockedID bson.ObjectId) User {
 	session := GetMongoSession()
 	defer session.Close()
 	db := session.DB("insapp").C("user")
 
 	userID := bson.M{"_id": id}
 	change := bson.M{"$pull": bson.M{
-		"postsliked": postID,
+		"blocked": blockedID,
 	}}
 	db.Update(userID, change)
 
@@ -201,6 +234,21 @@ func DislikePost(id bson.ObjectId, postID bson.ObjectId) User {
 	return result
 }
 
+// GetBlockedUsers returns the users blocked by the user linked to the given id
+func GetBlockedUsers(id bson.ObjectId) Users {
+	session := GetMongoSession()
+	defer session.Close()
+	db := session.DB("insapp").C("user")
+
+	result := Users{}
+	blocked := GetUser(id).Blocked
+	if len(blocked) > 0 {
+		db.Find(bson.M{"_id": bson.M{"$in": blocked}}).All(&result)
+	}
+
+	return result
+}
+
 // AddEventToUser will add the eventID to the list
 // of the user's event linked to the given id
 func AddEventToUser(id bson.ObjectId, eventID bson.ObjectId) User {
@@ -239,31 +287,54 @@ func RemoveEventFromUser(id bson.ObjectId, eventID bson.ObjectId) User {
 	return result
 }
 
-func SearchUser(name string) Users {
+// SearchUser returns the users whose username, name or description match
+// the search, the most relevant first, leaving out the given blocked users,
+// and whether more users follow
+func SearchUser(search Search, blocked []bson.ObjectId) (Users, bool) {
+	ids, more := searchIDs("user", search, blockedFilter(blocked))
+	if len(ids) == 0 {
+		return Users{}, false
+	}
+
 	session := GetMongoSession()
 	defer session.Close()
 	db := session.DB("insapp").C("user")
 
-	var result Users
-	db.Find(bson.M{"$or": []interface{}{
-		bson.M{"username": bson.M{"$regex": bson.RegEx{`^.*` + name + `.*`, "i"}}},
-		bson.M{"name": bson.M{"$regex": bson.RegEx{`^.*` + name + `.*`, "i"}}},
-	}}).All(&result)
+	var found Users
+	_ = db.Find(bson.M{"_id": bson.M{"$in": ids}}).All(&found)
 
-	return result
+	byID := map[bson.ObjectId]User{}
+	for _, user := range found {
+		byID[user.ID] = user
+	}
+	result := Users{}
+	for _, id := range ids {
+		if user, ok := byID[id]; ok {
+			result = append(result, user)
+		}
+	}
+
+	return result, more
 }
 
-func ReportUser(id bson.ObjectId, reporterID bson.ObjectId) {
-	session := GetMongoSession()
-	defer session.Close()
-	db := session.DB("insapp").C("user")
+// ReportUser records a report made by the given reporter on the user linked
+// to the given id
+func ReportUser(id bson.ObjectId, reporterID bson.ObjectId, category string, reason string) (Report, error) {
+	user := GetUser(id)
+	if user.ID == "" {
+		return Report{}, errors.New("no user found")
+	}
+
+	report, duplicate := AddReport(Report{
+		Reporter:   reporterID,
+		TargetType: ReportTargetUser,
+		Target:     user.ID,
+		Category:   category,
+		Reason:     reason,
+	})
+	if !duplicate {
+		sendReportEmail(report, user.Username+"\n"+user.Name+"\n"+user.Description)
+	}
 
-	var user User
-	db.Find(bson.M{"_id": id}).One(&user)
-	var reporter User
-	db.Find(bson.M{"_id": reporterID}).One(&reporter)
-	SendEmail("aeir@insa-rennes.fr", "Un utilisateur a été reporté sur Insapp",
-		"Cet utilisateur a été reporté le "+time.Now().String()+
-			"\n\nReporteur:\n"+reporter.ID.Hex()+"\n"+reporter.Username+"\n"+reporter.Name+
-			"\n\nSignaler:\n"+user.ID.Hex()+"\n"+user.Username+"\n"+user.Name+"\n"+user.Description)
+	return report, nil
 }
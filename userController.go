@@ -57,6 +57,7 @@ func GetUserController(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	userID := vars["id"]
 	var res = GetUser(bson.ObjectIdHex(userID))
+	fillPostsLiked(&res)
 	json.NewEncoder(w).Encode(res)
 }
 
@@ -86,6 +87,7 @@ func UpdateUserController(w http.ResponseWriter, r *http.Request) {
 	userID := vars["id"]
 
 	res := UpdateUser(bson.ObjectIdHex(userID), user)
+	fillPostsLiked(&res)
 	json.NewEncoder(w).Encode(res)
 }
 
@@ -104,6 +106,8 @@ func DeleteUserController(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(res)
 }
 
+// ReportUserController will answer a JSON of the report
+// made on the user linked to the given id in the URL
 func ReportUserController(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id := vars["id"]
@@ -115,6 +119,67 @@ func ReportUserController(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	ReportUser(bson.ObjectIdHex(id), userID)
-	json.NewEncoder(w).Encode(bson.M{})
+	request := decodeReportRequest(r)
+	res, err := ReportUser(bson.ObjectIdHex(id), userID, request.Category, request.Reason)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(bson.M{"error": err.Error()})
+		return
+	}
+
+	json.NewEncoder(w).Encode(res)
+}
+
+// GetBlockedUsersController will answer a JSON of the users
+// blocked by the current user
+func GetBlockedUsersController(w http.ResponseWriter, r *http.Request) {
+	userID, err := GetUserFromRequest(r)
+	if err != nil {
+		w.WriteHeader(http.StatusNotAcceptable)
+		json.NewEncoder(w).Encode(bson.M{"error": "could not get user ID"})
+		return
+	}
+
+	res := GetBlockedUsers(userID)
+	json.NewEncoder(w).Encode(bson.M{"users": res})
+}
+
+// BlockUserController will answer a JSON of the users blocked by the
+// current user, once the user linked to the given id in the URL is added
+func BlockUserController(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	userID, err := GetUserFromRequest(r)
+	if err != nil {
+		w.WriteHeader(http.StatusNotAcceptable)
+		json.NewEncoder(w).Encode(bson.M{"error": "could not get user ID"})
+		return
+	}
+
+	_, err = BlockUser(userID, bson.ObjectIdHex(id))
+	if err != nil {
+		w.WriteHeader(http.StatusNotAcceptable)
+		json.NewEncoder(w).Encode(bson.M{"error": err.Error()})
+		return
+	}
+
+	json.NewEncoder(w).Encode(bson.M{"users": GetBlockedUsers(userID)})
+}
+
+// UnblockUserController will answer a JSON of the users blocked by the
+// current user, once the user linked to the given id in the URL is removed
+func UnblockUserController(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	userID, err := GetUserFromRequest(r)
+	if err != nil {
+		w.WriteHeader(http.StatusNotAcceptable)
+		json.NewEncoder(w).Encode(bson.M{"error": "could not get user ID"})
+		return
+	}
+
+	UnblockUser(userID, bson.ObjectIdHex(id))
+	json.NewEncoder(w).Encode(bson.M{"users": GetBlockedUsers(userID)})
 }
@@ -6,6 +6,8 @@ import (
 	"encoding/hex"
 	"math/rand"
 	"time"
+
+	"gopkg.in/mgo.v2/bson"
 )
 
 func GeneratePassword() string {
@@ -77,3 +79,12 @@ func contains(a string, list []string) bool {
 	}
 	return false
 }
+
+func containsObjectID(list []bson.ObjectId, id bson.ObjectId) bool {
+	for _, element := range list {
+		if element == id {
+			return true
+		}
+	}
+	return false
+}
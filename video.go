@@ -0,0 +1,379 @@
+package insapp
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// The types of the media of posts and events
+const (
+	MediaTypeImage = "image"
+	MediaTypeGIF   = "gif"
+	MediaTypeVideo = "video"
+)
+
+// The errors returned when an uploaded video is refused
+var (
+	ErrVideoTooLarge    = errors.New("the video is too large")
+	ErrVideoTooLong     = errors.New("the video is too long")
+	ErrVideoFormat      = errors.New("the video format is not supported")
+	ErrVideoUnsupported = errors.New("videos are not supported by this server")
+)
+
+const (
+	defaultVideoMaxSize     = 50 << 20
+	defaultVideoMaxDuration = 60
+	defaultVideoEncoder     = "ffmpeg"
+	videoFormat             = "mp4"
+	// Remuxing copies the tracks without encoding them, which is quick
+	videoEncoderTimeout = 2 * time.Minute
+	// mp4HeaderSize is the size of the header of a box, without large size
+	mp4HeaderSize = 8
+)
+
+// videoMaxSize returns the maximum size of an uploaded video, in bytes
+func videoMaxSize() int64 {
+	if config != nil && config.VideoMaxSize > 0 {
+		return config.VideoMaxSize
+	}
+
+	return defaultVideoMaxSize
+}
+
+// videoMaxDuration returns the maximum duration of an uploaded video, in seconds
+func videoMaxDuration() float64 {
+	if config != nil && config.VideoMaxDuration > 0 {
+		return config.VideoMaxDuration
+	}
+
+	return defaultVideoMaxDuration
+}
+
+// videoEncoder returns the path of ffmpeg, which remuxes the videos and
+// extracts their poster frame
+func videoEncoder() (string, error) {
+	encoder := defaultVideoEncoder
+	if config != nil && config.VideoEncoder != "" {
+		encoder = config.VideoEncoder
+	}
+
+	encoder, err := exec.LookPath(encoder)
+	if err != nil {
+		return "", ErrVideoUnsupported
+	}
+
+	return encoder, nil
+}
+
+// UploadVideo will upload the MP4 video of a POST request, named after its
+// content. The video is remuxed without its metadata, and its first frame
+// is stored as its poster image. Uploading a video already stored gives
+// the existing one.
+func UploadVideo(w http.ResponseWriter, r *http.Request) (Image, error) {
+	encoder, err := videoEncoder()
+	if err != nil {
+		return Image{}, err
+	}
+
+	upload, err := readUploadedVideo(w, r)
+	if err != nil {
+		return Image{}, err
+	}
+	defer os.Remove(upload)
+
+	// Only the first video and audio tracks are kept, without the
+	// metadata like the position of phone videos. The index is moved
+	// at the beginning so that the video can be played while downloading.
+	remuxed := upload + "." + videoFormat
+	defer os.Remove(remuxed)
+	err = runVideoEncoder(encoder, "-i", upload,
+		"-map", "0:v:0", "-map", "0:a:0?", "-c", "copy",
+		"-map_metadata", "-1", "-map_chapters", "-1",
+		"-movflags", "+faststart", "-f", videoFormat, remuxed)
+	if err != nil {
+		return Image{}, ErrVideoFormat
+	}
+
+	duration, err := mp4Duration(remuxed)
+	if err != nil {
+		return Image{}, ErrVideoFormat
+	}
+	if duration > videoMaxDuration() {
+		return Image{}, ErrVideoTooLong
+	}
+
+	fileName, err := hashFile(remuxed)
+	if err != nil {
+		return Image{}, err
+	}
+	fileName += "." + videoFormat
+
+	if existing, err := GetImage(fileName); err == nil && existing.Poster != "" {
+		// The video was uploaded again, it must not be collected before being used
+		touchImage(fileName)
+		touchImage(existing.Poster)
+		return existing, nil
+	}
+
+	poster, err := extractPoster(encoder, remuxed)
+	if err != nil {
+		return Image{}, err
+	}
+
+	file, err := os.Open(remuxed)
+	if err != nil {
+		return Image{}, err
+	}
+	defer file.Close()
+
+	err = getBlobStore().Put(fileName, file, "video/"+videoFormat)
+	if err != nil {
+		return Image{}, err
+	}
+
+	session := GetMongoSession()
+	defer session.Close()
+	db := session.DB("insapp").C("image")
+
+	// The references are kept, as the video may already be used
+	_, err = db.UpsertId(fileName, bson.M{
+		"$set": bson.M{
+			"type":        MediaTypeVideo,
+			"width":       poster.Width,
+			"height":      poster.Height,
+			"duration":    duration,
+			"poster":      poster.Name,
+			"placeholder": poster.Placeholder,
+		},
+		"$setOnInsert": bson.M{"date": time.Now()},
+	})
+	if err != nil {
+		return Image{}, err
+	}
+
+	return GetImage(fileName)
+}
+
+// readUploadedVideo copies the video of a POST request in a temporary file,
+// after checking it is a MP4 video. The caller removes the file. The
+// connection is closed if the request is too large.
+func readUploadedVideo(w http.ResponseWriter, r *http.Request) (string, error) {
+	maxSize := videoMaxSize()
+	r.Body = http.MaxBytesReader(w, r.Body, maxSize+imageUploadOverhead)
+	err := r.ParseMultipartForm(32 << 20)
+	if err != nil {
+		if errors.As(err, new(*http.MaxBytesError)) {
+			return "", ErrVideoTooLarge
+		}
+		return "", err
+	}
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	if header.Size > maxSize {
+		return "", ErrVideoTooLarge
+	}
+
+	// MP4 files start with a "ftyp" box
+	incipit := make([]byte, mp4HeaderSize)
+	_, err = io.ReadFull(file, incipit)
+	if err != nil || string(incipit[4:]) != "ftyp" {
+		return "", ErrVideoFormat
+	}
+
+	upload, err := ioutil.TempFile("", "insapp-video-")
+	if err != nil {
+		return "", err
+	}
+
+	_, err = upload.Write(incipit)
+	if err == nil {
+		_, err = io.Copy(upload, io.LimitReader(file, maxSize))
+	}
+	if closeErr := upload.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(upload.Name())
+		return "", err
+	}
+
+	return upload.Name(), nil
+}
+
+// extractPoster stores the first frame of the video as an image, along with
+// its variants and placeholder
+func extractPoster(encoder string, video string) (Image, error) {
+	frame := video + ".png"
+	defer os.Remove(frame)
+	err := runVideoEncoder(encoder, "-i", video, "-frames:v", "1", "-f", "image2", "-c:v", "png", frame)
+	if err != nil {
+		return Image{}, ErrVideoFormat
+	}
+
+	data, err := ioutil.ReadFile(frame)
+	if err != nil {
+		return Image{}, err
+	}
+
+	// The frame goes through the checks of the uploaded images
+	data, format, err := sanitizeImage(data)
+	if err != nil {
+		return Image{}, err
+	}
+
+	fileName := contentAddressedName(data, format)
+	if _, err = getBlobStore().Stat(fileName); err != nil {
+		err = getBlobStore().Put(fileName, bytes.NewReader(data), "image/"+format)
+		if err != nil {
+			return Image{}, err
+		}
+	}
+
+	poster, err := ProcessImage(fileName)
+	if err == nil && len(poster.Palette) == 0 {
+		ExtractImagePalette(fileName)
+	}
+
+	return poster, err
+}
+
+// runVideoEncoder runs ffmpeg with the given arguments, killing it if it
+// takes longer than videoEncoderTimeout
+func runVideoEncoder(encoder string, arguments ...string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), videoEncoderTimeout)
+	defer cancel()
+
+	arguments = append([]string{"-v", "error", "-y"}, arguments...)
+	output, err := exec.CommandContext(ctx, encoder, arguments...).CombinedOutput()
+	if ctx.Err() == context.DeadlineExceeded {
+		return ctx.Err()
+	}
+	if err != nil {
+		return errors.New(strings.TrimSpace(string(output)) + " " + err.Error())
+	}
+
+	return nil
+}
+
+// hashFile returns the SHA-256 of the file, in hexadecimal
+func hashFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err = io.Copy(hash, file); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// mp4Duration reads the duration of the MP4 file in its movie header, in
+// seconds. Please refer to ISO/IEC 14496-12, 8.2.2.
+func mp4Duration(path string) (float64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	moov, moovSize, err := findMP4Box(file, 0, stat.Size(), "moov")
+	if err != nil {
+		return 0, err
+	}
+	mvhd, mvhdSize, err := findMP4Box(file, moov, moovSize, "mvhd")
+	if err != nil {
+		return 0, err
+	}
+
+	// Version 1 headers have 64 bits dates and duration
+	header := make([]byte, 32)
+	if mvhdSize < 20 {
+		return 0, ErrVideoFormat
+	}
+	if mvhdSize < int64(len(header)) {
+		header = header[:mvhdSize]
+	}
+	if _, err = file.ReadAt(header, mvhd); err != nil && err != io.EOF {
+		return 0, err
+	}
+
+	var timescale uint32
+	var duration uint64
+	switch {
+	case header[0] == 0:
+		timescale = binary.BigEndian.Uint32(header[12:])
+		duration = uint64(binary.BigEndian.Uint32(header[16:]))
+	case header[0] == 1 && len(header) == 32:
+		timescale = binary.BigEndian.Uint32(header[20:])
+		duration = binary.BigEndian.Uint64(header[24:])
+	default:
+		return 0, ErrVideoFormat
+	}
+	if timescale == 0 {
+		return 0, ErrVideoFormat
+	}
+
+	return float64(duration) / float64(timescale), nil
+}
+
+// findMP4Box returns the offset and the size of the content of the first box
+// of the given type, between the given offset and the given size
+func findMP4Box(file io.ReaderAt, offset int64, size int64, boxType string) (int64, int64, error) {
+	end := offset + size
+	header := make([]byte, 16)
+	for offset+mp4HeaderSize <= end {
+		if _, err := file.ReadAt(header[:mp4HeaderSize], offset); err != nil {
+			return 0, 0, ErrVideoFormat
+		}
+
+		boxSize := int64(binary.BigEndian.Uint32(header))
+		headerSize := int64(mp4HeaderSize)
+		switch boxSize {
+		case 0:
+			// The box extends to the end
+			boxSize = end - offset
+		case 1:
+			// The size is given in 64 bits after the type
+			if _, err := file.ReadAt(header[mp4HeaderSize:], offset+mp4HeaderSize); err != nil {
+				return 0, 0, ErrVideoFormat
+			}
+			boxSize = int64(binary.BigEndian.Uint64(header[mp4HeaderSize:]))
+			headerSize += 8
+		}
+		if boxSize < headerSize || offset+boxSize > end {
+			return 0, 0, ErrVideoFormat
+		}
+
+		if string(header[4:mp4HeaderSize]) == boxType {
+			return offset + headerSize, boxSize - headerSize, nil
+		}
+		offset += boxSize
+	}
+
+	return 0, 0, ErrVideoFormat
+}
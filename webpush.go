@@ -0,0 +1,380 @@
+package insapp
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+// WebPushSubscription is the subscription of a browser to Web Push,
+// as given by PushManager.subscribe()
+type WebPushSubscription struct {
+	Endpoint string      `json:"endpoint"`
+	Keys     WebPushKeys `json:"keys"`
+}
+
+// WebPushKeys are the keys of the browser used to encrypt the payload
+type WebPushKeys struct {
+	P256dh string `json:"p256dh"`
+	Auth   string `json:"auth"`
+}
+
+// webPushOs is the os of the devices registered with Web Push
+const webPushOs = "web"
+
+const (
+	webPushTTL        = 24 * time.Hour
+	webPushRecordSize = 4096
+	// Payloads bigger than this are rejected by the push services
+	webPushMaxPayload = 3993
+	webPushTimeout    = 30 * time.Second
+)
+
+// errWebPushAddress is returned when the endpoint of a subscription is not
+// a public address. The server must not be used to reach its own network.
+var errWebPushAddress = errors.New("the endpoint must be a public push service")
+
+// Validate checks the subscription can be used to send push notifications.
+// The endpoint must be served on the https port of a public address.
+func (subscription WebPushSubscription) Validate() error {
+	endpoint, err := url.Parse(subscription.Endpoint)
+	if err != nil || endpoint.Scheme != "https" || endpoint.Hostname() == "" {
+		return errors.New("the endpoint must be an https URL")
+	}
+	if endpoint.Port() != "" && endpoint.Port() != "443" {
+		return errWebPushAddress
+	}
+
+	addresses, err := net.LookupIP(endpoint.Hostname())
+	if err != nil || len(addresses) == 0 {
+		return errWebPushAddress
+	}
+	for _, address := range addresses {
+		if !isPublicAddress(address) {
+			return errWebPushAddress
+		}
+	}
+
+	publicKey, err := decodeWebPushKey(subscription.Keys.P256dh)
+	if err != nil {
+		return errors.New("wrong p256dh key")
+	}
+	if _, err = ecdh.P256().NewPublicKey(publicKey); err != nil {
+		return errors.New("wrong p256dh key")
+	}
+
+	auth, err := decodeWebPushKey(subscription.Keys.Auth)
+	if err != nil || len(auth) != 16 {
+		return errors.New("wrong auth secret")
+	}
+
+	return nil
+}
+
+// isPublicAddress returns false for the loopback, private, link-local,
+// multicast and unspecified addresses, which push services never use
+func isPublicAddress(ip net.IP) bool {
+	return !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsUnspecified() &&
+		!ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() &&
+		!ip.IsInterfaceLocalMulticast() && !ip.IsMulticast()
+}
+
+// newWebPushClient returns a client connecting to public addresses only. The
+// address is checked again when connecting, as the host of the endpoint may
+// resolve to another address than when the subscription was validated.
+// Redirections are not followed.
+func newWebPushClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout: webPushTimeout,
+		Control: func(network string, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !isPublicAddress(ip) {
+				return errWebPushAddress
+			}
+			return nil
+		},
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+
+	return &http.Client{
+		Timeout:   webPushTimeout,
+		Transport: transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// WebPushSender sends push notifications to browsers, with the VAPID
+// keys of the configuration.
+// Please refer to https://tools.ietf.org/html/rfc8030, rfc8291 and rfc8292.
+type WebPushSender struct {
+	publicKey  string
+	privateKey *ecdsa.PrivateKey
+	subject    string
+	client     *http.Client
+}
+
+var (
+	webPushSender     *WebPushSender
+	webPushSenderErr  error
+	webPushSenderOnce sync.Once
+)
+
+// getWebPushSender returns the sender built from the configuration,
+// or an error if the VAPID keys are not configured
+func getWebPushSender() (*WebPushSender, error) {
+	webPushSenderOnce.Do(func() {
+		webPushSender, webPushSenderErr = NewWebPushSender(config.VAPIDPublicKey, config.VAPIDPrivateKey, config.VAPIDSubject)
+	})
+
+	return webPushSender, webPushSenderErr
+}
+
+// NewWebPushSender creates a WebPushSender from the base64url encoded VAPID
+// keys. The subject is a contact address given to the push services.
+func NewWebPushSender(publicKey string, privateKey string, subject string) (*WebPushSender, error) {
+	if publicKey == "" || privateKey == "" {
+		return nil, errors.New("the VAPID keys are not configured")
+	}
+
+	privateBytes, err := decodeWebPushKey(privateKey)
+	if err != nil {
+		return nil, errors.New("wrong VAPID private key")
+	}
+	key, err := ecdsa.ParseRawPrivateKey(elliptic.P256(), privateBytes)
+	if err != nil {
+		return nil, errors.New("wrong VAPID private key")
+	}
+
+	// The public key must be the one of the private key
+	publicBytes, err := decodeWebPushKey(publicKey)
+	if err != nil {
+		return nil, errors.New("wrong VAPID public key")
+	}
+	if ownPublicBytes, err := key.PublicKey.Bytes(); err != nil || !bytes.Equal(publicBytes, ownPublicBytes) {
+		return nil, errors.New("wrong VAPID public key")
+	}
+
+	if !strings.HasPrefix(subject, "mailto:") && !strings.HasPrefix(subject, "https:") {
+		subject = "mailto:" + subject
+	}
+
+	return &WebPushSender{
+		publicKey:  base64.RawURLEncoding.EncodeToString(publicBytes),
+		privateKey: key,
+		subject:    subject,
+		client:     newWebPushClient(),
+	}, nil
+}
+
+// GenerateVAPIDKeys returns a new pair of base64url encoded VAPID keys
+func GenerateVAPIDKeys() (string, string, error) {
+	privateKey, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+
+	publicKey := privateKey.PublicKey().Bytes()
+	return base64.RawURLEncoding.EncodeToString(publicKey), base64.RawURLEncoding.EncodeToString(privateKey.Bytes()), nil
+}
+
+// GetVAPIDPublicKey returns the key browsers need to subscribe to Web Push
+func GetVAPIDPublicKey() (string, error) {
+	sender, err := getWebPushSender()
+	if err != nil {
+		return "", err
+	}
+
+	return sender.publicKey, nil
+}
+
+// Send encrypts the message and sends it to the browser. ErrUnregisteredDevice
+// is returned if the subscription expired.
+func (sender *WebPushSender) Send(message PushMessage, subscription WebPushSubscription) error {
+	payload, err := json.Marshal(struct {
+		Title       string `json:"title"`
+		Body        string `json:"body"`
+		ID          string `json:"id"`
+		ClickAction string `json:"clickaction"`
+	}{message.Title, message.Body, message.ObjectID, message.ClickAction})
+	if err != nil {
+		return err
+	}
+	if len(payload) > webPushMaxPayload {
+		return errors.New("the push notification is too big")
+	}
+
+	body, err := encryptWebPushPayload(payload, subscription.Keys)
+	if err != nil {
+		return err
+	}
+
+	authorization, err := sender.vapidAuthorization(subscription.Endpoint)
+	if err != nil {
+		return err
+	}
+
+	request, err := http.NewRequest("POST", subscription.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/octet-stream")
+	request.Header.Set("Content-Encoding", "aes128gcm")
+	request.Header.Set("TTL", fmt.Sprint(int(webPushTTL.Seconds())))
+	request.Header.Set("Authorization", authorization)
+
+	response, err := sender.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	switch {
+	case response.StatusCode == http.StatusNotFound || response.StatusCode == http.StatusGone:
+		return ErrUnregisteredDevice
+	case response.StatusCode >= 300:
+		return fmt.Errorf("push service answered %s", response.Status)
+	}
+
+	return nil
+}
+
+// vapidAuthorization returns the Authorization header identifying
+// the server to the push service of the endpoint (RFC 8292)
+func (sender *WebPushSender) vapidAuthorization(endpoint string) (string, error) {
+	endpointURL, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{
+		"aud": endpointURL.Scheme + "://" + endpointURL.Host,
+		"exp": time.Now().Add(12 * time.Hour).Unix(),
+		"sub": sender.subject,
+	})
+	signed, err := token.SignedString(sender.privateKey)
+	if err != nil {
+		return "", err
+	}
+
+	return "vapid t=" + signed + ", k=" + sender.publicKey, nil
+}
+
+// encryptWebPushPayload encrypts the payload for the browser owning the
+// given keys, with the aes128gcm content encoding (RFC 8291 and RFC 8188)
+func encryptWebPushPayload(payload []byte, keys WebPushKeys) ([]byte, error) {
+	// A new key pair and salt are used for every message
+	serverKey, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	salt := make([]byte, 16)
+	if _, err = rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	return encryptWebPushRecord(payload, keys, serverKey, salt)
+}
+
+// encryptWebPushRecord encrypts the payload in a single record, with the
+// given key pair of the server and salt
+func encryptWebPushRecord(payload []byte, keys WebPushKeys, serverKey *ecdh.PrivateKey, salt []byte) ([]byte, error) {
+	userAgentPublic, err := decodeWebPushKey(keys.P256dh)
+	if err != nil {
+		return nil, err
+	}
+	userAgentKey, err := ecdh.P256().NewPublicKey(userAgentPublic)
+	if err != nil {
+		return nil, errors.New("wrong p256dh key")
+	}
+
+	authSecret, err := decodeWebPushKey(keys.Auth)
+	if err != nil {
+		return nil, err
+	}
+
+	sharedSecret, err := serverKey.ECDH(userAgentKey)
+	if err != nil {
+		return nil, err
+	}
+	serverPublic := serverKey.PublicKey().Bytes()
+
+	keyInfo := append([]byte("WebPush: info\x00"), userAgentPublic...)
+	keyInfo = append(keyInfo, serverPublic...)
+	ikm := hkdfExpand(hkdfExtract(authSecret, sharedSecret), keyInfo, 32)
+
+	prk := hkdfExtract(salt, ikm)
+	contentKey := hkdfExpand(prk, []byte("Content-Encoding: aes128gcm\x00"), 16)
+	nonce := hkdfExpand(prk, []byte("Content-Encoding: nonce\x00"), 12)
+
+	block, err := aes.NewCipher(contentKey)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	// A single record, ended by the last record delimiter
+	plaintext := append(append([]byte{}, payload...), 0x02)
+
+	header := make([]byte, 0, 16+4+1+len(serverPublic))
+	header = append(header, salt...)
+	recordSize := make([]byte, 4)
+	binary.BigEndian.PutUint32(recordSize, webPushRecordSize)
+	header = append(header, recordSize...)
+	header = append(header, byte(len(serverPublic)))
+	header = append(header, serverPublic...)
+
+	return gcm.Seal(header, nonce, plaintext, nil), nil
+}
+
+// hkdfExtract is the extract step of HKDF with SHA-256 (RFC 5869)
+func hkdfExtract(salt []byte, ikm []byte) []byte {
+	mac := hmac.New(sha256.New, salt)
+	mac.Write(ikm)
+	return mac.Sum(nil)
+}
+
+// hkdfExpand is the expand step of HKDF with SHA-256 (RFC 5869),
+// limited to a single block as Web Push never needs more than 32 bytes
+func hkdfExpand(prk []byte, info []byte, length int) []byte {
+	mac := hmac.New(sha256.New, prk)
+	mac.Write(info)
+	mac.Write([]byte{0x01})
+	return mac.Sum(nil)[:length]
+}
+
+// decodeWebPushKey decodes a base64url key, padded or not
+func decodeWebPushKey(key string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(key, "="))
+}
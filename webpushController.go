@@ -0,0 +1,79 @@
+package insapp
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// GetVAPIDPublicKeyController will answer the public key
+// browsers need to subscribe to Web Push
+func GetVAPIDPublicKeyController(w http.ResponseWriter, r *http.Request) {
+	key, err := GetVAPIDPublicKey()
+	if err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_ = json.NewEncoder(w).Encode(bson.M{"error": err.Error()})
+		return
+	}
+
+	_ = json.NewEncoder(w).Encode(bson.M{"publickey": key})
+}
+
+// SubscribeWebPushController will answer a JSON of the devices of the
+// current user, once the browser subscription in the JSON body is registered
+func SubscribeWebPushController(w http.ResponseWriter, r *http.Request) {
+	userID, err := GetUserFromRequest(r)
+	if err != nil {
+		w.WriteHeader(http.StatusNotAcceptable)
+		_ = json.NewEncoder(w).Encode(bson.M{"error": "could not get user ID"})
+		return
+	}
+
+	var subscription WebPushSubscription
+	_ = json.NewDecoder(r.Body).Decode(&subscription)
+	err = subscription.Validate()
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(bson.M{"error": err.Error()})
+		return
+	}
+
+	err = CreateOrUpdateNotificationUser(NotificationUser{
+		UserId:  userID,
+		Token:   subscription.Endpoint,
+		Os:      webPushOs,
+		WebPush: &subscription.Keys,
+	})
+	if err == ErrDeviceOwned {
+		w.WriteHeader(http.StatusConflict)
+		_ = json.NewEncoder(w).Encode(bson.M{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		_ = json.NewEncoder(w).Encode(bson.M{"error": "unable to register the subscription"})
+		return
+	}
+
+	_ = json.NewEncoder(w).Encode(bson.M{"devices": GetNotificationUsersForUser(userID)})
+}
+
+// UnsubscribeWebPushController will answer a JSON of the devices of the current
+// user, once the browser subscription with the given endpoint is removed
+func UnsubscribeWebPushController(w http.ResponseWriter, r *http.Request) {
+	userID, err := GetUserFromRequest(r)
+	if err != nil {
+		w.WriteHeader(http.StatusNotAcceptable)
+		_ = json.NewEncoder(w).Encode(bson.M{"error": "could not get user ID"})
+		return
+	}
+
+	var subscription WebPushSubscription
+	_ = json.NewDecoder(r.Body).Decode(&subscription)
+	if subscription.Endpoint != "" {
+		DeleteNotificationUserWithToken(userID, subscription.Endpoint)
+	}
+
+	_ = json.NewEncoder(w).Encode(bson.M{"devices": GetNotificationUsersForUser(userID)})
+}
@@ -0,0 +1,88 @@
+package insapp
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"testing"
+)
+
+// The example of RFC 8291, Appendix A
+func TestEncryptWebPushRecord(t *testing.T) {
+	decode := func(value string) []byte {
+		decoded, err := decodeWebPushKey(value)
+		if err != nil {
+			t.Fatalf("decoding %q: %v", value, err)
+		}
+		return decoded
+	}
+
+	serverKey, err := ecdh.P256().NewPrivateKey(decode("yfWPiYE-n46HLnH0KqZOF1fJJU3MYrct3AELtAQ-oRw"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := WebPushKeys{
+		P256dh: "BCVxsr7N_eNgVRqvHtD0zTZsEc6-VV-JvLexhqUzORcxaOzi6-AYWXvTBHm4bjyPjs7Vd8pZGH6SRpkNtoIAiw4",
+		Auth:   "BTBZMqHH6r4Tts7J_aSIgg",
+	}
+	salt := decode("DGv6ra1nlYgDCS1FRnbzlw")
+
+	result, err := encryptWebPushRecord([]byte("When I grow up, I want to be a watermelon"), keys, serverKey, salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := decode("DGv6ra1nlYgDCS1FRnbzlwAAEABBBP4z9KsN6nGRTbVYI_c7VJSPQTBtkgcy27mlmlMoZIIgDll6e3vCYLocInmYWAmS6TlzAC8wEqKK6PBru3jl7A_yl95bQpu6cVPTpK4Mqgkf1CXztLVBSt2Ks3oZwbuwXPXLWyouBWLVWGNWQexSgSxsj_Qulcy4a-fN")
+	if !bytes.Equal(result, expected) {
+		t.Errorf("got %x, want %x", result, expected)
+	}
+}
+
+func TestValidateRejectsPrivateEndpoints(t *testing.T) {
+	keys := WebPushKeys{
+		P256dh: "BCVxsr7N_eNgVRqvHtD0zTZsEc6-VV-JvLexhqUzORcxaOzi6-AYWXvTBHm4bjyPjs7Vd8pZGH6SRpkNtoIAiw4",
+		Auth:   "BTBZMqHH6r4Tts7J_aSIgg",
+	}
+	endpoints := []string{
+		"http://push.example.com/send",
+		"https://127.0.0.1/send",
+		"https://10.1.2.3/send",
+		"https://192.168.0.1/send",
+		"https://169.254.169.254/latest/meta-data",
+		"https://[::1]/send",
+		"https://0.0.0.0/send",
+		"https://8.8.8.8:8443/send",
+	}
+	for _, endpoint := range endpoints {
+		if err := (WebPushSubscription{Endpoint: endpoint, Keys: keys}).Validate(); err == nil {
+			t.Errorf("endpoint %q accepted", endpoint)
+		}
+	}
+
+	// Addresses are not looked up, so this works offline
+	if err := (WebPushSubscription{Endpoint: "https://8.8.8.8/send", Keys: keys}).Validate(); err != nil {
+		t.Errorf("public endpoint refused: %v", err)
+	}
+}
+
+func TestNewWebPushSenderWithGeneratedKeys(t *testing.T) {
+	publicKey, privateKey, err := GenerateVAPIDKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sender, err := NewWebPushSender(publicKey, privateKey, "contact@insapp.fr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sender.publicKey != publicKey || sender.subject != "mailto:contact@insapp.fr" {
+		t.Errorf("unexpected sender %+v", sender)
+	}
+
+	otherPublicKey, _, err := GenerateVAPIDKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = NewWebPushSender(otherPublicKey, privateKey, "contact@insapp.fr"); err == nil {
+		t.Error("mismatched VAPID keys accepted")
+	}
+}